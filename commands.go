@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"main.go/helper"
+)
+
+// runCommand runs a maintenance command instead of provisioning.
+func runCommand(args []string) {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+
+	switch args[0] {
+	case "launch-template-diff":
+		flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+		name := flags.String("name", Settings.LaunchTemplateName, "launch template name")
+		from := flags.String("from", "$Default", "version to compare from")
+		to := flags.String("to", "$Latest", "version to compare to")
+		flags.Parse(args[1:])
+
+		changes, err := helper.DiffLaunchTemplateVersions(ec2.NewFromConfig(cfg), *name, *from, *to)
+		if err != nil {
+			log.Fatalf("unable to diff launch template versions: %v", err)
+		}
+		if len(changes) == 0 {
+			fmt.Printf("Versions %s and %s of %s are identical\n", *from, *to, *name)
+		}
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+	case "teardown":
+		flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+		reportPath := flags.String("report", Settings.RunOutputFile, "run report of the provisioning run to tear down")
+		flags.Parse(args[1:])
+
+		if err := teardown(cfg, *reportPath); err != nil {
+			log.Fatalf("teardown failed: %v", err)
+		}
+	case "ssm":
+		if len(args) < 2 || args[1] != "run" {
+			log.Fatalf("unknown ssm command, expected ssm run")
+		}
+		var options helper.FleetCommandOptions
+		flags := flag.NewFlagSet("ssm run", flag.ExitOnError)
+		flags.Func("tag", "run on instances with the tag, Key=Value1,Value2 or Key; repeat to require several", options.Targets.AddTag)
+		flags.StringVar(&options.Targets.ResourceGroup, "resource-group", "", "run on the instances of the resource group")
+		flags.StringVar(&options.MaxConcurrency, "max-concurrency", "", "instances running the command at once, a number or percentage")
+		flags.StringVar(&options.MaxErrors, "max-errors", "", "failed instances after which the command is not sent to more")
+		flags.StringVar(&options.Comment, "comment", "", "comment shown with the command in the console")
+		flags.Parse(args[2:])
+		if flags.NArg() == 0 {
+			log.Fatalf("no commands given, expected ssm run [flags] command...")
+		}
+
+		result, err := helper.RunFleetCommand(ssm.NewFromConfig(cfg), flags.Args(), options, waitOptions())
+		if result != nil {
+			for _, instance := range result.Instances {
+				if instance.Output != "" {
+					fmt.Printf("==> %s (%s)\n%s\n", instance.InstanceID, instance.Status, instance.Output)
+				}
+			}
+			if summaryErr := helper.WriteFleetSummary(os.Stdout, result); summaryErr != nil {
+				log.Printf("Unable to write summary: %v\n", summaryErr)
+			}
+		}
+		if err != nil {
+			log.Fatalf("ssm run failed: %v", err)
+		}
+	default:
+		log.Fatalf("unknown command %s, expected launch-template-diff, teardown or ssm run", args[0])
+	}
+}
+
+// teardown removes the DNS record, spot requests, instances and Elastic IPs recorded in a run
+// report. The IAM role and security group are kept, as later runs reuse them.
+func teardown(cfg aws.Config, reportPath string) error {
+	runReport, err := helper.ReadRunReport(reportPath)
+	if err != nil {
+		return err
+	}
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	var errs []error
+	if runReport.DNSRecord != nil {
+		errs = append(errs, helper.DeleteDNSRecord(route53.NewFromConfig(cfg), *runReport.DNSRecord))
+	}
+
+	var instanceIDs, spotRequests []string
+	for _, instance := range runReport.Instances {
+		instanceIDs = append(instanceIDs, instance.InstanceID)
+		if instance.SpotRequestID != "" {
+			spotRequests = append(spotRequests, instance.SpotRequestID)
+		}
+	}
+	if len(spotRequests) > 0 {
+		if err := helper.CancelSpotRequests(ec2Client, spotRequests); err != nil {
+			// A persistent request would replace the terminated instances
+			return fmt.Errorf("%s", joinErrors(append(errs, err)...))
+		}
+	}
+	if len(instanceIDs) > 0 {
+		if err := helper.TerminateInstances(ec2Client, instanceIDs); err != nil {
+			// Elastic IPs cannot be released while still associated
+			return fmt.Errorf("%s", joinErrors(append(errs, err)...))
+		}
+	}
+	for _, instance := range runReport.Instances {
+		if instance.Network.ElasticIPAllocationID != "" {
+			errs = append(errs, helper.ReleaseElasticIP(ec2Client, instance.Network.ElasticIPAllocationID))
+		}
+	}
+
+	if message := joinErrors(errs...); message != "" {
+		return fmt.Errorf("%s", message)
+	}
+	log.Printf("Tore down the resources recorded in %s\n", reportPath)
+	return nil
+}
@@ -0,0 +1,172 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// How an AMI ID was obtained
+const (
+	AMISourceDirect       = "direct"
+	AMISourceSSMParameter = "ssm-parameter"
+	AMISourceImageFilter  = "image-filter"
+)
+
+// amiAlias describes where the current image of an alias is looked up.
+// Aliases with an SSM public parameter use it, the others search images by name.
+type amiAlias struct {
+	SSMParameter string
+	NamePattern  string
+	Owners       []string
+}
+
+var amiAliases = map[string]amiAlias{
+	"ubuntu-22.04-amd64": {SSMParameter: "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id"},
+	"ubuntu-22.04-arm64": {SSMParameter: "/aws/service/canonical/ubuntu/server/22.04/stable/current/arm64/hvm/ebs-gp2/ami-id"},
+	"ubuntu-24.04-amd64": {SSMParameter: "/aws/service/canonical/ubuntu/server/24.04/stable/current/amd64/hvm/ebs-gp3/ami-id"},
+	"ubuntu-24.04-arm64": {SSMParameter: "/aws/service/canonical/ubuntu/server/24.04/stable/current/arm64/hvm/ebs-gp3/ami-id"},
+	"debian-12-amd64":    {SSMParameter: "/aws/service/debian/release/12/latest/amd64"},
+	"debian-12-arm64":    {SSMParameter: "/aws/service/debian/release/12/latest/arm64"},
+	"al2023-amd64":       {SSMParameter: "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64"},
+	"al2023-arm64":       {SSMParameter: "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-arm64"},
+	"rhel-9-amd64":       {NamePattern: "RHEL-9.*_HVM-*-x86_64-*", Owners: []string{"309956199498"}},
+	"rhel-9-arm64":       {NamePattern: "RHEL-9.*_HVM-*-arm64-*", Owners: []string{"309956199498"}},
+}
+
+type parameterInterface interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// AMIResolution records which image was picked for the requested AMI.
+type AMIResolution struct {
+	Requested    string `json:"requested"`
+	ImageID      string `json:"imageId"`
+	Source       string `json:"source"`
+	Name         string `json:"name,omitempty"`
+	OwnerID      string `json:"ownerId,omitempty"`
+	CreationDate string `json:"creationDate,omitempty"`
+}
+
+// AMIUsesSSMParameter reports whether resolving the requested AMI reads an SSM public parameter.
+func AMIUsesSSMParameter(requested string) bool {
+	return amiAliases[requested].SSMParameter != ""
+}
+
+// ResolveAMI turns an AMI ID or alias into an image ID. When owners is not empty,
+// the resolved image must belong to one of them.
+func ResolveAMI(ec2Client imageInterface, ssmClient parameterInterface, requested string, owners []string) (*AMIResolution, error) {
+	if strings.HasPrefix(requested, "ami-") {
+		resolution := &AMIResolution{Requested: requested, ImageID: requested, Source: AMISourceDirect}
+		if len(owners) > 0 {
+			if err := describeResolvedImage(ec2Client, resolution, owners); err != nil {
+				return nil, err
+			}
+		}
+		return resolution, nil
+	}
+
+	alias, ok := amiAliases[requested]
+	if !ok {
+		return nil, fmt.Errorf("unknown AMI alias %s", requested)
+	}
+
+	if alias.SSMParameter != "" {
+		parameterOutput, err := ssmClient.GetParameter(context.Background(), &ssm.GetParameterInput{
+			Name: aws.String(alias.SSMParameter),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get SSM parameter %s: %v", alias.SSMParameter, err)
+		}
+		resolution := &AMIResolution{
+			Requested: requested,
+			ImageID:   aws.ToString(parameterOutput.Parameter.Value),
+			Source:    AMISourceSSMParameter,
+		}
+		if err := describeResolvedImage(ec2Client, resolution, owners); err != nil {
+			return nil, err
+		}
+		log.Printf("Resolved AMI alias %s to %s from %s\n", requested, resolution.ImageID, alias.SSMParameter)
+		return resolution, nil
+	}
+
+	if len(owners) == 0 {
+		owners = alias.Owners
+	}
+	image, err := newestImage(ec2Client, alias.NamePattern, owners)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Resolved AMI alias %s to %s (%s)\n", requested, aws.ToString(image.ImageId), aws.ToString(image.Name))
+	return &AMIResolution{
+		Requested:    requested,
+		ImageID:      aws.ToString(image.ImageId),
+		Source:       AMISourceImageFilter,
+		Name:         aws.ToString(image.Name),
+		OwnerID:      aws.ToString(image.OwnerId),
+		CreationDate: aws.ToString(image.CreationDate),
+	}, nil
+}
+
+// newestImage returns the most recently created available image matching the name pattern.
+func newestImage(client imageInterface, namePattern string, owners []string) (types.Image, error) {
+	imagesOutput, err := client.DescribeImages(context.Background(), &ec2.DescribeImagesInput{
+		Owners: owners,
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("name"),
+				Values: []string{namePattern},
+			},
+			{
+				Name:   aws.String("state"),
+				Values: []string{"available"},
+			},
+		},
+	})
+	if err != nil {
+		return types.Image{}, fmt.Errorf("failed to describe images: %v", err)
+	}
+	if len(imagesOutput.Images) == 0 {
+		return types.Image{}, fmt.Errorf("no image matches %s for owners %s", namePattern, strings.Join(owners, ", "))
+	}
+
+	images := imagesOutput.Images
+	sort.Slice(images, func(i, j int) bool {
+		return aws.ToString(images[i].CreationDate) > aws.ToString(images[j].CreationDate)
+	})
+	return images[0], nil
+}
+
+// describeResolvedImage fills in the image details and checks the owner against the allow-list.
+func describeResolvedImage(client imageInterface, resolution *AMIResolution, owners []string) error {
+	imagesOutput, err := client.DescribeImages(context.Background(), &ec2.DescribeImagesInput{
+		ImageIds: []string{resolution.ImageID},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe image: %v", err)
+	}
+	if len(imagesOutput.Images) == 0 {
+		return fmt.Errorf("image %s not found", resolution.ImageID)
+	}
+	image := imagesOutput.Images[0]
+	resolution.Name = aws.ToString(image.Name)
+	resolution.OwnerID = aws.ToString(image.OwnerId)
+	resolution.CreationDate = aws.ToString(image.CreationDate)
+
+	if len(owners) == 0 {
+		return nil
+	}
+	for _, owner := range owners {
+		if owner == resolution.OwnerID {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s is owned by %s, which is not in the allowed owners %s", resolution.ImageID, resolution.OwnerID, strings.Join(owners, ", "))
+}
@@ -0,0 +1,120 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of parameterInterface for testing
+type MockParameterClient struct {
+	Value           string
+	GetParameterErr error
+
+	name string
+}
+
+func TestAMIUsesSSMParameter(t *testing.T) {
+	tests := []struct {
+		requested string
+		expected  bool
+	}{
+		{"ami-123456", false},
+		{"ubuntu-22.04-amd64", true},
+		{"rhel-9-amd64", false},
+		{"unknown", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, AMIUsesSSMParameter(test.requested), test.requested)
+	}
+}
+
+func TestResolveAMI(t *testing.T) {
+	ubuntuImage := types.Image{
+		ImageId:      aws.String("ami-0e001c9271cf7f3b9"),
+		Name:         aws.String("ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240501"),
+		OwnerId:      aws.String("099720109477"),
+		CreationDate: aws.String("2024-05-01T10:00:00.000Z"),
+	}
+
+	t.Run("Direct", func(t *testing.T) {
+		imageClient := &MockImageClient{}
+		resolution, err := ResolveAMI(imageClient, &MockParameterClient{}, "ami-123456", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, &AMIResolution{Requested: "ami-123456", ImageID: "ami-123456", Source: AMISourceDirect}, resolution)
+		assert.Nil(t, imageClient.describeImagesInput)
+	})
+
+	t.Run("DirectOwnerNotAllowed", func(t *testing.T) {
+		_, err := ResolveAMI(&MockImageClient{Images: []types.Image{ubuntuImage}}, &MockParameterClient{}, "ami-0e001c9271cf7f3b9", []string{"137112412989"})
+		assert.Error(t, err)
+		assert.Equal(t, "image ami-0e001c9271cf7f3b9 is owned by 099720109477, which is not in the allowed owners 137112412989", err.Error())
+	})
+
+	t.Run("UnknownAlias", func(t *testing.T) {
+		_, err := ResolveAMI(&MockImageClient{}, &MockParameterClient{}, "windows-2022", nil)
+		assert.Error(t, err)
+		assert.Equal(t, "unknown AMI alias windows-2022", err.Error())
+	})
+
+	t.Run("SSMParameter", func(t *testing.T) {
+		parameterClient := &MockParameterClient{Value: "ami-0e001c9271cf7f3b9"}
+		resolution, err := ResolveAMI(&MockImageClient{Images: []types.Image{ubuntuImage}}, parameterClient, "ubuntu-22.04-amd64", []string{"099720109477"})
+		assert.NoError(t, err)
+		assert.Equal(t, "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id", parameterClient.name)
+		assert.Equal(t, "ami-0e001c9271cf7f3b9", resolution.ImageID)
+		assert.Equal(t, AMISourceSSMParameter, resolution.Source)
+		assert.Equal(t, "099720109477", resolution.OwnerID)
+	})
+
+	t.Run("SSMParameterError", func(t *testing.T) {
+		_, err := ResolveAMI(&MockImageClient{}, &MockParameterClient{GetParameterErr: fmt.Errorf("parameter not found")}, "al2023-arm64", nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to get SSM parameter /aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-arm64")
+	})
+
+	t.Run("ImageFilterNewestFirst", func(t *testing.T) {
+		imageClient := &MockImageClient{Images: []types.Image{
+			{ImageId: aws.String("ami-old"), Name: aws.String("RHEL-9.2.0_HVM-20230503-x86_64-41-Hourly2-GP2"), CreationDate: aws.String("2023-05-03T10:00:00.000Z")},
+			{ImageId: aws.String("ami-new"), Name: aws.String("RHEL-9.4.0_HVM-20240423-x86_64-62-Hourly2-GP3"), CreationDate: aws.String("2024-04-23T10:00:00.000Z")},
+			{ImageId: aws.String("ami-mid"), Name: aws.String("RHEL-9.3.0_HVM-20231101-x86_64-5-Hourly2-GP2"), CreationDate: aws.String("2023-11-01T10:00:00.000Z")},
+		}}
+		resolution, err := ResolveAMI(imageClient, &MockParameterClient{}, "rhel-9-amd64", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "ami-new", resolution.ImageID)
+		assert.Equal(t, AMISourceImageFilter, resolution.Source)
+		assert.Equal(t, []string{"309956199498"}, imageClient.describeImagesInput.Owners)
+	})
+
+	t.Run("ImageFilterOwnerAllowList", func(t *testing.T) {
+		imageClient := &MockImageClient{Images: []types.Image{ubuntuImage}}
+		_, err := ResolveAMI(imageClient, &MockParameterClient{}, "rhel-9-amd64", []string{"123456789012"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"123456789012"}, imageClient.describeImagesInput.Owners)
+	})
+
+	t.Run("ImageFilterNoMatch", func(t *testing.T) {
+		_, err := ResolveAMI(&MockImageClient{}, &MockParameterClient{}, "rhel-9-arm64", nil)
+		assert.Error(t, err)
+		assert.Equal(t, "no image matches RHEL-9.*_HVM-*-arm64-* for owners 309956199498", err.Error())
+	})
+}
+
+func (client *MockParameterClient) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	if client.GetParameterErr != nil {
+		return nil, client.GetParameterErr
+	}
+	client.name = aws.ToString(params.Name)
+	return &ssm.GetParameterOutput{
+		Parameter: &ssmTypes.Parameter{
+			Name:  params.Name,
+			Value: aws.String(client.Value),
+		},
+	}, nil
+}
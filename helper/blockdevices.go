@@ -0,0 +1,229 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Root volume size used when neither the settings nor the AMI ask for more
+const defaultRootVolumeSize = 15
+
+// Device names handed out to additional data volumes, in order
+var dataVolumeDeviceNames = []string{"/dev/sdf", "/dev/sdg", "/dev/sdh", "/dev/sdi", "/dev/sdj", "/dev/sdk", "/dev/sdl", "/dev/sdm"}
+
+// VolumeOptions describes an EBS volume. Zero values keep the AMI or AWS defaults.
+type VolumeOptions struct {
+	SizeGiB    int32
+	VolumeType string
+	IOPS       int32
+	Throughput int32 // MiB/s, gp3 only
+	Encrypted  bool
+	KMSKeyID   string
+	SnapshotID string // data volumes only, restores the volume from the snapshot
+}
+
+// BlockDeviceOptions describes the root volume and the additional data volumes of the instance.
+type BlockDeviceOptions struct {
+	Root        VolumeOptions
+	DataVolumes []VolumeOptions
+}
+
+// RequiresEncryption reports whether any volume is to be encrypted.
+func (opts BlockDeviceOptions) RequiresEncryption() bool {
+	if opts.Root.Encrypted || opts.Root.KMSKeyID != "" {
+		return true
+	}
+	for _, volume := range opts.DataVolumes {
+		if volume.Encrypted || volume.KMSKeyID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type volumeInterface interface {
+	DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error)
+}
+
+// BuildBlockDeviceMappings creates the mappings for the AMI, resizing its root device
+// rather than adding a volume under a hard-coded device name.
+func BuildBlockDeviceMappings(client imageInterface, amiID string, opts BlockDeviceOptions) ([]types.BlockDeviceMapping, error) {
+	imagesOutput, err := client.DescribeImages(context.Background(), &ec2.DescribeImagesInput{
+		ImageIds: []string{amiID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe image: %v", err)
+	}
+	if len(imagesOutput.Images) == 0 {
+		return nil, fmt.Errorf("image %s not found", amiID)
+	}
+	image := imagesOutput.Images[0]
+
+	rootDeviceName := aws.ToString(image.RootDeviceName)
+	if rootDeviceName == "" {
+		return nil, fmt.Errorf("image %s has no root device name", amiID)
+	}
+
+	// Keep the root volume at least as large as the snapshot it is created from
+	root := opts.Root
+	if root.SizeGiB == 0 {
+		root.SizeGiB = defaultRootVolumeSize
+	}
+	usedDevices := map[string]bool{}
+	for _, mapping := range image.BlockDeviceMappings {
+		deviceName := aws.ToString(mapping.DeviceName)
+		usedDevices[deviceName] = true
+		if deviceName == rootDeviceName && mapping.Ebs != nil {
+			if snapshotSize := aws.ToInt32(mapping.Ebs.VolumeSize); root.SizeGiB < snapshotSize {
+				if opts.Root.SizeGiB != 0 {
+					return nil, fmt.Errorf("root volume size %d GiB is smaller than the %d GiB snapshot of image %s", opts.Root.SizeGiB, snapshotSize, amiID)
+				}
+				root.SizeGiB = snapshotSize
+			}
+		}
+	}
+
+	rootEbs, err := ebsBlockDevice(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root volume: %v", err)
+	}
+	mappings := []types.BlockDeviceMapping{
+		{
+			DeviceName: aws.String(rootDeviceName),
+			Ebs:        rootEbs,
+		},
+	}
+
+	var deviceNames []string
+	for _, name := range dataVolumeDeviceNames {
+		if !usedDevices[name] {
+			deviceNames = append(deviceNames, name)
+		}
+	}
+	if len(opts.DataVolumes) > len(deviceNames) {
+		return nil, fmt.Errorf("too many data volumes: %d requested, %d device names available", len(opts.DataVolumes), len(deviceNames))
+	}
+	for i, volume := range opts.DataVolumes {
+		if volume.SizeGiB == 0 && volume.SnapshotID == "" {
+			return nil, fmt.Errorf("invalid data volume %d: size or snapshot is required", i+1)
+		}
+		ebs, err := ebsBlockDevice(volume)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data volume %d: %v", i+1, err)
+		}
+		mappings = append(mappings, types.BlockDeviceMapping{
+			DeviceName: aws.String(deviceNames[i]),
+			Ebs:        ebs,
+		})
+	}
+
+	return mappings, nil
+}
+
+func ebsBlockDevice(volume VolumeOptions) (*types.EbsBlockDevice, error) {
+	volumeType := types.VolumeType(volume.VolumeType)
+	if volumeType == "" {
+		volumeType = types.VolumeTypeGp3
+	}
+
+	ebs := &types.EbsBlockDevice{
+		VolumeType:          volumeType,
+		SnapshotId:          optionalString(volume.SnapshotID),
+		DeleteOnTermination: aws.Bool(true),
+	}
+	// Volumes restored from a snapshot default to the snapshot size
+	if volume.SizeGiB > 0 {
+		ebs.VolumeSize = aws.Int32(volume.SizeGiB)
+	}
+	if volume.IOPS > 0 {
+		if volumeType != types.VolumeTypeGp3 && volumeType != types.VolumeTypeIo1 && volumeType != types.VolumeTypeIo2 {
+			return nil, fmt.Errorf("IOPS cannot be set for %s volumes", volumeType)
+		}
+		ebs.Iops = aws.Int32(volume.IOPS)
+	}
+	if volume.Throughput > 0 {
+		if volumeType != types.VolumeTypeGp3 {
+			return nil, fmt.Errorf("throughput can only be set for gp3 volumes")
+		}
+		ebs.Throughput = aws.Int32(volume.Throughput)
+	}
+	if volume.Encrypted || volume.KMSKeyID != "" {
+		ebs.Encrypted = aws.Bool(true)
+		ebs.KmsKeyId = optionalString(volume.KMSKeyID)
+	}
+	return ebs, nil
+}
+
+// VerifyVolumeEncryption checks that every EBS volume attached to the instance is encrypted.
+func VerifyVolumeEncryption(client volumeInterface, instanceID string) error {
+	var unencrypted []string
+	paginator := ec2.NewDescribeVolumesPaginator(client, &ec2.DescribeVolumesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("attachment.instance-id"),
+				Values: []string{instanceID},
+			},
+		},
+	})
+	count := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to describe volumes: %v", err)
+		}
+		for _, volume := range page.Volumes {
+			count++
+			if !aws.ToBool(volume.Encrypted) {
+				unencrypted = append(unencrypted, aws.ToString(volume.VolumeId))
+			}
+		}
+	}
+
+	if count == 0 {
+		return fmt.Errorf("no volumes attached to instance %s", instanceID)
+	}
+	if len(unencrypted) > 0 {
+		return fmt.Errorf("volumes of instance %s are not encrypted: %s", instanceID, strings.Join(unencrypted, ", "))
+	}
+	log.Printf("All %d volumes of instance %s are encrypted\n", count, instanceID)
+	return nil
+}
+
+// ParseVolumeSpec reads a volume written as size[:type[:iops[:throughput]]][@snapshot],
+// e.g. 100:gp3:4000:250 or :gp3@snap-0123456789abcdef0 to restore a snapshot at its own size.
+func ParseVolumeSpec(spec string) (VolumeOptions, error) {
+	var volume VolumeOptions
+	options, snapshotID, _ := strings.Cut(spec, "@")
+	if snapshotID != "" && !strings.HasPrefix(snapshotID, "snap-") {
+		return VolumeOptions{}, fmt.Errorf("invalid volume %q: %s is not a snapshot ID", spec, snapshotID)
+	}
+	volume.SnapshotID = snapshotID
+	fields := strings.Split(options, ":")
+	if len(fields) > 4 {
+		return VolumeOptions{}, fmt.Errorf("invalid volume %q: expected size[:type[:iops[:throughput]]][@snapshot]", spec)
+	}
+
+	numbers := []*int32{&volume.SizeGiB, nil, &volume.IOPS, &volume.Throughput}
+	for i, field := range fields {
+		if i == 1 {
+			volume.VolumeType = field
+			continue
+		}
+		if field == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(field, 10, 32)
+		if err != nil {
+			return VolumeOptions{}, fmt.Errorf("invalid volume %q: %v", spec, err)
+		}
+		*numbers[i] = int32(parsed)
+	}
+	return volume, nil
+}
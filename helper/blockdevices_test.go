@@ -0,0 +1,195 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of volumeInterface for testing
+type MockVolumeClient struct {
+	Volumes            []types.Volume
+	DescribeVolumesErr error
+
+	describeVolumesInput *ec2.DescribeVolumesInput
+}
+
+func TestBuildBlockDeviceMappings(t *testing.T) {
+	ubuntuImage := types.Image{
+		ImageId:        aws.String("ami-123456"),
+		RootDeviceName: aws.String("/dev/sda1"),
+		BlockDeviceMappings: []types.BlockDeviceMapping{
+			{DeviceName: aws.String("/dev/sda1"), Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-123456"), VolumeSize: aws.Int32(8)}},
+			{DeviceName: aws.String("/dev/sdb"), VirtualName: aws.String("ephemeral0")},
+			{DeviceName: aws.String("/dev/sdf"), VirtualName: aws.String("ephemeral1")},
+		},
+	}
+
+	t.Run("DescribeImagesError", func(t *testing.T) {
+		_, err := BuildBlockDeviceMappings(&MockImageClient{DescribeImagesErr: fmt.Errorf("describe images error")}, "ami-123456", BlockDeviceOptions{})
+		assert.Error(t, err)
+		assert.Equal(t, "failed to describe image: describe images error", err.Error())
+	})
+
+	t.Run("ImageNotFound", func(t *testing.T) {
+		_, err := BuildBlockDeviceMappings(&MockImageClient{}, "ami-123456", BlockDeviceOptions{})
+		assert.Error(t, err)
+		assert.Equal(t, "image ami-123456 not found", err.Error())
+	})
+
+	t.Run("DefaultRootUsesImageRootDevice", func(t *testing.T) {
+		mappings, err := BuildBlockDeviceMappings(&MockImageClient{Images: []types.Image{ubuntuImage}}, "ami-123456", BlockDeviceOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, mappings, 1)
+		assert.Equal(t, "/dev/sda1", aws.ToString(mappings[0].DeviceName))
+		assert.Equal(t, int32(defaultRootVolumeSize), aws.ToInt32(mappings[0].Ebs.VolumeSize))
+		assert.Equal(t, types.VolumeTypeGp3, mappings[0].Ebs.VolumeType)
+		assert.Nil(t, mappings[0].Ebs.Encrypted)
+	})
+
+	t.Run("DefaultRootKeepsLargerSnapshot", func(t *testing.T) {
+		image := ubuntuImage
+		image.BlockDeviceMappings = []types.BlockDeviceMapping{
+			{DeviceName: aws.String("/dev/sda1"), Ebs: &types.EbsBlockDevice{VolumeSize: aws.Int32(30)}},
+		}
+		mappings, err := BuildBlockDeviceMappings(&MockImageClient{Images: []types.Image{image}}, "ami-123456", BlockDeviceOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(30), aws.ToInt32(mappings[0].Ebs.VolumeSize))
+	})
+
+	t.Run("RootSmallerThanSnapshot", func(t *testing.T) {
+		_, err := BuildBlockDeviceMappings(&MockImageClient{Images: []types.Image{ubuntuImage}}, "ami-123456", BlockDeviceOptions{Root: VolumeOptions{SizeGiB: 4}})
+		assert.Error(t, err)
+		assert.Equal(t, "root volume size 4 GiB is smaller than the 8 GiB snapshot of image ami-123456", err.Error())
+	})
+
+	t.Run("ConfiguredRootAndDataVolumes", func(t *testing.T) {
+		mappings, err := BuildBlockDeviceMappings(&MockImageClient{Images: []types.Image{ubuntuImage}}, "ami-123456", BlockDeviceOptions{
+			Root: VolumeOptions{SizeGiB: 50, VolumeType: "gp3", IOPS: 4000, Throughput: 250, KMSKeyID: "alias/ebs"},
+			DataVolumes: []VolumeOptions{
+				{SizeGiB: 100},
+				{SizeGiB: 200, VolumeType: "io2", IOPS: 6000},
+			},
+		})
+		assert.NoError(t, err)
+		assert.Len(t, mappings, 3)
+
+		root := mappings[0].Ebs
+		assert.Equal(t, int32(50), aws.ToInt32(root.VolumeSize))
+		assert.Equal(t, int32(4000), aws.ToInt32(root.Iops))
+		assert.Equal(t, int32(250), aws.ToInt32(root.Throughput))
+		assert.True(t, aws.ToBool(root.Encrypted))
+		assert.Equal(t, "alias/ebs", aws.ToString(root.KmsKeyId))
+
+		// /dev/sdf is taken by an instance store volume of the AMI
+		assert.Equal(t, "/dev/sdg", aws.ToString(mappings[1].DeviceName))
+		assert.Equal(t, "/dev/sdh", aws.ToString(mappings[2].DeviceName))
+		assert.Equal(t, types.VolumeTypeIo2, mappings[2].Ebs.VolumeType)
+	})
+
+	t.Run("InvalidThroughput", func(t *testing.T) {
+		_, err := BuildBlockDeviceMappings(&MockImageClient{Images: []types.Image{ubuntuImage}}, "ami-123456", BlockDeviceOptions{Root: VolumeOptions{VolumeType: "gp2", Throughput: 250}})
+		assert.Error(t, err)
+		assert.Equal(t, "invalid root volume: throughput can only be set for gp3 volumes", err.Error())
+	})
+
+	t.Run("InvalidIOPS", func(t *testing.T) {
+		_, err := BuildBlockDeviceMappings(&MockImageClient{Images: []types.Image{ubuntuImage}}, "ami-123456", BlockDeviceOptions{DataVolumes: []VolumeOptions{{SizeGiB: 10, VolumeType: "st1", IOPS: 100}}})
+		assert.Error(t, err)
+		assert.Equal(t, "invalid data volume 1: IOPS cannot be set for st1 volumes", err.Error())
+	})
+
+	t.Run("DataVolumeWithoutSize", func(t *testing.T) {
+		_, err := BuildBlockDeviceMappings(&MockImageClient{Images: []types.Image{ubuntuImage}}, "ami-123456", BlockDeviceOptions{DataVolumes: []VolumeOptions{{VolumeType: "gp3"}}})
+		assert.Error(t, err)
+		assert.Equal(t, "invalid data volume 1: size or snapshot is required", err.Error())
+	})
+
+	t.Run("DataVolumeFromSnapshot", func(t *testing.T) {
+		mappings, err := BuildBlockDeviceMappings(&MockImageClient{Images: []types.Image{ubuntuImage}}, "ami-123456", BlockDeviceOptions{
+			DataVolumes: []VolumeOptions{{SnapshotID: "snap-0jenkinshome", Encrypted: true, KMSKeyID: "alias/ebs"}},
+		})
+		assert.NoError(t, err)
+		data := mappings[1].Ebs
+		assert.Equal(t, "snap-0jenkinshome", aws.ToString(data.SnapshotId))
+		assert.Nil(t, data.VolumeSize)
+		assert.True(t, aws.ToBool(data.Encrypted))
+		assert.Equal(t, "alias/ebs", aws.ToString(data.KmsKeyId))
+	})
+}
+
+func TestRequiresEncryption(t *testing.T) {
+	assert.False(t, BlockDeviceOptions{DataVolumes: []VolumeOptions{{SizeGiB: 10}}}.RequiresEncryption())
+	assert.True(t, BlockDeviceOptions{Root: VolumeOptions{Encrypted: true}}.RequiresEncryption())
+	assert.True(t, BlockDeviceOptions{DataVolumes: []VolumeOptions{{SizeGiB: 10, KMSKeyID: "alias/ebs"}}}.RequiresEncryption())
+}
+
+func TestVerifyVolumeEncryption(t *testing.T) {
+	t.Run("DescribeVolumesError", func(t *testing.T) {
+		err := VerifyVolumeEncryption(&MockVolumeClient{DescribeVolumesErr: fmt.Errorf("describe volumes error")}, "i-123456")
+		assert.Error(t, err)
+		assert.Equal(t, "failed to describe volumes: describe volumes error", err.Error())
+	})
+
+	t.Run("NoVolumes", func(t *testing.T) {
+		err := VerifyVolumeEncryption(&MockVolumeClient{}, "i-123456")
+		assert.Error(t, err)
+		assert.Equal(t, "no volumes attached to instance i-123456", err.Error())
+	})
+
+	t.Run("Unencrypted", func(t *testing.T) {
+		err := VerifyVolumeEncryption(&MockVolumeClient{Volumes: []types.Volume{
+			{VolumeId: aws.String("vol-root"), Encrypted: aws.Bool(true)},
+			{VolumeId: aws.String("vol-data"), Encrypted: aws.Bool(false)},
+		}}, "i-123456")
+		assert.Error(t, err)
+		assert.Equal(t, "volumes of instance i-123456 are not encrypted: vol-data", err.Error())
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		client := &MockVolumeClient{Volumes: []types.Volume{
+			{VolumeId: aws.String("vol-root"), Encrypted: aws.Bool(true)},
+			{VolumeId: aws.String("vol-data"), Encrypted: aws.Bool(true)},
+		}}
+		assert.NoError(t, VerifyVolumeEncryption(client, "i-123456"))
+		assert.Equal(t, []string{"i-123456"}, client.describeVolumesInput.Filters[0].Values)
+	})
+}
+
+func TestParseVolumeSpec(t *testing.T) {
+	volume, err := ParseVolumeSpec("100:gp3:4000:250")
+	assert.NoError(t, err)
+	assert.Equal(t, VolumeOptions{SizeGiB: 100, VolumeType: "gp3", IOPS: 4000, Throughput: 250}, volume)
+
+	volume, err = ParseVolumeSpec("20")
+	assert.NoError(t, err)
+	assert.Equal(t, VolumeOptions{SizeGiB: 20}, volume)
+
+	volume, err = ParseVolumeSpec(":gp3@snap-0123456789abcdef0")
+	assert.NoError(t, err)
+	assert.Equal(t, VolumeOptions{VolumeType: "gp3", SnapshotID: "snap-0123456789abcdef0"}, volume)
+
+	// Errors quote the spec as given, including the snapshot
+	_, err = ParseVolumeSpec("100@vol-0123")
+	assert.EqualError(t, err, `invalid volume "100@vol-0123": vol-0123 is not a snapshot ID`)
+
+	_, err = ParseVolumeSpec("big:gp3@snap-0123456789abcdef0")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid volume "big:gp3@snap-0123456789abcdef0": `)
+
+	_, err = ParseVolumeSpec("1:2:3:4:5@snap-0123456789abcdef0")
+	assert.EqualError(t, err, `invalid volume "1:2:3:4:5@snap-0123456789abcdef0": expected size[:type[:iops[:throughput]]][@snapshot]`)
+}
+
+func (client *MockVolumeClient) DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	if client.DescribeVolumesErr != nil {
+		return nil, client.DescribeVolumesErr
+	}
+	client.describeVolumesInput = params
+	return &ec2.DescribeVolumesOutput{Volumes: client.Volumes}, nil
+}
@@ -0,0 +1,143 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Error codes after which the launch is retried with the next capacity option
+var capacityErrorCodes = []string{
+	"InsufficientInstanceCapacity",
+	"SpotMaxPriceTooLow",
+	"MaxSpotInstanceCountExceeded",
+	"InsufficientCapacity",
+}
+
+// SpotOptions requests spot capacity for the launch.
+type SpotOptions struct {
+	MaxPrice             string // hourly price in USD, the on-demand price when empty
+	InterruptionBehavior string // terminate (default), stop or hibernate
+	FallbackToOnDemand   bool   // launch on-demand when no spot capacity is available
+}
+
+// launchAttempt is one instance type and market combination to try.
+type launchAttempt struct {
+	InstanceType string
+	Spot         bool
+	Fallback     bool // one of the fallback instance types
+}
+
+func (attempt launchAttempt) String() string {
+	if attempt.Spot {
+		return attempt.InstanceType + " (spot)"
+	}
+	return attempt.InstanceType + " (on-demand)"
+}
+
+// launchAttempts lists the capacity options in order of preference: spot for every instance
+// type first, then on-demand when spot is not requested or fallback is enabled.
+func launchAttempts(instanceType string, opts LaunchOptions) []launchAttempt {
+	instanceTypes := append([]string{instanceType}, opts.FallbackInstanceTypes...)
+
+	var attempts []launchAttempt
+	if opts.Spot != nil {
+		for i, candidate := range instanceTypes {
+			attempts = append(attempts, launchAttempt{InstanceType: candidate, Spot: true, Fallback: i > 0})
+		}
+		if !opts.Spot.FallbackToOnDemand {
+			return attempts
+		}
+	}
+	for i, candidate := range instanceTypes {
+		attempts = append(attempts, launchAttempt{InstanceType: candidate, Fallback: i > 0})
+	}
+	return attempts
+}
+
+func spotMarketOptions(spot *SpotOptions) *types.InstanceMarketOptionsRequest {
+	behavior := types.InstanceInterruptionBehavior(spot.InterruptionBehavior)
+	if behavior == "" {
+		behavior = types.InstanceInterruptionBehaviorTerminate
+	}
+	// Stopped or hibernated spot instances are restarted by a persistent request
+	spotType := types.SpotInstanceTypeOneTime
+	if behavior != types.InstanceInterruptionBehaviorTerminate {
+		spotType = types.SpotInstanceTypePersistent
+	}
+	return &types.InstanceMarketOptionsRequest{
+		MarketType: types.MarketTypeSpot,
+		SpotOptions: &types.SpotMarketOptions{
+			MaxPrice:                     optionalString(spot.MaxPrice),
+			InstanceInterruptionBehavior: behavior,
+			SpotInstanceType:             spotType,
+		},
+	}
+}
+
+type spotRequestInterface interface {
+	CancelSpotInstanceRequests(ctx context.Context, params *ec2.CancelSpotInstanceRequestsInput, optFns ...func(*ec2.Options)) (*ec2.CancelSpotInstanceRequestsOutput, error)
+}
+
+// CancelSpotRequests cancels the spot requests of the instances. A persistent request, used for
+// the stop and hibernate interruption behaviors, would otherwise launch a replacement once its
+// instance is terminated.
+func CancelSpotRequests(client spotRequestInterface, requestIDs []string) error {
+	output, err := client.CancelSpotInstanceRequests(context.Background(), &ec2.CancelSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: requestIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cancel spot requests: %v", err)
+	}
+	for _, request := range output.CancelledSpotInstanceRequests {
+		log.Printf("Spot request %s is %s\n", aws.ToString(request.SpotInstanceRequestId), request.State)
+	}
+	return nil
+}
+
+// runInstancesWithFallback tries each capacity option in turn until one is fulfilled.
+// Errors other than missing capacity or a too low spot price are returned right away.
+func runInstancesWithFallback(client ec2InstanceInterface, input *ec2.RunInstancesInput, instanceType string, opts LaunchOptions) (*ec2.RunInstancesOutput, error) {
+	attempts := launchAttempts(instanceType, opts)
+	var failures []string
+	for _, attempt := range attempts {
+		attemptInput := *input
+		// A launch template keeps its own instance type unless it has no capacity
+		if input.LaunchTemplate == nil || attempt.Fallback {
+			attemptInput.InstanceType = types.InstanceType(attempt.InstanceType)
+		}
+		attemptInput.InstanceMarketOptions = nil
+		if attempt.Spot {
+			attemptInput.InstanceMarketOptions = spotMarketOptions(opts.Spot)
+		}
+
+		// The instance profile may not be visible to EC2 yet right after it was created
+		var output *ec2.RunInstancesOutput
+		err := retryEventualConsistency("launching "+attempt.String(), func() error {
+			var err error
+			output, err = client.RunInstances(context.Background(), &attemptInput)
+			return err
+		})
+		if err == nil {
+			if len(attempts) > 1 {
+				log.Printf("Launched %s\n", attempt)
+			}
+			return output, nil
+		}
+		if !isCapacityError(err) {
+			return nil, err
+		}
+		log.Printf("No capacity for %s: %v\n", attempt, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", attempt, err))
+	}
+	return nil, fmt.Errorf("no capacity available after %d attempts: %s", len(attempts), strings.Join(failures, "; "))
+}
+
+func isCapacityError(err error) bool {
+	return hasErrorCode(err, capacityErrorCodes)
+}
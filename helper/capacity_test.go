@@ -0,0 +1,189 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock of ec2InstanceInterface returning one RunInstances error per call (nil for success), then success
+type MockCapacityClient struct {
+	RunInstancesErrs []error
+
+	inputs []*ec2.RunInstancesInput
+}
+
+func TestLaunchAttempts(t *testing.T) {
+	t.Run("OnDemand", func(t *testing.T) {
+		attempts := launchAttempts("t3.medium", LaunchOptions{FallbackInstanceTypes: []string{"t3a.medium"}})
+		assert.Equal(t, []launchAttempt{{InstanceType: "t3.medium"}, {InstanceType: "t3a.medium", Fallback: true}}, attempts)
+	})
+
+	t.Run("SpotOnly", func(t *testing.T) {
+		attempts := launchAttempts("t3.medium", LaunchOptions{Spot: &SpotOptions{}})
+		assert.Equal(t, []launchAttempt{{InstanceType: "t3.medium", Spot: true}}, attempts)
+	})
+
+	t.Run("SpotWithFallback", func(t *testing.T) {
+		attempts := launchAttempts("t3.medium", LaunchOptions{Spot: &SpotOptions{FallbackToOnDemand: true}, FallbackInstanceTypes: []string{"t3a.medium"}})
+		assert.Equal(t, []launchAttempt{
+			{InstanceType: "t3.medium", Spot: true},
+			{InstanceType: "t3a.medium", Spot: true, Fallback: true},
+			{InstanceType: "t3.medium"},
+			{InstanceType: "t3a.medium", Fallback: true},
+		}, attempts)
+	})
+}
+
+func TestSpotMarketOptions(t *testing.T) {
+	options := spotMarketOptions(&SpotOptions{MaxPrice: "0.05"})
+	assert.Equal(t, types.MarketTypeSpot, options.MarketType)
+	assert.Equal(t, "0.05", aws.ToString(options.SpotOptions.MaxPrice))
+	assert.Equal(t, types.InstanceInterruptionBehaviorTerminate, options.SpotOptions.InstanceInterruptionBehavior)
+	assert.Equal(t, types.SpotInstanceTypeOneTime, options.SpotOptions.SpotInstanceType)
+
+	options = spotMarketOptions(&SpotOptions{InterruptionBehavior: "stop"})
+	assert.Nil(t, options.SpotOptions.MaxPrice)
+	assert.Equal(t, types.SpotInstanceTypePersistent, options.SpotOptions.SpotInstanceType)
+}
+
+func TestRunInstancesWithFallback(t *testing.T) {
+	input := createInstanceInput("sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{})
+
+	t.Run("FirstAttempt", func(t *testing.T) {
+		client := &MockCapacityClient{}
+		_, err := runInstancesWithFallback(client, input, "t3.medium", LaunchOptions{Spot: &SpotOptions{}})
+		assert.NoError(t, err)
+		assert.Len(t, client.inputs, 1)
+		assert.Equal(t, types.MarketTypeSpot, client.inputs[0].InstanceMarketOptions.MarketType)
+	})
+
+	t.Run("FallbackToAlternativeTypeThenOnDemand", func(t *testing.T) {
+		client := &MockCapacityClient{RunInstancesErrs: []error{
+			apiError("InsufficientInstanceCapacity", "no capacity"),
+			apiError("SpotMaxPriceTooLow", "price too low"),
+		}}
+		_, err := runInstancesWithFallback(client, input, "t3.medium", LaunchOptions{
+			Spot:                  &SpotOptions{FallbackToOnDemand: true},
+			FallbackInstanceTypes: []string{"t3a.medium"},
+		})
+		assert.NoError(t, err)
+		assert.Len(t, client.inputs, 3)
+		assert.Equal(t, types.InstanceType("t3a.medium"), client.inputs[1].InstanceType)
+		assert.NotNil(t, client.inputs[1].InstanceMarketOptions)
+		assert.Equal(t, types.InstanceType("t3.medium"), client.inputs[2].InstanceType)
+		assert.Nil(t, client.inputs[2].InstanceMarketOptions)
+	})
+
+	t.Run("OtherErrorStops", func(t *testing.T) {
+		client := &MockCapacityClient{RunInstancesErrs: []error{apiError("UnauthorizedOperation", "denied")}}
+		_, err := runInstancesWithFallback(client, input, "t3.medium", LaunchOptions{FallbackInstanceTypes: []string{"t3a.medium"}})
+		assert.Error(t, err)
+		assert.Equal(t, "api error UnauthorizedOperation: denied", err.Error())
+		assert.Len(t, client.inputs, 1)
+	})
+
+	t.Run("LaunchTemplateKeepsInstanceType", func(t *testing.T) {
+		opts := LaunchOptions{
+			LaunchTemplate:        &types.LaunchTemplateSpecification{LaunchTemplateName: aws.String("jenkins"), Version: aws.String("3")},
+			FallbackInstanceTypes: []string{"t3a.medium"},
+		}
+		client := &MockCapacityClient{RunInstancesErrs: []error{apiError("InsufficientInstanceCapacity", "no capacity")}}
+		_, err := runInstancesWithFallback(client, createInstanceInput("", "t3.medium", "", "", "", opts), "t3.medium", opts)
+		assert.NoError(t, err)
+		assert.Len(t, client.inputs, 2)
+		assert.Empty(t, client.inputs[0].InstanceType)
+		assert.Equal(t, "3", aws.ToString(client.inputs[0].LaunchTemplate.Version))
+		assert.Equal(t, types.InstanceType("t3a.medium"), client.inputs[1].InstanceType)
+	})
+
+	t.Run("NoCapacity", func(t *testing.T) {
+		client := &MockCapacityClient{RunInstancesErrs: []error{
+			apiError("InsufficientInstanceCapacity", "no capacity"),
+			apiError("InsufficientInstanceCapacity", "no capacity"),
+		}}
+		_, err := runInstancesWithFallback(client, input, "t3.medium", LaunchOptions{Spot: &SpotOptions{}, FallbackInstanceTypes: []string{"t3a.medium"}})
+		assert.Error(t, err)
+		assert.Equal(t, "no capacity available after 2 attempts: t3.medium (spot): api error InsufficientInstanceCapacity: no capacity; t3a.medium (spot): api error InsufficientInstanceCapacity: no capacity", err.Error())
+	})
+}
+
+// Mock implementation of the spotRequestInterface for testing
+type MockSpotRequestClient struct {
+	CancelErr error
+	cancelled []string
+}
+
+func TestCancelSpotRequests(t *testing.T) {
+	client := &MockSpotRequestClient{}
+	assert.NoError(t, CancelSpotRequests(client, []string{"sir-1", "sir-2"}))
+	assert.Equal(t, []string{"sir-1", "sir-2"}, client.cancelled)
+
+	err := CancelSpotRequests(&MockSpotRequestClient{CancelErr: apiError("UnauthorizedOperation", "denied")}, []string{"sir-1"})
+	assert.EqualError(t, err, "failed to cancel spot requests: api error UnauthorizedOperation: denied")
+}
+
+func (client *MockCapacityClient) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	client.inputs = append(client.inputs, params)
+	if len(client.inputs) <= len(client.RunInstancesErrs) && client.RunInstancesErrs[len(client.inputs)-1] != nil {
+		return nil, client.RunInstancesErrs[len(client.inputs)-1]
+	}
+	output := &ec2.RunInstancesOutput{}
+	for i := int32(0); i < aws.ToInt32(params.MaxCount); i++ {
+		output.Instances = append(output.Instances, types.Instance{
+			InstanceId:   aws.String(fmt.Sprintf("i-%d%d", len(client.inputs), i)),
+			InstanceType: params.InstanceType,
+			SubnetId:     params.SubnetId,
+		})
+		if params.InstanceMarketOptions != nil {
+			output.Instances[i].InstanceLifecycle = types.InstanceLifecycleTypeSpot
+			output.Instances[i].SpotInstanceRequestId = aws.String(fmt.Sprintf("sir-%d%d", len(client.inputs), i))
+		}
+	}
+	return output, nil
+}
+
+// The launched instances are running, with status checks passed
+func (client *MockCapacityClient) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	reservation := types.Reservation{}
+	for _, instanceID := range params.InstanceIds {
+		reservation.Instances = append(reservation.Instances, types.Instance{
+			InstanceId:      aws.String(instanceID),
+			State:           &types.InstanceState{Name: types.InstanceStateNameRunning},
+			PublicIpAddress: aws.String("203.0.113.10"),
+		})
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{reservation}}, nil
+}
+
+func (client *MockCapacityClient) DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+	output := &ec2.DescribeInstanceStatusOutput{}
+	for _, instanceID := range params.InstanceIds {
+		output.InstanceStatuses = append(output.InstanceStatuses, types.InstanceStatus{
+			InstanceId:     aws.String(instanceID),
+			InstanceStatus: &types.InstanceStatusSummary{Status: types.SummaryStatusOk},
+			SystemStatus:   &types.InstanceStatusSummary{Status: types.SummaryStatusOk},
+		})
+	}
+	return output, nil
+}
+
+func (client *MockSpotRequestClient) CancelSpotInstanceRequests(ctx context.Context, params *ec2.CancelSpotInstanceRequestsInput, optFns ...func(*ec2.Options)) (*ec2.CancelSpotInstanceRequestsOutput, error) {
+	if client.CancelErr != nil {
+		return nil, client.CancelErr
+	}
+	client.cancelled = append(client.cancelled, params.SpotInstanceRequestIds...)
+	output := &ec2.CancelSpotInstanceRequestsOutput{}
+	for _, requestID := range params.SpotInstanceRequestIds {
+		output.CancelledSpotInstanceRequests = append(output.CancelledSpotInstanceRequests, types.CancelledSpotInstanceRequest{
+			SpotInstanceRequestId: aws.String(requestID),
+			State:                 types.CancelSpotInstanceRequestStateCancelled,
+		})
+	}
+	return output, nil
+}
@@ -0,0 +1,191 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// TTL of the DNS record when the settings leave it unset
+const defaultDNSRecordTTL = 300
+
+// How long to wait for a record change to reach all Route 53 name servers
+const dnsChangeTimeout = 3 * time.Minute
+
+type dnsInterface interface {
+	ListHostedZonesByName(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error)
+	ChangeResourceRecordSets(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error)
+	GetChange(ctx context.Context, params *route53.GetChangeInput, optFns ...func(*route53.Options)) (*route53.GetChangeOutput, error)
+}
+
+// DNSRecordOptions describes the record pointing to the provisioned instances.
+type DNSRecordOptions struct {
+	Name         string // fully qualified record name, e.g. jenkins.example.com
+	HostedZoneID string // looked up from the record name when empty
+	RecordType   string // A (default) or CNAME
+	TTL          int64
+}
+
+// DNSRecord identifies a record created by UpsertDNSRecord, so it can be deleted on teardown.
+type DNSRecord struct {
+	HostedZoneID string   `json:"hostedZoneId"`
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	TTL          int64    `json:"ttl"`
+	Values       []string `json:"values"`
+}
+
+// dnsRecordValues returns the record values for the instances: their public IPs for an
+// A record, or the single instance's DNS name for a CNAME. Instances without a public
+// address are pointed to by their private address, for private hosted zones.
+func dnsRecordValues(recordType string, instances []NetworkInfo) ([]string, bool, error) {
+	if len(instances) == 0 {
+		return nil, false, fmt.Errorf("no instances to point the record to")
+	}
+	private := false
+	var values []string
+	for _, instance := range instances {
+		switch {
+		case recordType == "CNAME" && instance.PublicDNS != "":
+			values = append(values, instance.PublicDNS)
+		case recordType == "CNAME" && instance.PrivateDNS != "":
+			values = append(values, instance.PrivateDNS)
+			private = true
+		case recordType == "A" && instance.PublicIP != "":
+			values = append(values, instance.PublicIP)
+		case recordType == "A" && instance.PrivateIP != "":
+			values = append(values, instance.PrivateIP)
+			private = true
+		default:
+			return nil, false, fmt.Errorf("instance has no address for a %s record", recordType)
+		}
+	}
+	if recordType == "CNAME" && len(values) > 1 {
+		return nil, false, fmt.Errorf("a CNAME record can only point to one instance, got %d", len(values))
+	}
+	return values, private, nil
+}
+
+// findHostedZone returns the ID of the most specific hosted zone containing the record name,
+// preferring a private zone for private addresses when the domain has both.
+func findHostedZone(client dnsInterface, recordName string, private bool) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(recordName, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		domain := strings.Join(labels[i:], ".") + "."
+		zonesOutput, err := client.ListHostedZonesByName(context.Background(), &route53.ListHostedZonesByNameInput{
+			DNSName: aws.String(domain),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to list hosted zones: %v", err)
+		}
+
+		var matching []types.HostedZone
+		for _, zone := range zonesOutput.HostedZones {
+			if aws.ToString(zone.Name) == domain {
+				matching = append(matching, zone)
+			}
+		}
+		for _, zone := range matching {
+			if zone.Config != nil && zone.Config.PrivateZone == private {
+				return strings.TrimPrefix(aws.ToString(zone.Id), "/hostedzone/"), nil
+			}
+		}
+		if len(matching) > 0 {
+			return strings.TrimPrefix(aws.ToString(matching[0].Id), "/hostedzone/"), nil
+		}
+	}
+	return "", fmt.Errorf("no hosted zone found for %s", recordName)
+}
+
+// UpsertDNSRecord creates or updates the record to point to the instances and waits until
+// the change has propagated to the Route 53 name servers.
+func UpsertDNSRecord(client dnsInterface, opts DNSRecordOptions, instances []NetworkInfo) (*DNSRecord, error) {
+	recordType := opts.RecordType
+	if recordType == "" {
+		recordType = "A"
+	}
+	values, private, err := dnsRecordValues(recordType, instances)
+	if err != nil {
+		return nil, err
+	}
+
+	zoneID := opts.HostedZoneID
+	if zoneID == "" {
+		if zoneID, err = findHostedZone(client, opts.Name, private); err != nil {
+			return nil, err
+		}
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = defaultDNSRecordTTL
+	}
+
+	record := &DNSRecord{
+		HostedZoneID: zoneID,
+		Name:         strings.TrimSuffix(opts.Name, "."),
+		Type:         recordType,
+		TTL:          ttl,
+		Values:       values,
+	}
+	if err := changeDNSRecord(client, types.ChangeActionUpsert, record); err != nil {
+		return nil, err
+	}
+	log.Printf("DNS record %s %s now points to %s\n", record.Type, record.Name, strings.Join(record.Values, ", "))
+	return record, nil
+}
+
+// DeleteDNSRecord removes a record created by UpsertDNSRecord. A record that no longer exists is ignored.
+func DeleteDNSRecord(client dnsInterface, record DNSRecord) error {
+	err := changeDNSRecord(client, types.ChangeActionDelete, &record)
+	var invalidChangeBatch *types.InvalidChangeBatch
+	if errors.As(err, &invalidChangeBatch) && strings.Contains(invalidChangeBatch.ErrorMessage(), "not found") {
+		log.Printf("DNS record %s %s was already deleted\n", record.Type, record.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleted DNS record %s %s\n", record.Type, record.Name)
+	return nil
+}
+
+func changeDNSRecord(client dnsInterface, action types.ChangeAction, record *DNSRecord) error {
+	var resourceRecords []types.ResourceRecord
+	for _, value := range record.Values {
+		resourceRecords = append(resourceRecords, types.ResourceRecord{Value: aws.String(value)})
+	}
+	changeOutput, err := client.ChangeResourceRecordSets(context.Background(), &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(record.HostedZoneID),
+		ChangeBatch: &types.ChangeBatch{
+			Comment: aws.String("Jenkins host provisioning"),
+			Changes: []types.Change{
+				{
+					Action: action,
+					ResourceRecordSet: &types.ResourceRecordSet{
+						Name:            aws.String(record.Name),
+						Type:            types.RRType(record.Type),
+						TTL:             aws.Int64(record.TTL),
+						ResourceRecords: resourceRecords,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		// Wrapped so DeleteDNSRecord can tell a record that is already gone
+		return fmt.Errorf("failed to change DNS record: %w", err)
+	}
+
+	waiter := route53.NewResourceRecordSetsChangedWaiter(client)
+	if err := waiter.Wait(context.Background(), &route53.GetChangeInput{Id: changeOutput.ChangeInfo.Id}, dnsChangeTimeout); err != nil {
+		return fmt.Errorf("DNS change did not propagate in time: %v", err)
+	}
+	return nil
+}
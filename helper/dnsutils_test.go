@@ -0,0 +1,124 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of the dnsInterface for testing
+type MockDNSClient struct {
+	HostedZones                 []types.HostedZone
+	ChangeResourceRecordSetsErr error
+
+	changes []*route53.ChangeResourceRecordSetsInput
+}
+
+func TestDNSRecordValues(t *testing.T) {
+	public := NetworkInfo{PublicIP: "54.1.2.3", PublicDNS: "ec2-54-1-2-3.compute-1.amazonaws.com", PrivateIP: "10.0.0.1", PrivateDNS: "ip-10-0-0-1.ec2.internal"}
+	private := NetworkInfo{PrivateIP: "10.0.0.2", PrivateDNS: "ip-10-0-0-2.ec2.internal"}
+
+	values, isPrivate, err := dnsRecordValues("A", []NetworkInfo{public, private})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"54.1.2.3", "10.0.0.2"}, values)
+	assert.True(t, isPrivate)
+
+	values, isPrivate, err = dnsRecordValues("CNAME", []NetworkInfo{public})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ec2-54-1-2-3.compute-1.amazonaws.com"}, values)
+	assert.False(t, isPrivate)
+
+	_, _, err = dnsRecordValues("CNAME", []NetworkInfo{public, private})
+	assert.Equal(t, "a CNAME record can only point to one instance, got 2", err.Error())
+
+	_, _, err = dnsRecordValues("A", nil)
+	assert.Error(t, err)
+}
+
+func TestFindHostedZone(t *testing.T) {
+	client := &MockDNSClient{HostedZones: []types.HostedZone{
+		{Id: aws.String("/hostedzone/ZPUBLIC"), Name: aws.String("example.com."), Config: &types.HostedZoneConfig{}},
+		{Id: aws.String("/hostedzone/ZPRIVATE"), Name: aws.String("example.com."), Config: &types.HostedZoneConfig{PrivateZone: true}},
+		{Id: aws.String("/hostedzone/ZCI"), Name: aws.String("ci.example.com."), Config: &types.HostedZoneConfig{}},
+	}}
+
+	zoneID, err := findHostedZone(client, "jenkins.ci.example.com", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "ZCI", zoneID)
+
+	zoneID, err = findHostedZone(client, "jenkins.example.com.", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "ZPRIVATE", zoneID)
+
+	zoneID, err = findHostedZone(client, "jenkins.example.com", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "ZPUBLIC", zoneID)
+
+	_, err = findHostedZone(client, "jenkins.example.org", false)
+	assert.Equal(t, "no hosted zone found for jenkins.example.org", err.Error())
+}
+
+func TestUpsertDNSRecord(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		client := &MockDNSClient{HostedZones: []types.HostedZone{
+			{Id: aws.String("/hostedzone/ZPUBLIC"), Name: aws.String("example.com."), Config: &types.HostedZoneConfig{}},
+		}}
+		record, err := UpsertDNSRecord(client, DNSRecordOptions{Name: "jenkins.example.com"}, []NetworkInfo{{PublicIP: "54.1.2.3"}})
+		assert.NoError(t, err)
+		assert.Equal(t, &DNSRecord{HostedZoneID: "ZPUBLIC", Name: "jenkins.example.com", Type: "A", TTL: defaultDNSRecordTTL, Values: []string{"54.1.2.3"}}, record)
+
+		change := client.changes[0].ChangeBatch.Changes[0]
+		assert.Equal(t, types.ChangeActionUpsert, change.Action)
+		assert.Equal(t, types.RRTypeA, change.ResourceRecordSet.Type)
+		assert.Equal(t, "54.1.2.3", aws.ToString(change.ResourceRecordSet.ResourceRecords[0].Value))
+	})
+
+	t.Run("ChangeError", func(t *testing.T) {
+		client := &MockDNSClient{ChangeResourceRecordSetsErr: fmt.Errorf("access denied")}
+		_, err := UpsertDNSRecord(client, DNSRecordOptions{Name: "jenkins.example.com", HostedZoneID: "Z123"}, []NetworkInfo{{PublicIP: "54.1.2.3"}})
+		assert.Equal(t, "failed to change DNS record: access denied", err.Error())
+	})
+}
+
+func TestDeleteDNSRecord(t *testing.T) {
+	record := DNSRecord{HostedZoneID: "Z123", Name: "jenkins.example.com", Type: "A", TTL: 300, Values: []string{"54.1.2.3"}}
+
+	client := &MockDNSClient{}
+	assert.NoError(t, DeleteDNSRecord(client, record))
+	assert.Equal(t, types.ChangeActionDelete, client.changes[0].ChangeBatch.Changes[0].Action)
+
+	client = &MockDNSClient{ChangeResourceRecordSetsErr: &types.InvalidChangeBatch{Message: aws.String("Tried to delete resource record set but it was not found")}}
+	assert.NoError(t, DeleteDNSRecord(client, record))
+}
+
+func (client *MockDNSClient) ListHostedZonesByName(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error) {
+	// Zones are listed from the requested name on, like the real API
+	output := &route53.ListHostedZonesByNameOutput{}
+	for _, zone := range client.HostedZones {
+		if aws.ToString(zone.Name) >= aws.ToString(params.DNSName) {
+			output.HostedZones = append(output.HostedZones, zone)
+		}
+	}
+	return output, nil
+}
+
+func (client *MockDNSClient) ChangeResourceRecordSets(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+	client.changes = append(client.changes, params)
+	if client.ChangeResourceRecordSetsErr != nil {
+		return nil, client.ChangeResourceRecordSetsErr
+	}
+	return &route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &types.ChangeInfo{Id: aws.String("/change/C123"), Status: types.ChangeStatusPending},
+	}, nil
+}
+
+func (client *MockDNSClient) GetChange(ctx context.Context, params *route53.GetChangeInput, optFns ...func(*route53.Options)) (*route53.GetChangeOutput, error) {
+	return &route53.GetChangeOutput{
+		ChangeInfo: &types.ChangeInfo{Id: params.Id, Status: types.ChangeStatusInsync},
+	}, nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -18,28 +19,28 @@ type ec2InstanceInterface interface {
 	DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error)
 }
 
-func createUserDataScript() string {
-	return `#!/bin/bash
-        sudo apt update
-        sudo apt install -y apt-transport-https ca-certificates curl software-properties-common
-        curl -fsSL https://download.docker.com/linux/ubuntu/gpg | sudo apt-key add -
-        sudo add-apt-repository "deb [arch=amd64] https://download.docker.com/linux/ubuntu $(lsb_release -cs) stable"
-        sudo apt update
-        sudo apt install -y docker-ce
-        sudo systemctl start docker
-        sudo systemctl enable docker
-        sudo usermod -aG docker ubuntu
-        sudo curl -L "https://github.com/docker/compose/releases/latest/download/docker-compose-$(uname -s)-$(uname -m)" -o /usr/local/bin/docker-compose
-        sudo chmod +x /usr/local/bin/docker-compose
-        docker --version
-        docker-compose --version
-        sudo snap install amazon-ssm-agent --classic
-        sudo systemctl start snap.amazon-ssm-agent.amazon-ssm-agent
-        sudo systemctl enable snap.amazon-ssm-agent.amazon-ssm-agent
-    `
+// LaunchOptions holds the optional settings of the instance launch.
+type LaunchOptions struct {
+	BlockDeviceMappings []types.BlockDeviceMapping         // from BuildBlockDeviceMappings, AMI defaults when empty
+	LaunchTemplate      *types.LaunchTemplateSpecification // launch from this template instead of the parameters
+
+	Spot                  *SpotOptions // request spot capacity, on-demand when nil
+	FallbackInstanceTypes []string     // tried in order when the instance type has no capacity
+
+	Count          int32    // number of instances, at least one
+	SubnetIDs      []string // instances are spread round-robin over these subnets
+	MaxConcurrency int      // instances waited for at the same time
+	Waits          WaitOptions
 }
 
-func createInstanceInput(securityGroupID, instanceType, amiID, instanceProfileName, userData string) *ec2.RunInstancesInput {
+func createInstanceInput(securityGroupID, instanceType, amiID, instanceProfileName, userData string, opts LaunchOptions) *ec2.RunInstancesInput {
+	if opts.LaunchTemplate != nil {
+		return &ec2.RunInstancesInput{
+			LaunchTemplate: opts.LaunchTemplate,
+			MinCount:       aws.Int32(1),
+			MaxCount:       aws.Int32(1),
+		}
+	}
 	return &ec2.RunInstancesInput{
 		ImageId:          aws.String(amiID),
 		InstanceType:     types.InstanceType(instanceType),
@@ -49,72 +50,195 @@ func createInstanceInput(securityGroupID, instanceType, amiID, instanceProfileNa
 		IamInstanceProfile: &types.IamInstanceProfileSpecification{
 			Name: aws.String(instanceProfileName),
 		},
-		UserData: aws.String(base64.StdEncoding.EncodeToString([]byte(userData))),
-		BlockDeviceMappings: []types.BlockDeviceMapping{
-			{
-				DeviceName: aws.String("/dev/xvda"), // The device name for the root volume
-				Ebs: &types.EbsBlockDevice{
-					VolumeSize:          aws.Int32(15),       // Size of the volume in GB
-					VolumeType:          types.VolumeTypeGp3, // General Purpose SSD (GP3)
-					DeleteOnTermination: aws.Bool(true),
-				},
-			},
-		},
+		UserData:            aws.String(base64.StdEncoding.EncodeToString([]byte(userData))),
+		BlockDeviceMappings: opts.BlockDeviceMappings,
 	}
 }
 
-func waitForInstanceRunning(client ec2InstanceInterface, instanceID string) (string, error) {
+// waitForInstanceRunning waits until the instance is running and returns its addresses.
+func waitForInstanceRunning(client ec2InstanceInterface, instanceID string, waits WaitOptions) (NetworkInfo, error) {
 	describeInstancesInput := &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
 	}
-	log.Printf("Waiting for instance to be in running state...")
-	waiter := ec2.NewInstanceRunningWaiter(client)
-	if err := waiter.Wait(context.Background(), describeInstancesInput, 5*time.Minute); err != nil {
-		return "", fmt.Errorf("instance did not reach running state in time: %v", err)
-	}
-	log.Printf("Instance is now running")
-
-	describeInstancesResult, err := client.DescribeInstances(context.Background(), describeInstancesInput)
+	log.Printf("Waiting for instance %s to be in running state...", instanceID)
+	started := time.Now()
+	waiter := ec2.NewInstanceRunningWaiter(client, func(o *ec2.InstanceRunningWaiterOptions) {
+		retryable := o.Retryable
+		o.Retryable = func(ctx context.Context, input *ec2.DescribeInstancesInput, output *ec2.DescribeInstancesOutput, err error) (bool, error) {
+			state, detail := instanceStateProgress(output, err)
+			waits.report(instanceID, PhaseInstanceRunning, started, state, detail)
+			return retryable(ctx, input, output, err)
+		}
+	})
+	describeInstancesResult, err := waiter.WaitForOutput(context.Background(), describeInstancesInput, waits.InstanceRunningTimeout)
 	if err != nil {
-		return "", fmt.Errorf("failed to describe instances: %v", err)
+		return NetworkInfo{}, fmt.Errorf("instance did not reach running state in time: %v", err)
 	}
-	publicDNS := aws.ToString(describeInstancesResult.Reservations[0].Instances[0].PublicDnsName)
+	log.Printf("Instance %s is now running", instanceID)
 
-	return publicDNS, nil
+	return networkInfo(describeInstancesResult, instanceID)
 }
 
-func waitForInstanceStatusChecks(client ec2InstanceInterface, instanceID string) error {
+func waitForInstanceStatusChecks(client ec2InstanceInterface, instanceID string, waits WaitOptions) error {
 	describeInstanceStatusInput := &ec2.DescribeInstanceStatusInput{
 		InstanceIds: []string{instanceID},
 	}
-	log.Printf("Waiting for instance status checks to complete...")
-	waiter := ec2.NewInstanceStatusOkWaiter(client)
-	if err := waiter.Wait(context.Background(), describeInstanceStatusInput, 10*time.Minute); err != nil {
+	log.Printf("Waiting for instance %s status checks to complete...", instanceID)
+	started := time.Now()
+	waiter := ec2.NewInstanceStatusOkWaiter(client, func(o *ec2.InstanceStatusOkWaiterOptions) {
+		retryable := o.Retryable
+		o.Retryable = func(ctx context.Context, input *ec2.DescribeInstanceStatusInput, output *ec2.DescribeInstanceStatusOutput, err error) (bool, error) {
+			state, detail := instanceStatusProgress(output, err)
+			waits.report(instanceID, PhaseStatusChecks, started, state, detail)
+			return retryable(ctx, input, output, err)
+		}
+	})
+	if err := waiter.Wait(context.Background(), describeInstanceStatusInput, waits.StatusChecksTimeout); err != nil {
 		return fmt.Errorf("instance did not pass status checks in time: %v", err)
 	}
-	log.Printf("Instance has passed status checks")
+	log.Printf("Instance %s has passed status checks", instanceID)
 	return nil
 }
 
-func CreateEC2Instance(client ec2InstanceInterface, securityGroupID, instanceType, amiID, instanceProfileName string) (string, string, error) {
-	userData := createUserDataScript()
-	instanceInput := createInstanceInput(securityGroupID, instanceType, amiID, instanceProfileName, userData)
+// LaunchedInstance describes an instance started by CreateEC2Instances.
+type LaunchedInstance struct {
+	InstanceID    string         `json:"instanceId"`
+	InstanceType  string         `json:"instanceType"`
+	Lifecycle     string         `json:"lifecycle"` // spot or on-demand
+	SpotRequestID string         `json:"spotInstanceRequestId,omitempty"`
+	SubnetID      string         `json:"subnetId,omitempty"`
+	Network       NetworkInfo    `json:"network"`
+	Steps         []StepResult   `json:"steps,omitempty"` // bootstrap steps run over SSM
+	Jenkins       *JenkinsAccess `json:"jenkins,omitempty"`
+	Health        *HealthReport  `json:"health,omitempty"` // probes run after the install
+	Error         string         `json:"error,omitempty"`  // why the instance failed to start or bootstrap
+}
 
-	runResult, err := client.RunInstances(context.Background(), instanceInput)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to run instances: %v", err)
+func newLaunchedInstance(instance types.Instance) LaunchedInstance {
+	launched := LaunchedInstance{
+		InstanceID:   aws.ToString(instance.InstanceId),
+		InstanceType: string(instance.InstanceType),
+		Lifecycle:    "on-demand",
+		SubnetID:     aws.ToString(instance.SubnetId),
 	}
+	if instance.InstanceLifecycle == types.InstanceLifecycleTypeSpot {
+		launched.Lifecycle = "spot"
+		launched.SpotRequestID = aws.ToString(instance.SpotInstanceRequestId)
+	}
+	if instance.Placement != nil {
+		launched.Network.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+	}
+	return launched
+}
 
-	instanceID := aws.ToString(runResult.Instances[0].InstanceId)
+// subnetAllocation is the number of instances launched into one subnet.
+type subnetAllocation struct {
+	SubnetID string
+	Count    int32
+}
 
-	publicDNS, err := waitForInstanceRunning(client, instanceID)
-	if err != nil {
-		return "", "", err
+// distributeInstances spreads the instances round-robin over the subnets. Without subnets
+// all instances go to the default subnet.
+func distributeInstances(count int32, subnetIDs []string) []subnetAllocation {
+	if len(subnetIDs) == 0 {
+		return []subnetAllocation{{Count: count}}
+	}
+	subnetCount := int32(len(subnetIDs))
+	var allocations []subnetAllocation
+	for i, subnetID := range subnetIDs {
+		allocated := count / subnetCount
+		if int32(i) < count%subnetCount {
+			allocated++
+		}
+		if allocated > 0 {
+			allocations = append(allocations, subnetAllocation{SubnetID: subnetID, Count: allocated})
+		}
 	}
+	return allocations
+}
 
-	if err := waitForInstanceStatusChecks(client, instanceID); err != nil {
-		return "", "", err
+// launchInstances starts the instances subnet by subnet. Instances launched before
+// a failure are returned along with the error.
+func launchInstances(client ec2InstanceInterface, securityGroupID, instanceType, amiID, instanceProfileName, userData string, opts LaunchOptions) ([]LaunchedInstance, error) {
+	instanceInput := createInstanceInput(securityGroupID, instanceType, amiID, instanceProfileName, userData, opts)
+	count := opts.Count
+	if count < 1 {
+		count = 1
 	}
 
-	return instanceID, publicDNS, nil
+	var launched []LaunchedInstance
+	for _, allocation := range distributeInstances(count, opts.SubnetIDs) {
+		allocationInput := *instanceInput
+		allocationInput.MinCount = aws.Int32(allocation.Count)
+		allocationInput.MaxCount = aws.Int32(allocation.Count)
+		allocationInput.SubnetId = optionalString(allocation.SubnetID)
+
+		runResult, err := runInstancesWithFallback(client, &allocationInput, instanceType, opts)
+		if err != nil {
+			return launched, fmt.Errorf("failed to run instances: %v", err)
+		}
+		for _, instance := range runResult.Instances {
+			launched = append(launched, newLaunchedInstance(instance))
+		}
+	}
+	return launched, nil
+}
+
+// CreateEC2Instances launches opts.Count instances spread over opts.SubnetIDs and waits until
+// each passes status checks, up to opts.MaxConcurrency at a time. Instances are returned even
+// when some fail, with the failure recorded on the instance. When only part of the instances
+// launch, those that did are still waited for.
+func CreateEC2Instances(client ec2InstanceInterface, securityGroupID, instanceType, amiID, instanceProfileName, userData string, opts LaunchOptions) ([]LaunchedInstance, error) {
+	instances, launchErr := launchInstances(client, securityGroupID, instanceType, amiID, instanceProfileName, userData, opts)
+
+	maxConcurrency := opts.MaxConcurrency
+	if maxConcurrency == 0 {
+		maxConcurrency = defaultMaxConcurrency
+	}
+	waits := opts.Waits.withDefaults()
+	waitErr := RunConcurrently(len(instances), maxConcurrency, func(i int) error {
+		instance := &instances[i]
+		network, err := waitForInstanceRunning(client, instance.InstanceID, waits)
+		if err == nil {
+			instance.Network = network
+			err = waitForInstanceStatusChecks(client, instance.InstanceID, waits)
+		}
+		if err != nil {
+			instance.Error = err.Error()
+			return fmt.Errorf("%s: %v", instance.InstanceID, err)
+		}
+		return nil
+	})
+	switch {
+	case launchErr != nil && waitErr != nil:
+		return instances, fmt.Errorf("%v; instances did not start: %v", launchErr, waitErr)
+	case launchErr != nil:
+		return instances, launchErr
+	case waitErr != nil:
+		return instances, fmt.Errorf("instances did not start: %v", waitErr)
+	}
+	return instances, nil
+}
+
+type instanceTerminationInterface interface {
+	TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+}
+
+// TerminateInstances terminates the instances and waits until they are gone, which also
+// disassociates their Elastic IPs.
+func TerminateInstances(client instanceTerminationInterface, instanceIDs []string) error {
+	_, err := client.TerminateInstances(context.Background(), &ec2.TerminateInstancesInput{
+		InstanceIds: instanceIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to terminate instances: %v", err)
+	}
+	log.Printf("Waiting for instances %s to terminate...", strings.Join(instanceIDs, ", "))
+	waiter := ec2.NewInstanceTerminatedWaiter(client)
+	if err := waiter.Wait(context.Background(), &ec2.DescribeInstancesInput{InstanceIds: instanceIDs}, instanceTerminatedTimeout); err != nil {
+		return fmt.Errorf("instances did not terminate in time: %v", err)
+	}
+	log.Printf("Instances %s are terminated", strings.Join(instanceIDs, ", "))
+	return nil
 }
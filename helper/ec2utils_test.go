@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -18,35 +19,152 @@ type MockEC2Client struct {
 	DescribeInstanceStatusErr error
 }
 
-func TestCreateEC2Instance(t *testing.T) {
+func TestCreateEC2Instances(t *testing.T) {
+	// Short timeouts so the waiters give up after their first poll
+	testLaunchOptions := LaunchOptions{Count: 1, Waits: WaitOptions{InstanceRunningTimeout: time.Second, StatusChecksTimeout: time.Second}}
+
 	t.Run("RunInstancesError", func(t *testing.T) {
-		_, _, err := CreateEC2Instance(MockEC2Client{
+		instances, err := CreateEC2Instances(MockEC2Client{
 			RunInstancesErr: fmt.Errorf("run instances error"),
-		}, "sg-123456", "t2.micro", "ami-123456", "instanceProfileName")
+		}, "sg-123456", "t2.micro", "ami-123456", "instanceProfileName", "#!/bin/bash", testLaunchOptions)
 		assert.Equal(t, "failed to run instances: run instances error", err.Error())
+		assert.Empty(t, instances)
 	})
 
 	t.Run("DescribeInstancesError", func(t *testing.T) {
-		_, _, err := CreateEC2Instance(MockEC2Client{
+		instances, err := CreateEC2Instances(MockEC2Client{
 			DescribeInstancesErr: fmt.Errorf("describe instances error"),
-		}, "securityGroupID", "instanceType", "amiID", "instanceProfileName")
-		assert.NotEqual(t, "instance did not pass status checks in time: %v", err)
+		}, "sg-123456", "t2.micro", "ami-123456", "instanceProfileName", "#!/bin/bash", testLaunchOptions)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "instances did not start: 1 of 1 failed: i-123456: ")
+		assert.Len(t, instances, 1)
+		assert.NotEmpty(t, instances[0].Error)
 	})
 
 	t.Run("DescribeInstanceStatusError", func(t *testing.T) {
-		_, _, err := CreateEC2Instance(MockEC2Client{
+		instances, err := CreateEC2Instances(MockEC2Client{
 			DescribeInstanceStatusErr: fmt.Errorf("describe instance status error"),
-		}, "securityGroupID", "instanceType", "amiID", "instanceProfileName")
-		assert.NotEqual(t, "failed to describe instance status: describe instance status error", err.Error())
+		}, "sg-123456", "t2.micro", "ami-123456", "instanceProfileName", "#!/bin/bash", testLaunchOptions)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "instances did not start: 1 of 1 failed: i-123456: ")
+		assert.Len(t, instances, 1)
 	})
 
 	t.Run("Success", func(t *testing.T) {
-		client := MockEC2Client{}
-		instanceID, publicDNS, err := CreateEC2Instance(client, "sg-123456", "t2.micro", "ami-123456", "instanceProfileName")
-		assert.Error(t, err)
-		assert.NotEqual(t, "i-123456", instanceID)
-		assert.NotEqual(t, "ec2-123-456-789.compute-1.amazonaws.com", publicDNS)
+		instances, err := CreateEC2Instances(&MockCapacityClient{}, "sg-123456", "t2.micro", "ami-123456", "instanceProfileName", "#!/bin/bash", testLaunchOptions)
+		assert.NoError(t, err)
+		assert.Len(t, instances, 1)
+		assert.Equal(t, "i-10", instances[0].InstanceID)
+		assert.Equal(t, "203.0.113.10", instances[0].Network.Address())
 	})
+
+	t.Run("PartialLaunch", func(t *testing.T) {
+		client := &MockCapacityClient{RunInstancesErrs: []error{nil, apiError("UnauthorizedOperation", "denied")}}
+		instances, err := CreateEC2Instances(client, "sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{
+			Count:     2,
+			SubnetIDs: []string{"subnet-a", "subnet-b"},
+			Waits:     WaitOptions{InstanceRunningTimeout: time.Second, StatusChecksTimeout: time.Second},
+		})
+		assert.EqualError(t, err, "failed to run instances: api error UnauthorizedOperation: denied")
+		// The launched instance is still waited for, so it can be bootstrapped
+		assert.Len(t, instances, 1)
+		assert.Empty(t, instances[0].Error)
+		assert.Equal(t, "203.0.113.10", instances[0].Network.Address())
+	})
+}
+
+func TestDistributeInstances(t *testing.T) {
+	assert.Equal(t, []subnetAllocation{{Count: 3}}, distributeInstances(3, nil))
+	assert.Equal(t, []subnetAllocation{
+		{SubnetID: "subnet-a", Count: 2},
+		{SubnetID: "subnet-b", Count: 2},
+		{SubnetID: "subnet-c", Count: 1},
+	}, distributeInstances(5, []string{"subnet-a", "subnet-b", "subnet-c"}))
+	assert.Equal(t, []subnetAllocation{{SubnetID: "subnet-a", Count: 1}}, distributeInstances(1, []string{"subnet-a", "subnet-b"}))
+}
+
+func TestLaunchInstances(t *testing.T) {
+	t.Run("SpreadOverSubnets", func(t *testing.T) {
+		client := &MockCapacityClient{}
+		instances, err := launchInstances(client, "sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{
+			Count:     3,
+			SubnetIDs: []string{"subnet-a", "subnet-b"},
+		})
+		assert.NoError(t, err)
+		assert.Len(t, client.inputs, 2)
+		assert.Equal(t, "subnet-a", aws.ToString(client.inputs[0].SubnetId))
+		assert.Equal(t, int32(2), aws.ToInt32(client.inputs[0].MinCount))
+		assert.Equal(t, int32(2), aws.ToInt32(client.inputs[0].MaxCount))
+		assert.Equal(t, "subnet-b", aws.ToString(client.inputs[1].SubnetId))
+		assert.Equal(t, int32(1), aws.ToInt32(client.inputs[1].MaxCount))
+
+		assert.Len(t, instances, 3)
+		assert.Equal(t, "subnet-a", instances[0].SubnetID)
+		assert.Equal(t, "subnet-b", instances[2].SubnetID)
+		assert.Equal(t, "t3.medium", instances[2].InstanceType)
+		assert.Equal(t, "on-demand", instances[2].Lifecycle)
+	})
+
+	t.Run("DefaultSubnet", func(t *testing.T) {
+		client := &MockCapacityClient{}
+		instances, err := launchInstances(client, "sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, instances, 1)
+		assert.Nil(t, client.inputs[0].SubnetId)
+	})
+
+	t.Run("Spot", func(t *testing.T) {
+		client := &MockCapacityClient{}
+		instances, err := launchInstances(client, "sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{Spot: &SpotOptions{InterruptionBehavior: "stop"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "spot", instances[0].Lifecycle)
+		assert.Equal(t, "sir-10", instances[0].SpotRequestID)
+	})
+
+	t.Run("PartialFailure", func(t *testing.T) {
+		client := &MockCapacityClient{RunInstancesErrs: []error{nil, apiError("UnauthorizedOperation", "denied")}}
+		instances, err := launchInstances(client, "sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{
+			Count:     2,
+			SubnetIDs: []string{"subnet-a", "subnet-b"},
+		})
+		assert.Equal(t, "failed to run instances: api error UnauthorizedOperation: denied", err.Error())
+		assert.Len(t, instances, 1)
+		assert.Equal(t, "subnet-a", instances[0].SubnetID)
+	})
+}
+
+// Mock implementation of the instanceTerminationInterface for testing
+type MockTerminationClient struct {
+	TerminateInstancesErr error
+	terminated            []string
+}
+
+func TestTerminateInstances(t *testing.T) {
+	client := &MockTerminationClient{}
+	assert.NoError(t, TerminateInstances(client, []string{"i-1", "i-2"}))
+	assert.Equal(t, []string{"i-1", "i-2"}, client.terminated)
+
+	err := TerminateInstances(&MockTerminationClient{TerminateInstancesErr: fmt.Errorf("not authorized")}, []string{"i-1"})
+	assert.Equal(t, "failed to terminate instances: not authorized", err.Error())
+}
+
+func (client *MockTerminationClient) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	if client.TerminateInstancesErr != nil {
+		return nil, client.TerminateInstancesErr
+	}
+	client.terminated = append(client.terminated, params.InstanceIds...)
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func (client *MockTerminationClient) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	var instances []types.Instance
+	for _, instanceID := range params.InstanceIds {
+		instances = append(instances, types.Instance{
+			InstanceId: aws.String(instanceID),
+			State:      &types.InstanceState{Name: types.InstanceStateNameTerminated},
+		})
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: instances}}}, nil
 }
 
 func (client MockEC2Client) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
@@ -0,0 +1,93 @@
+package helper
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// How long each health probe may take
+const healthProbeTimeout = 2 * time.Minute
+
+// HealthProbe is a shell check run on the instance; it passes when it exits with 0.
+type HealthProbe struct {
+	Name     string
+	Commands []string
+}
+
+// Probes run after the install
+var healthProbes = []HealthProbe{
+	{Name: "docker", Commands: []string{"docker info --format 'Docker {{.ServerVersion}}, {{.ContainersRunning}} containers running'"}},
+	{Name: "jenkins service", Commands: []string{"systemctl is-active jenkins"}},
+	{Name: "jenkins http", Commands: []string{
+		fmt.Sprintf("code=$(curl -s -o /dev/null -w '%%{http_code}' http://localhost:%d/login) || true", jenkinsPort),
+		`echo "HTTP $code"`,
+		`[ "$code" = 200 ] || { echo "expected HTTP 200 from /login, got $code" >&2; exit 1; }`,
+	}},
+	{Name: "java", Commands: []string{`version=$(java -version 2>&1) && echo "$version" | head -n 1`}},
+	// The install adds the standalone docker-compose binary; the Compose plugin of Docker also passes
+	{Name: "docker compose", Commands: []string{"docker-compose version 2>/dev/null || docker compose version"}},
+}
+
+// ProbeResult is the outcome of one health probe.
+type ProbeResult struct {
+	Name     string `json:"name"`
+	Healthy  bool   `json:"healthy"`
+	ExitCode int32  `json:"exitCode"` // -1 when the probe did not finish
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HealthReport is the outcome of the health probes of an instance.
+type HealthReport struct {
+	Healthy   bool          `json:"healthy"`
+	CheckedAt time.Time     `json:"checkedAt"`
+	Probes    []ProbeResult `json:"probes"`
+}
+
+// Failed returns the names of the probes that did not pass.
+func (report *HealthReport) Failed() []string {
+	var failed []string
+	for _, probe := range report.Probes {
+		if !probe.Healthy {
+			failed = append(failed, probe.Name)
+		}
+	}
+	return failed
+}
+
+// CheckHealth runs every health probe on the instance, each as its own SSM command, and reports
+// all of them. The report is returned also when probes fail, together with an error naming them.
+func CheckHealth(client ssmCommandInterface, instanceID string, waits WaitOptions) (*HealthReport, error) {
+	waits = waits.withDefaults()
+	if waits.SSMCommandTimeout > healthProbeTimeout {
+		waits.SSMCommandTimeout = healthProbeTimeout
+	}
+
+	report := &HealthReport{CheckedAt: time.Now().UTC()}
+	var problems []string
+	for _, probe := range healthProbes {
+		result, err := runSSMCommand(client, instanceID, probe.Commands, waits, nil)
+		probeResult := ProbeResult{
+			Name:     probe.Name,
+			Healthy:  err == nil,
+			ExitCode: result.ExitCode,
+			Output:   strings.TrimSpace(result.Stdout),
+		}
+		if err != nil {
+			probeResult.Error = err.Error()
+			problems = append(problems, fmt.Sprintf("%s: %v", probe.Name, err))
+			log.Printf("Health probe %q on %s failed: %v\n", probe.Name, instanceID, err)
+		} else {
+			log.Printf("Health probe %q on %s passed: %s\n", probe.Name, instanceID, probeResult.Output)
+		}
+		report.Probes = append(report.Probes, probeResult)
+	}
+
+	report.Healthy = len(problems) == 0
+	if !report.Healthy {
+		return report, fmt.Errorf("%d of %d health probes failed: %s", len(problems), len(healthProbes), strings.Join(problems, "; "))
+	}
+	return report, nil
+}
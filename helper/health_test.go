@@ -0,0 +1,48 @@
+package helper
+
+import (
+	"testing"
+	"time"
+
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckHealth(t *testing.T) {
+	waits := WaitOptions{SSMCommandTimeout: time.Second}
+
+	t.Run("Healthy", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess, Stdout: "ok\n"}}}
+		report, err := CheckHealth(client, "i-123456", waits)
+		assert.NoError(t, err)
+		assert.True(t, report.Healthy)
+		assert.Empty(t, report.Failed())
+		assert.Len(t, report.Probes, len(healthProbes))
+		assert.Equal(t, ProbeResult{Name: "docker", Healthy: true, Output: "ok"}, report.Probes[0])
+		// Every probe is its own command
+		assert.Len(t, client.sentCommands, len(healthProbes))
+		assert.Equal(t, []string{"systemctl is-active jenkins"}, client.sentCommands[1])
+		assert.Equal(t, []string{"docker-compose version 2>/dev/null || docker compose version"}, client.sentCommands[4])
+	})
+
+	t.Run("Unhealthy", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusFailed, ExitCode: 1, Stdout: "HTTP 503\n", Stderr: "expected HTTP 200 from /login, got 503\n"}}}
+		report, err := CheckHealth(client, "i-123456", waits)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "5 of 5 health probes failed: docker: ")
+		assert.Contains(t, err.Error(), "(status Failed, exit code 1): expected HTTP 200 from /login, got 503")
+		// All probes run and are reported
+		assert.False(t, report.Healthy)
+		assert.Equal(t, []string{"docker", "jenkins service", "jenkins http", "java", "docker compose"}, report.Failed())
+		assert.Equal(t, int32(1), report.Probes[2].ExitCode)
+		assert.Equal(t, "HTTP 503", report.Probes[2].Output)
+		assert.NotEmpty(t, report.Probes[2].Error)
+	})
+
+	t.Run("SendCommandError", func(t *testing.T) {
+		client := &MockSSMClient{SendCommandErr: apiError("AccessDeniedException", "denied")}
+		report, err := CheckHealth(client, "i-123456", waits)
+		assert.Error(t, err)
+		assert.Equal(t, int32(-1), report.Probes[0].ExitCode)
+	})
+}
@@ -2,9 +2,11 @@ package helper
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
@@ -18,16 +20,36 @@ type iamutilsInterface interface {
 	AttachRolePolicy(ctx context.Context, params *iam.AttachRolePolicyInput, optFns ...func(*iam.Options)) (*iam.AttachRolePolicyOutput, error)
 	CreateInstanceProfile(ctx context.Context, params *iam.CreateInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.CreateInstanceProfileOutput, error)
 	AddRoleToInstanceProfile(ctx context.Context, params *iam.AddRoleToInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.AddRoleToInstanceProfileOutput, error)
+	PutRolePermissionsBoundary(ctx context.Context, params *iam.PutRolePermissionsBoundaryInput, optFns ...func(*iam.Options)) (*iam.PutRolePermissionsBoundaryOutput, error)
+	PutRolePolicy(ctx context.Context, params *iam.PutRolePolicyInput, optFns ...func(*iam.Options)) (*iam.PutRolePolicyOutput, error)
+}
+
+// Inline policies of the role allowing the instances to read the Jenkins admin secret and to
+// write the full output of the SSM commands
+const (
+	secretReadPolicyName  = "Jenkins-Admin-Secret-Read"
+	outputWritePolicyName = "SSM-Output-Write"
+)
+
+// IAMRoleOptions holds the optional settings applied to the role and its instance profile.
+type IAMRoleOptions struct {
+	PermissionsBoundary string // ARN of the managed policy used as the permissions boundary
+	Path                string // e.g. /automation/
+	MaxSessionDuration  int32  // in seconds, 0 keeps the AWS default
+	Description         string
 }
 
 // EnsureIAMRole checks if the IAM role exists and creates it if it doesn't, attaching the necessary policies.
-func EnsureIAMRole(client iamutilsInterface, roleName string) (string, error) {
-	_, err := client.GetRole(context.Background(), &iam.GetRoleInput{
+func EnsureIAMRole(client iamutilsInterface, roleName string, opts IAMRoleOptions) (string, error) {
+	getRoleOutput, err := client.GetRole(context.Background(), &iam.GetRoleInput{
 		RoleName: aws.String(roleName),
 	})
 
 	if err == nil {
 		log.Printf("IAM role %s already exists\n", roleName)
+		if err := reconcilePermissionsBoundary(client, getRoleOutput.Role, roleName, opts.PermissionsBoundary); err != nil {
+			return "", err
+		}
 		return roleName, nil
 	} else {
 		var notFound *iamTypes.NoSuchEntityException
@@ -99,10 +121,7 @@ func EnsureIAMRole(client iamutilsInterface, roleName string) (string, error) {
 		log.Printf("Created IAM policy SSM-SessionManager-Policy")
 
 		// Create the IAM role
-		_, err = client.CreateRole(context.Background(), &iam.CreateRoleInput{
-			RoleName:                 aws.String(roleName),
-			AssumeRolePolicyDocument: aws.String(`{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Principal": {"Service": "ec2.amazonaws.com"}, "Action": "sts:AssumeRole"}]}`),
-		})
+		_, err = client.CreateRole(context.Background(), createRoleInput(roleName, opts))
 		if err != nil {
 			return "", fmt.Errorf("failed to create IAM role: %v", err)
 		}
@@ -121,6 +140,7 @@ func EnsureIAMRole(client iamutilsInterface, roleName string) (string, error) {
 		// Create an instance profile
 		_, err = client.CreateInstanceProfile(context.Background(), &iam.CreateInstanceProfileInput{
 			InstanceProfileName: aws.String(roleName),
+			Path:                optionalString(opts.Path),
 		})
 		if err != nil {
 			return "", fmt.Errorf("failed to create instance profile: %v", err)
@@ -142,3 +162,128 @@ func EnsureIAMRole(client iamutilsInterface, roleName string) (string, error) {
 	}
 
 }
+
+func createRoleInput(roleName string, opts IAMRoleOptions) *iam.CreateRoleInput {
+	input := &iam.CreateRoleInput{
+		RoleName:                 aws.String(roleName),
+		AssumeRolePolicyDocument: aws.String(`{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Principal": {"Service": "ec2.amazonaws.com"}, "Action": "sts:AssumeRole"}]}`),
+		Path:                     optionalString(opts.Path),
+		PermissionsBoundary:      optionalString(opts.PermissionsBoundary),
+		Description:              optionalString(opts.Description),
+	}
+	if opts.MaxSessionDuration > 0 {
+		input.MaxSessionDuration = aws.Int32(opts.MaxSessionDuration)
+	}
+	return input
+}
+
+// reconcilePermissionsBoundary puts the configured boundary on an existing role that lacks it.
+func reconcilePermissionsBoundary(client iamutilsInterface, role *iamTypes.Role, roleName, boundaryArn string) error {
+	if boundaryArn == "" {
+		return nil
+	}
+	if role != nil && role.PermissionsBoundary != nil && aws.ToString(role.PermissionsBoundary.PermissionsBoundaryArn) == boundaryArn {
+		return nil
+	}
+
+	_, err := client.PutRolePermissionsBoundary(context.Background(), &iam.PutRolePermissionsBoundaryInput{
+		RoleName:            aws.String(roleName),
+		PermissionsBoundary: aws.String(boundaryArn),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put permissions boundary on role: %v", err)
+	}
+	log.Printf("Applied permissions boundary %s to role %s\n", boundaryArn, roleName)
+	return nil
+}
+
+// GrantSecretRead puts an inline policy on the role that allows reading the secret, and only that
+// secret. It replaces the policy written by an earlier run, so the role can read one secret.
+func GrantSecretRead(client iamutilsInterface, roleName, secretARN string) error {
+	statements := []map[string]interface{}{
+		{
+			"Effect":   "Allow",
+			"Action":   "secretsmanager:GetSecretValue",
+			"Resource": secretARN,
+		},
+	}
+	if err := putRolePolicy(client, roleName, secretReadPolicyName, statements); err != nil {
+		return err
+	}
+	log.Printf("Allowed role %s to read secret %s\n", roleName, secretARN)
+	return nil
+}
+
+// GrantOutputWrite puts an inline policy on the role that allows the SSM agent to write the
+// command output to the bucket prefix and the log group of the options. Options without a
+// bucket or log group leave the role unchanged.
+func GrantOutputWrite(client iamutilsInterface, roleName string, opts SSMOutputOptions) error {
+	var statements []map[string]interface{}
+	if opts.S3Bucket != "" {
+		objects := opts.S3Bucket + "/*"
+		if prefix := strings.Trim(opts.S3KeyPrefix, "/"); prefix != "" {
+			objects = opts.S3Bucket + "/" + prefix + "/*"
+		}
+		statements = append(statements,
+			map[string]interface{}{
+				"Effect":   "Allow",
+				"Action":   "s3:PutObject",
+				"Resource": "arn:aws:s3:::" + objects,
+			},
+			map[string]interface{}{
+				"Effect":   "Allow",
+				"Action":   "s3:GetEncryptionConfiguration",
+				"Resource": "arn:aws:s3:::" + opts.S3Bucket,
+			})
+	}
+	if opts.LogGroup != "" {
+		logGroup := "arn:aws:logs:*:*:log-group:" + opts.LogGroup
+		statements = append(statements,
+			map[string]interface{}{
+				"Effect":   "Allow",
+				"Action":   []string{"logs:CreateLogGroup", "logs:CreateLogStream", "logs:DescribeLogStreams", "logs:PutLogEvents"},
+				"Resource": []string{logGroup, logGroup + ":*"},
+			},
+			map[string]interface{}{
+				"Effect":   "Allow",
+				"Action":   "logs:DescribeLogGroups",
+				"Resource": "*",
+			})
+	}
+	if len(statements) == 0 {
+		return nil
+	}
+	if err := putRolePolicy(client, roleName, outputWritePolicyName, statements); err != nil {
+		return err
+	}
+	log.Printf("Allowed role %s to write the SSM command output\n", roleName)
+	return nil
+}
+
+// putRolePolicy puts the statements on the role as an inline policy, replacing the one of the same name.
+func putRolePolicy(client iamutilsInterface, roleName, policyName string, statements []map[string]interface{}) error {
+	policyDocument, err := json.Marshal(map[string]interface{}{
+		"Version":   "2012-10-17",
+		"Statement": statements,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode IAM policy: %v", err)
+	}
+	_, err = client.PutRolePolicy(context.Background(), &iam.PutRolePolicyInput{
+		RoleName:       aws.String(roleName),
+		PolicyName:     aws.String(policyName),
+		PolicyDocument: aws.String(string(policyDocument)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put policy %s on role %s: %v", policyName, roleName, err)
+	}
+	return nil
+}
+
+// optionalString returns nil for an empty value so unset options are left out of the request.
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
@@ -13,98 +13,229 @@ import (
 )
 
 type MockIAMClient struct {
-	GetRoleErr                  error
-	CreatePolicyErr             error
-	CreateRoleErr               error
-	AttachRolePolicyErr         error
-	CreateInstanceProfileErr    error
-	AddRoleToInstanceProfileErr error
+	GetRoleErr                    error
+	CreatePolicyErr               error
+	CreateRoleErr                 error
+	AttachRolePolicyErr           error
+	CreateInstanceProfileErr      error
+	AddRoleToInstanceProfileErr   error
+	PutRolePermissionsBoundaryErr error
+	PutRolePolicyErr              error
+	ExistingBoundary              string
+
+	createRoleInput            *iam.CreateRoleInput
+	createInstanceProfileInput *iam.CreateInstanceProfileInput
+	putBoundaryInput           *iam.PutRolePermissionsBoundaryInput
+	putRolePolicyInput         *iam.PutRolePolicyInput
 }
 
 func TestEnsureIAMRole(t *testing.T) {
 	roleName := "test-role"
 
 	t.Run("GetRoleError", func(t *testing.T) {
-		client := MockIAMClient{
+		client := &MockIAMClient{
 			GetRoleErr: fmt.Errorf("get role error"),
 		}
-		_, err := EnsureIAMRole(client, roleName)
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, "get role error", err.Error())
 	})
 
 	t.Run("CreatePolicyError", func(t *testing.T) {
-		client := MockIAMClient{
+		client := &MockIAMClient{
 			GetRoleErr:      &types.NoSuchEntityException{},
 			CreatePolicyErr: fmt.Errorf("create policy error"),
 		}
-		_, err := EnsureIAMRole(client, roleName)
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, "failed to create IAM policy: create policy error", err.Error())
 	})
 
 	t.Run("CreateRoleError", func(t *testing.T) {
-		client := MockIAMClient{
+		client := &MockIAMClient{
 			GetRoleErr:    &types.NoSuchEntityException{},
 			CreateRoleErr: fmt.Errorf("create role error"),
 		}
-		_, err := EnsureIAMRole(client, roleName)
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, "failed to create IAM role: create role error", err.Error())
 	})
 
 	t.Run("AttachRolePolicyError", func(t *testing.T) {
-		client := MockIAMClient{
+		client := &MockIAMClient{
 			GetRoleErr:          &types.NoSuchEntityException{},
 			AttachRolePolicyErr: fmt.Errorf("attach role policy error"),
 		}
-		_, err := EnsureIAMRole(client, roleName)
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, "failed to attach IAM policy to role: attach role policy error", err.Error())
 	})
 
 	t.Run("CreateInstanceProfileError", func(t *testing.T) {
-		client := MockIAMClient{
+		client := &MockIAMClient{
 			GetRoleErr:               &types.NoSuchEntityException{},
 			CreateInstanceProfileErr: fmt.Errorf("create instance profile error"),
 		}
-		_, err := EnsureIAMRole(client, roleName)
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, "failed to create instance profile: create instance profile error", err.Error())
 	})
 
 	t.Run("AddRoleToInstanceProfileError", func(t *testing.T) {
-		client := MockIAMClient{
+		client := &MockIAMClient{
 			GetRoleErr:                  &types.NoSuchEntityException{},
 			AddRoleToInstanceProfileErr: fmt.Errorf("add role to instance profile error"),
 		}
-		_, err := EnsureIAMRole(client, roleName)
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{})
 		assert.Error(t, err)
 		assert.Equal(t, "failed to add role to instance profile: add role to instance profile error", err.Error())
 	})
 
 	t.Run("Success", func(t *testing.T) {
-		client := MockIAMClient{
+		client := &MockIAMClient{
 			GetRoleErr: &types.NoSuchEntityException{},
 		}
-		result, err := EnsureIAMRole(client, roleName)
+		result, err := EnsureIAMRole(client, roleName, IAMRoleOptions{})
 		assert.NoError(t, err)
 		assert.Equal(t, roleName, result)
 	})
+
+	t.Run("CreateWithOptions", func(t *testing.T) {
+		client := &MockIAMClient{
+			GetRoleErr: &types.NoSuchEntityException{},
+		}
+		opts := IAMRoleOptions{
+			PermissionsBoundary: "arn:aws:iam::123456789012:policy/boundary",
+			Path:                "/automation/",
+			MaxSessionDuration:  7200,
+			Description:         "Jenkins host role",
+		}
+		_, err := EnsureIAMRole(client, roleName, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, opts.PermissionsBoundary, aws.ToString(client.createRoleInput.PermissionsBoundary))
+		assert.Equal(t, opts.Path, aws.ToString(client.createRoleInput.Path))
+		assert.Equal(t, opts.MaxSessionDuration, aws.ToInt32(client.createRoleInput.MaxSessionDuration))
+		assert.Equal(t, opts.Description, aws.ToString(client.createRoleInput.Description))
+		assert.Equal(t, opts.Path, aws.ToString(client.createInstanceProfileInput.Path))
+	})
+
+	t.Run("CreateWithoutOptions", func(t *testing.T) {
+		client := &MockIAMClient{
+			GetRoleErr: &types.NoSuchEntityException{},
+		}
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{})
+		assert.NoError(t, err)
+		assert.Nil(t, client.createRoleInput.PermissionsBoundary)
+		assert.Nil(t, client.createRoleInput.Path)
+		assert.Nil(t, client.createRoleInput.MaxSessionDuration)
+		assert.Nil(t, client.createInstanceProfileInput.Path)
+	})
+
+	t.Run("ExistingRoleMissingBoundary", func(t *testing.T) {
+		client := &MockIAMClient{}
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{PermissionsBoundary: "arn:aws:iam::123456789012:policy/boundary"})
+		assert.NoError(t, err)
+		assert.NotNil(t, client.putBoundaryInput)
+		assert.Equal(t, "arn:aws:iam::123456789012:policy/boundary", aws.ToString(client.putBoundaryInput.PermissionsBoundary))
+	})
+
+	t.Run("ExistingRoleWithBoundary", func(t *testing.T) {
+		client := &MockIAMClient{ExistingBoundary: "arn:aws:iam::123456789012:policy/boundary"}
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{PermissionsBoundary: "arn:aws:iam::123456789012:policy/boundary"})
+		assert.NoError(t, err)
+		assert.Nil(t, client.putBoundaryInput)
+	})
+
+	t.Run("PutRolePermissionsBoundaryError", func(t *testing.T) {
+		client := &MockIAMClient{PutRolePermissionsBoundaryErr: fmt.Errorf("put boundary error")}
+		_, err := EnsureIAMRole(client, roleName, IAMRoleOptions{PermissionsBoundary: "arn:aws:iam::123456789012:policy/boundary"})
+		assert.Error(t, err)
+		assert.Equal(t, "failed to put permissions boundary on role: put boundary error", err.Error())
+	})
+}
+
+func TestGrantSecretRead(t *testing.T) {
+	secretARN := "arn:aws:secretsmanager:us-east-1:123456789012:secret:jenkins/admin-AbCdEf"
+
+	t.Run("Success", func(t *testing.T) {
+		client := &MockIAMClient{}
+		err := GrantSecretRead(client, "jenkins-role", secretARN)
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins-role", aws.ToString(client.putRolePolicyInput.RoleName))
+		assert.Equal(t, "Jenkins-Admin-Secret-Read", aws.ToString(client.putRolePolicyInput.PolicyName))
+		assert.JSONEq(t, `{
+			"Version": "2012-10-17",
+			"Statement": [{"Effect": "Allow", "Action": "secretsmanager:GetSecretValue", "Resource": "`+secretARN+`"}]
+		}`, aws.ToString(client.putRolePolicyInput.PolicyDocument))
+	})
+
+	t.Run("PutRolePolicyError", func(t *testing.T) {
+		client := &MockIAMClient{PutRolePolicyErr: fmt.Errorf("access denied")}
+		err := GrantSecretRead(client, "jenkins-role", secretARN)
+		assert.EqualError(t, err, "failed to put policy Jenkins-Admin-Secret-Read on role jenkins-role: access denied")
+	})
+}
+
+func TestGrantOutputWrite(t *testing.T) {
+	t.Run("BucketAndLogGroup", func(t *testing.T) {
+		client := &MockIAMClient{}
+		err := GrantOutputWrite(client, "jenkins-role", SSMOutputOptions{S3Bucket: "build-logs", S3KeyPrefix: "/jenkins/", LogGroup: "/jenkins/ssm"})
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins-role", aws.ToString(client.putRolePolicyInput.RoleName))
+		assert.Equal(t, "SSM-Output-Write", aws.ToString(client.putRolePolicyInput.PolicyName))
+		assert.JSONEq(t, `{
+			"Version": "2012-10-17",
+			"Statement": [
+				{"Effect": "Allow", "Action": "s3:PutObject", "Resource": "arn:aws:s3:::build-logs/jenkins/*"},
+				{"Effect": "Allow", "Action": "s3:GetEncryptionConfiguration", "Resource": "arn:aws:s3:::build-logs"},
+				{
+					"Effect": "Allow",
+					"Action": ["logs:CreateLogGroup", "logs:CreateLogStream", "logs:DescribeLogStreams", "logs:PutLogEvents"],
+					"Resource": ["arn:aws:logs:*:*:log-group:/jenkins/ssm", "arn:aws:logs:*:*:log-group:/jenkins/ssm:*"]
+				},
+				{"Effect": "Allow", "Action": "logs:DescribeLogGroups", "Resource": "*"}
+			]
+		}`, aws.ToString(client.putRolePolicyInput.PolicyDocument))
+	})
+
+	t.Run("BucketWithoutPrefix", func(t *testing.T) {
+		client := &MockIAMClient{}
+		err := GrantOutputWrite(client, "jenkins-role", SSMOutputOptions{S3Bucket: "build-logs"})
+		assert.NoError(t, err)
+		assert.Contains(t, aws.ToString(client.putRolePolicyInput.PolicyDocument), `"Resource":"arn:aws:s3:::build-logs/*"`)
+		assert.NotContains(t, aws.ToString(client.putRolePolicyInput.PolicyDocument), "logs:")
+	})
+
+	t.Run("NoOutputLocation", func(t *testing.T) {
+		client := &MockIAMClient{}
+		err := GrantOutputWrite(client, "jenkins-role", SSMOutputOptions{Dir: "out"})
+		assert.NoError(t, err)
+		assert.Nil(t, client.putRolePolicyInput)
+	})
+
+	t.Run("PutRolePolicyError", func(t *testing.T) {
+		client := &MockIAMClient{PutRolePolicyErr: fmt.Errorf("access denied")}
+		err := GrantOutputWrite(client, "jenkins-role", SSMOutputOptions{LogGroup: "/jenkins/ssm"})
+		assert.EqualError(t, err, "failed to put policy SSM-Output-Write on role jenkins-role: access denied")
+	})
 }
 
-func (m MockIAMClient) GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error) {
+func (m *MockIAMClient) GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error) {
 	if m.GetRoleErr != nil {
 		return nil, m.GetRoleErr
 	}
-	return &iam.GetRoleOutput{
-		Role: &types.Role{
-			RoleName: params.RoleName,
-		},
-	}, nil
+	role := &types.Role{
+		RoleName: params.RoleName,
+	}
+	if m.ExistingBoundary != "" {
+		role.PermissionsBoundary = &types.AttachedPermissionsBoundary{
+			PermissionsBoundaryArn: aws.String(m.ExistingBoundary),
+		}
+	}
+	return &iam.GetRoleOutput{Role: role}, nil
 }
 
-func (m MockIAMClient) CreatePolicy(ctx context.Context, params *iam.CreatePolicyInput, optFns ...func(*iam.Options)) (*iam.CreatePolicyOutput, error) {
+func (m *MockIAMClient) CreatePolicy(ctx context.Context, params *iam.CreatePolicyInput, optFns ...func(*iam.Options)) (*iam.CreatePolicyOutput, error) {
 	if m.CreatePolicyErr != nil {
 		return nil, m.CreatePolicyErr
 	}
@@ -115,30 +246,48 @@ func (m MockIAMClient) CreatePolicy(ctx context.Context, params *iam.CreatePolic
 	}, nil
 }
 
-func (m MockIAMClient) CreateRole(ctx context.Context, params *iam.CreateRoleInput, optFns ...func(*iam.Options)) (*iam.CreateRoleOutput, error) {
+func (m *MockIAMClient) CreateRole(ctx context.Context, params *iam.CreateRoleInput, optFns ...func(*iam.Options)) (*iam.CreateRoleOutput, error) {
 	if m.CreateRoleErr != nil {
 		return nil, m.CreateRoleErr
 	}
+	m.createRoleInput = params
 	return &iam.CreateRoleOutput{}, nil
 }
 
-func (m MockIAMClient) AttachRolePolicy(ctx context.Context, params *iam.AttachRolePolicyInput, optFns ...func(*iam.Options)) (*iam.AttachRolePolicyOutput, error) {
+func (m *MockIAMClient) AttachRolePolicy(ctx context.Context, params *iam.AttachRolePolicyInput, optFns ...func(*iam.Options)) (*iam.AttachRolePolicyOutput, error) {
 	if m.AttachRolePolicyErr != nil {
 		return nil, m.AttachRolePolicyErr
 	}
 	return &iam.AttachRolePolicyOutput{}, nil
 }
 
-func (m MockIAMClient) CreateInstanceProfile(ctx context.Context, params *iam.CreateInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.CreateInstanceProfileOutput, error) {
+func (m *MockIAMClient) CreateInstanceProfile(ctx context.Context, params *iam.CreateInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.CreateInstanceProfileOutput, error) {
 	if m.CreateInstanceProfileErr != nil {
 		return nil, m.CreateInstanceProfileErr
 	}
+	m.createInstanceProfileInput = params
 	return &iam.CreateInstanceProfileOutput{}, nil
 }
 
-func (m MockIAMClient) AddRoleToInstanceProfile(ctx context.Context, params *iam.AddRoleToInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.AddRoleToInstanceProfileOutput, error) {
+func (m *MockIAMClient) AddRoleToInstanceProfile(ctx context.Context, params *iam.AddRoleToInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.AddRoleToInstanceProfileOutput, error) {
 	if m.AddRoleToInstanceProfileErr != nil {
 		return nil, m.AddRoleToInstanceProfileErr
 	}
 	return &iam.AddRoleToInstanceProfileOutput{}, nil
 }
+
+func (m *MockIAMClient) PutRolePermissionsBoundary(ctx context.Context, params *iam.PutRolePermissionsBoundaryInput, optFns ...func(*iam.Options)) (*iam.PutRolePermissionsBoundaryOutput, error) {
+	if m.PutRolePermissionsBoundaryErr != nil {
+		return nil, m.PutRolePermissionsBoundaryErr
+	}
+	m.putBoundaryInput = params
+	return &iam.PutRolePermissionsBoundaryOutput{}, nil
+}
+
+func (m *MockIAMClient) PutRolePolicy(ctx context.Context, params *iam.PutRolePolicyInput, optFns ...func(*iam.Options)) (*iam.PutRolePolicyOutput, error) {
+	if m.PutRolePolicyErr != nil {
+		return nil, m.PutRolePolicyErr
+	}
+	m.putRolePolicyInput = params
+	return &iam.PutRolePolicyOutput{}, nil
+}
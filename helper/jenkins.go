@@ -0,0 +1,74 @@
+package helper
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Port Jenkins listens on
+const jenkinsPort = 8080
+
+// Where Jenkins writes the password that unlocks the setup wizard
+const initialAdminPasswordFile = "/var/lib/jenkins/secrets/initialAdminPassword"
+
+// Secret the initial admin password is stored in when the settings leave it unset
+const defaultAdminPasswordSecretName = "jenkins/initialAdminPassword"
+
+// How often the instance checks whether Jenkins answers
+const jenkinsPollSeconds = 5
+
+// JenkinsAccess tells how to reach and unlock the Jenkins of an instance. The password itself
+// is only kept in Secrets Manager.
+type JenkinsAccess struct {
+	URL                 string `json:"url"`
+	AdminPasswordSecret string `json:"adminPasswordSecret,omitempty"` // ARN of the secret
+}
+
+// JenkinsURL returns the URL Jenkins is reached at on the instance.
+func JenkinsURL(network NetworkInfo) string {
+	return fmt.Sprintf("http://%s:%d", network.Address(), jenkinsPort)
+}
+
+// WaitForJenkins waits until Jenkins answers HTTP requests on the instance. The check runs on
+// the instance over SSM, so it does not depend on the security group allowing the port.
+func WaitForJenkins(client ssmCommandInterface, instanceID string, waits WaitOptions) error {
+	waits = waits.withDefaults()
+	attempts := int(waits.JenkinsTimeout.Seconds())/jenkinsPollSeconds + 1
+	log.Printf("Waiting for Jenkins on %s to answer...", instanceID)
+	// The command itself keeps polling, so give it the Jenkins timeout on top of the command timeout
+	waits.SSMCommandTimeout += waits.JenkinsTimeout
+	result, err := runSSMCommand(client, instanceID, []string{
+		fmt.Sprintf("for i in $(seq 1 %d); do", attempts),
+		fmt.Sprintf("  code=$(curl -s -o /dev/null -w '%%{http_code}' http://localhost:%d/login) || true", jenkinsPort),
+		`  if [ -n "$code" ] && [ "$code" != "000" ]; then echo "$code"; exit 0; fi`,
+		fmt.Sprintf("  sleep %d", jenkinsPollSeconds),
+		"done",
+		fmt.Sprintf("echo 'Jenkins did not answer on port %d within %s' >&2", jenkinsPort, waits.JenkinsTimeout),
+		"exit 1",
+	}, waits, nil)
+	if err != nil {
+		return fmt.Errorf("Jenkins on %s is not answering: %v", instanceID, err)
+	}
+	log.Printf("Jenkins on %s answers with HTTP %s\n", instanceID, strings.TrimSpace(result.Stdout))
+	return nil
+}
+
+// ReadInitialAdminPassword reads the password Jenkins generated to unlock the setup wizard. The
+// output is never logged or stored locally.
+func ReadInitialAdminPassword(client ssmCommandInterface, instanceID string, waits WaitOptions) (string, error) {
+	result, err := runSSMCommand(client, instanceID, []string{
+		// Jenkins writes the file shortly after it starts answering
+		fmt.Sprintf("for i in $(seq 1 12); do [ -s %s ] && break; sleep %d; done", initialAdminPasswordFile, jenkinsPollSeconds),
+		fmt.Sprintf("if [ ! -s %s ]; then echo 'no %s, the setup wizard may be disabled' >&2; exit 1; fi", initialAdminPasswordFile, initialAdminPasswordFile),
+		"cat " + initialAdminPasswordFile,
+	}, waits, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the initial admin password: %v", err)
+	}
+	password := strings.TrimSpace(result.Stdout)
+	if password == "" {
+		return "", fmt.Errorf("failed to read the initial admin password: %s is empty", initialAdminPasswordFile)
+	}
+	return password, nil
+}
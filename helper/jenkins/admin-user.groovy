@@ -0,0 +1,35 @@
+// Creates or updates the admin user from secrets/admin-user.json, written by the provisioning
+// run from a Secrets Manager secret, and deletes the file. Runs at every Jenkins start.
+import groovy.json.JsonSlurper
+import hudson.model.User
+import hudson.security.AuthorizationStrategy
+import hudson.security.FullControlOnceLoggedInAuthorizationStrategy
+import hudson.security.HudsonPrivateSecurityRealm
+import jenkins.model.Jenkins
+
+def jenkins = Jenkins.get()
+def file = new File(jenkins.rootDir, 'secrets/admin-user.json')
+if (!file.exists()) {
+    return
+}
+def admin = new JsonSlurper().parse(file)
+
+def realm = jenkins.securityRealm
+if (!(realm instanceof HudsonPrivateSecurityRealm)) {
+    realm = new HudsonPrivateSecurityRealm(false)
+    jenkins.securityRealm = realm
+}
+def user = User.getById(admin.username, false)
+if (user == null) {
+    realm.createAccount(admin.username, admin.password)
+} else {
+    user.addProperty(HudsonPrivateSecurityRealm.Details.fromPlainPassword(admin.password))
+}
+if (jenkins.authorizationStrategy == AuthorizationStrategy.UNSECURED) {
+    def strategy = new FullControlOnceLoggedInAuthorizationStrategy()
+    strategy.allowAnonymousRead = false
+    jenkins.authorizationStrategy = strategy
+}
+jenkins.save()
+file.delete()
+println "Configured admin user ${admin.username}"
@@ -0,0 +1,59 @@
+package helper
+
+import (
+	"testing"
+	"time"
+
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJenkinsURL(t *testing.T) {
+	assert.Equal(t, "http://ec2-3-80-1-2.compute-1.amazonaws.com:8080", JenkinsURL(NetworkInfo{PublicDNS: "ec2-3-80-1-2.compute-1.amazonaws.com", PrivateIP: "10.0.1.5"}))
+	assert.Equal(t, "http://10.0.1.5:8080", JenkinsURL(NetworkInfo{PrivateIP: "10.0.1.5"}))
+}
+
+func TestWaitForJenkins(t *testing.T) {
+	waits := WaitOptions{SSMCommandTimeout: time.Second, JenkinsTimeout: time.Minute}
+
+	t.Run("Answers", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess, Stdout: "403\n"}}}
+		assert.NoError(t, WaitForJenkins(client, "i-123456", waits))
+		assert.Equal(t, "for i in $(seq 1 13); do", client.sentCommands[0][0])
+		assert.Contains(t, client.sentCommands[0], "  code=$(curl -s -o /dev/null -w '%{http_code}' http://localhost:8080/login) || true")
+	})
+
+	t.Run("NotAnswering", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusFailed, ExitCode: 1, Stderr: "Jenkins did not answer on port 8080 within 1m0s\n"}}}
+		err := WaitForJenkins(client, "i-123456", waits)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Jenkins on i-123456 is not answering")
+		assert.Contains(t, err.Error(), "Jenkins did not answer on port 8080 within 1m0s")
+	})
+}
+
+func TestReadInitialAdminPassword(t *testing.T) {
+	waits := WaitOptions{SSMCommandTimeout: time.Second}
+
+	t.Run("Success", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess, Stdout: "0123456789abcdef\n"}}}
+		password, err := ReadInitialAdminPassword(client, "i-123456", waits)
+		assert.NoError(t, err)
+		assert.Equal(t, "0123456789abcdef", password)
+		assert.Nil(t, client.sendInput.OutputS3BucketName)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusFailed, ExitCode: 1, Stderr: "no /var/lib/jenkins/secrets/initialAdminPassword, the setup wizard may be disabled"}}}
+		_, err := ReadInitialAdminPassword(client, "i-123456", waits)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to read the initial admin password")
+		assert.Contains(t, err.Error(), "the setup wizard may be disabled")
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess}}}
+		_, err := ReadInitialAdminPassword(client, "i-123456", waits)
+		assert.EqualError(t, err, "failed to read the initial admin password: /var/lib/jenkins/secrets/initialAdminPassword is empty")
+	})
+}
@@ -0,0 +1,162 @@
+package helper
+
+import (
+	"context"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed jenkins/admin-user.groovy
+var adminUserScript string
+
+const (
+	jenkinsHome = "/var/lib/jenkins"
+	// Where the jenkins packages of all supported distributions install the war
+	jenkinsWar = "/usr/share/java/jenkins.war"
+
+	pluginManagerVersion = "2.13.0"
+	pluginManagerJar     = "/opt/jenkins-plugin-manager.jar"
+	cascPlugin           = "configuration-as-code"
+	cascFile             = jenkinsHome + "/casc_configs/jenkins.yaml"
+	adminUserFile        = jenkinsHome + "/secrets/admin-user.json"
+	jenkinsServiceDropIn = "/etc/systemd/system/jenkins.service.d/provisioning.conf"
+)
+
+type secretValueInterface interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// JenkinsConfigOptions configures Jenkins after the install. Configuring skips the setup wizard.
+type JenkinsConfigOptions struct {
+	Plugins         []string // plugin IDs, optionally pinned as id:version
+	AdminSecretName string   // secret holding {"username": ..., "password": ...}, read by the instance
+	CascFile        string   // Configuration as Code YAML applied at every start
+	Region          string   // region the instance reads the admin secret in
+}
+
+// Enabled reports whether any configuration is requested.
+func (opts JenkinsConfigOptions) Enabled() bool {
+	return len(opts.Plugins) > 0 || opts.AdminSecretName != "" || opts.CascFile != ""
+}
+
+var pluginPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+(:[A-Za-z0-9_.-]+)?$`)
+
+// BuildJenkinsConfigSteps returns the steps that install the plugins, create the admin user,
+// apply the Configuration as Code file and restart Jenkins without the setup wizard. The admin
+// password never appears in the commands; the instance reads it from Secrets Manager.
+func BuildJenkinsConfigSteps(opts JenkinsConfigOptions) ([]CommandStep, error) {
+	var steps []CommandStep
+
+	plugins := opts.Plugins
+	if opts.CascFile != "" && !hasPlugin(plugins, cascPlugin) {
+		plugins = append([]string{cascPlugin}, plugins...)
+	}
+	if len(plugins) > 0 {
+		for _, plugin := range plugins {
+			if !pluginPattern.MatchString(plugin) {
+				return nil, fmt.Errorf("invalid plugin %q, expected an ID or id:version", plugin)
+			}
+		}
+		steps = append(steps, CommandStep{Name: "install plugins", Commands: []string{
+			fmt.Sprintf("curl -fsSL -o %s https://github.com/jenkinsci/plugin-installation-manager-tool/releases/download/%s/jenkins-plugin-manager-%s.jar", pluginManagerJar, pluginManagerVersion, pluginManagerVersion),
+			fmt.Sprintf("java -jar %s --war %s --plugin-download-directory %s/plugins --plugins %s", pluginManagerJar, jenkinsWar, jenkinsHome, strings.Join(plugins, " ")),
+			fmt.Sprintf("chown -R jenkins:jenkins %s/plugins", jenkinsHome),
+		}})
+	}
+
+	if opts.AdminSecretName != "" {
+		commands := []string{
+			fmt.Sprintf("install -d -o jenkins -g jenkins -m 700 %s/secrets %s/init.groovy.d", jenkinsHome, jenkinsHome),
+		}
+		commands = append(commands, writeFileCommands(jenkinsHome+"/init.groovy.d/admin-user.groovy", adminUserScript, "jenkins", "644")...)
+		region := ""
+		if opts.Region != "" {
+			region = " --region " + shellQuote(opts.Region)
+		}
+		commands = append(commands,
+			fmt.Sprintf("(umask 077 && aws secretsmanager get-secret-value%s --secret-id %s --query SecretString --output text > %s)", region, shellQuote(opts.AdminSecretName), adminUserFile),
+			"chown jenkins:jenkins "+adminUserFile,
+		)
+		steps = append(steps, CommandStep{Name: "create admin user", Commands: commands})
+	}
+
+	if opts.CascFile != "" {
+		content, err := os.ReadFile(opts.CascFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Configuration as Code file %s: %v", opts.CascFile, err)
+		}
+		var document map[string]interface{}
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			return nil, fmt.Errorf("invalid Configuration as Code file %s: %v", opts.CascFile, err)
+		}
+		commands := []string{fmt.Sprintf("install -d -o jenkins -g jenkins %s", path.Dir(cascFile))}
+		steps = append(steps, CommandStep{
+			Name:     "apply configuration as code",
+			Commands: append(commands, writeFileCommands(cascFile, string(content), "jenkins", "640")...),
+		})
+	}
+
+	dropIn := "[Service]\nEnvironment=\"JAVA_OPTS=-Djava.awt.headless=true -Djenkins.install.runSetupWizard=false\"\n"
+	if opts.CascFile != "" {
+		dropIn += fmt.Sprintf("Environment=\"CASC_JENKINS_CONFIG=%s\"\n", cascFile)
+	}
+	commands := []string{"mkdir -p " + path.Dir(jenkinsServiceDropIn)}
+	commands = append(commands, writeFileCommands(jenkinsServiceDropIn, dropIn, "root", "644")...)
+	steps = append(steps, CommandStep{Name: "skip setup wizard and restart", Commands: append(commands,
+		"systemctl daemon-reload",
+		"systemctl restart jenkins",
+		"systemctl is-active jenkins",
+	)})
+	return steps, nil
+}
+
+// CheckJenkinsAdminSecret verifies that the secret holds a username and password, so a malformed
+// secret is reported before any instance is launched. It returns the ARN of the secret.
+func CheckJenkinsAdminSecret(client secretValueInterface, name string) (string, error) {
+	output, err := client.GetSecretValue(context.Background(), &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %s: %v", name, err)
+	}
+	var admin struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal([]byte(aws.ToString(output.SecretString)), &admin); err != nil {
+		return "", fmt.Errorf("secret %s is not JSON with a username and password", name)
+	}
+	if admin.Username == "" || admin.Password == "" {
+		return "", fmt.Errorf("secret %s needs a username and password", name)
+	}
+	return aws.ToString(output.ARN), nil
+}
+
+// writeFileCommands writes the content to the file. The content is sent base64-encoded so it
+// needs no shell quoting.
+func writeFileCommands(file, content, owner, mode string) []string {
+	return []string{
+		fmt.Sprintf("echo %s | base64 -d > %s", base64.StdEncoding.EncodeToString([]byte(content)), file),
+		fmt.Sprintf("chown %s:%s %s", owner, owner, file),
+		fmt.Sprintf("chmod %s %s", mode, file),
+	}
+}
+
+func hasPlugin(plugins []string, id string) bool {
+	for _, plugin := range plugins {
+		if plugin == id || strings.HasPrefix(plugin, id+":") {
+			return true
+		}
+	}
+	return false
+}
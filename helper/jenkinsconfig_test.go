@@ -0,0 +1,134 @@
+package helper
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of the secretValueInterface for testing.
+type MockSecretValueClient struct {
+	SecretString      string
+	GetSecretValueErr error
+}
+
+func TestBuildJenkinsConfigSteps(t *testing.T) {
+	t.Run("All", func(t *testing.T) {
+		cascPath := filepath.Join(t.TempDir(), "casc.yaml")
+		assert.NoError(t, os.WriteFile(cascPath, []byte("jenkins:\n  numExecutors: 2\n"), 0644))
+
+		steps, err := BuildJenkinsConfigSteps(JenkinsConfigOptions{
+			Plugins:         []string{"git", "workflow-aggregator:600.vb_57cdd26fdd7"},
+			AdminSecretName: "jenkins/admin",
+			CascFile:        cascPath,
+			Region:          "us-east-1",
+		})
+		assert.NoError(t, err)
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.Name)
+		}
+		assert.Equal(t, []string{"install plugins", "create admin user", "apply configuration as code", "skip setup wizard and restart"}, names)
+
+		// The Configuration as Code plugin is added for the YAML file
+		assert.Contains(t, steps[0].Commands[1], "--plugins configuration-as-code git workflow-aggregator:600.vb_57cdd26fdd7")
+		assert.Contains(t, steps[1].Commands, "(umask 077 && aws secretsmanager get-secret-value --region 'us-east-1' --secret-id 'jenkins/admin' --query SecretString --output text > /var/lib/jenkins/secrets/admin-user.json)")
+		assert.Equal(t, "echo "+base64.StdEncoding.EncodeToString([]byte("jenkins:\n  numExecutors: 2\n"))+" | base64 -d > /var/lib/jenkins/casc_configs/jenkins.yaml", steps[2].Commands[1])
+
+		dropIn := decodeWrittenFile(t, steps[3].Commands[1])
+		assert.Contains(t, dropIn, "-Djenkins.install.runSetupWizard=false")
+		assert.Contains(t, dropIn, `Environment="CASC_JENKINS_CONFIG=/var/lib/jenkins/casc_configs/jenkins.yaml"`)
+		assert.Equal(t, "chown root:root /etc/systemd/system/jenkins.service.d/provisioning.conf", steps[3].Commands[2])
+	})
+
+	t.Run("PluginsOnly", func(t *testing.T) {
+		steps, err := BuildJenkinsConfigSteps(JenkinsConfigOptions{Plugins: []string{"configuration-as-code:1775.v810dc950b_514", "git"}})
+		assert.NoError(t, err)
+		assert.Len(t, steps, 2)
+		assert.Contains(t, steps[0].Commands[1], "--plugins configuration-as-code:1775.v810dc950b_514 git")
+		assert.NotContains(t, decodeWrittenFile(t, steps[1].Commands[1]), "CASC_JENKINS_CONFIG")
+	})
+
+	t.Run("AdminScript", func(t *testing.T) {
+		steps, err := BuildJenkinsConfigSteps(JenkinsConfigOptions{AdminSecretName: "jenkins/admin"})
+		assert.NoError(t, err)
+		assert.Equal(t, adminUserScript, decodeWrittenFile(t, steps[0].Commands[1]))
+		for _, command := range steps[0].Commands {
+			assert.NotContains(t, command, "--region")
+		}
+	})
+
+	t.Run("InvalidPlugin", func(t *testing.T) {
+		_, err := BuildJenkinsConfigSteps(JenkinsConfigOptions{Plugins: []string{"git; rm -rf /"}})
+		assert.EqualError(t, err, `invalid plugin "git; rm -rf /", expected an ID or id:version`)
+	})
+
+	t.Run("InvalidCasc", func(t *testing.T) {
+		cascPath := filepath.Join(t.TempDir(), "casc.yaml")
+		assert.NoError(t, os.WriteFile(cascPath, []byte("- jenkins\n"), 0644))
+		_, err := BuildJenkinsConfigSteps(JenkinsConfigOptions{CascFile: cascPath})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid Configuration as Code file "+cascPath)
+	})
+
+	t.Run("MissingCasc", func(t *testing.T) {
+		_, err := BuildJenkinsConfigSteps(JenkinsConfigOptions{CascFile: filepath.Join(t.TempDir(), "missing.yaml")})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to read Configuration as Code file")
+	})
+}
+
+func TestExampleCascFile(t *testing.T) {
+	_, err := BuildJenkinsConfigSteps(JenkinsConfigOptions{CascFile: "../jenkins/casc.yaml"})
+	assert.NoError(t, err)
+}
+
+func TestCheckJenkinsAdminSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  *MockSecretValueClient
+		wantErr string
+	}{
+		{name: "Valid", client: &MockSecretValueClient{SecretString: `{"username": "admin", "password": "s3cret"}`}},
+		{name: "NotJSON", client: &MockSecretValueClient{SecretString: "s3cret"}, wantErr: "secret jenkins/admin is not JSON with a username and password"},
+		{name: "NoPassword", client: &MockSecretValueClient{SecretString: `{"username": "admin"}`}, wantErr: "secret jenkins/admin needs a username and password"},
+		{name: "GetError", client: &MockSecretValueClient{GetSecretValueErr: apiError("ResourceNotFoundException", "not found")}, wantErr: "failed to get secret jenkins/admin: api error ResourceNotFoundException: not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arn, err := CheckJenkinsAdminSecret(tt.client, "jenkins/admin")
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, "arn:aws:secretsmanager:us-east-1:123456789012:secret:jenkins/admin-AbCdEf", arn)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+// decodeWrittenFile returns the content written by an echo command of writeFileCommands.
+func decodeWrittenFile(t *testing.T, command string) string {
+	encoded := strings.Fields(command)[1]
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func (client *MockSecretValueClient) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	if client.GetSecretValueErr != nil {
+		return nil, client.GetSecretValueErr
+	}
+	return &secretsmanager.GetSecretValueOutput{
+		ARN:          aws.String("arn:aws:secretsmanager:us-east-1:123456789012:secret:" + aws.ToString(params.SecretId) + "-AbCdEf"),
+		Name:         params.SecretId,
+		SecretString: aws.String(client.SecretString),
+	}, nil
+}
@@ -0,0 +1,274 @@
+package helper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type launchTemplateInterface interface {
+	CreateLaunchTemplate(ctx context.Context, params *ec2.CreateLaunchTemplateInput, optFns ...func(*ec2.Options)) (*ec2.CreateLaunchTemplateOutput, error)
+	CreateLaunchTemplateVersion(ctx context.Context, params *ec2.CreateLaunchTemplateVersionInput, optFns ...func(*ec2.Options)) (*ec2.CreateLaunchTemplateVersionOutput, error)
+	DescribeLaunchTemplateVersions(ctx context.Context, params *ec2.DescribeLaunchTemplateVersionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeLaunchTemplateVersionsOutput, error)
+	ModifyLaunchTemplate(ctx context.Context, params *ec2.ModifyLaunchTemplateInput, optFns ...func(*ec2.Options)) (*ec2.ModifyLaunchTemplateOutput, error)
+}
+
+// LaunchTemplateResult identifies the launch template version used for the launch.
+type LaunchTemplateResult struct {
+	TemplateID   string   `json:"templateId"`
+	TemplateName string   `json:"templateName"`
+	Version      int64    `json:"version"`
+	Created      bool     `json:"created"`           // whether this run created the version
+	Changes      []string `json:"changes,omitempty"` // differences to the previous or pinned version
+}
+
+// Specification returns the reference used by RunInstances.
+func (result *LaunchTemplateResult) Specification() *types.LaunchTemplateSpecification {
+	return &types.LaunchTemplateSpecification{
+		LaunchTemplateId: aws.String(result.TemplateID),
+		Version:          aws.String(strconv.FormatInt(result.Version, 10)),
+	}
+}
+
+// BuildLaunchTemplateData converts the launch parameters into launch template data.
+func BuildLaunchTemplateData(securityGroupID, instanceType, amiID, instanceProfileName, userData string, opts LaunchOptions) *types.RequestLaunchTemplateData {
+	opts.LaunchTemplate = nil
+	input := createInstanceInput(securityGroupID, instanceType, amiID, instanceProfileName, userData, opts)
+
+	data := &types.RequestLaunchTemplateData{
+		ImageId:          input.ImageId,
+		InstanceType:     input.InstanceType,
+		SecurityGroupIds: input.SecurityGroupIds,
+		UserData:         input.UserData,
+	}
+	if input.IamInstanceProfile != nil {
+		data.IamInstanceProfile = &types.LaunchTemplateIamInstanceProfileSpecificationRequest{
+			Arn:  input.IamInstanceProfile.Arn,
+			Name: input.IamInstanceProfile.Name,
+		}
+	}
+	for _, mapping := range input.BlockDeviceMappings {
+		templateMapping := types.LaunchTemplateBlockDeviceMappingRequest{
+			DeviceName:  mapping.DeviceName,
+			NoDevice:    mapping.NoDevice,
+			VirtualName: mapping.VirtualName,
+		}
+		if mapping.Ebs != nil {
+			templateMapping.Ebs = &types.LaunchTemplateEbsBlockDeviceRequest{
+				DeleteOnTermination: mapping.Ebs.DeleteOnTermination,
+				Encrypted:           mapping.Ebs.Encrypted,
+				Iops:                mapping.Ebs.Iops,
+				KmsKeyId:            mapping.Ebs.KmsKeyId,
+				SnapshotId:          mapping.Ebs.SnapshotId,
+				Throughput:          mapping.Ebs.Throughput,
+				VolumeSize:          mapping.Ebs.VolumeSize,
+				VolumeType:          mapping.Ebs.VolumeType,
+			}
+		}
+		data.BlockDeviceMappings = append(data.BlockDeviceMappings, templateMapping)
+	}
+	return data
+}
+
+// EnsureLaunchTemplate creates the launch template, or a new version of it when the data differs
+// from the latest version; a new version is made the default. With a pinned version nothing is
+// created and that version is used as-is.
+func EnsureLaunchTemplate(client launchTemplateInterface, templateName, pinnedVersion string, data *types.RequestLaunchTemplateData) (*LaunchTemplateResult, error) {
+	wanted, err := flattenTemplateData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	compareVersion := pinnedVersion
+	if compareVersion == "" {
+		compareVersion = "$Latest"
+	}
+	current, err := describeLaunchTemplateVersion(client, templateName, compareVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if current == nil {
+		if pinnedVersion != "" {
+			return nil, fmt.Errorf("launch template %s does not exist, cannot use pinned version %s", templateName, pinnedVersion)
+		}
+		createOutput, err := client.CreateLaunchTemplate(context.Background(), &ec2.CreateLaunchTemplateInput{
+			LaunchTemplateName: aws.String(templateName),
+			LaunchTemplateData: data,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create launch template: %v", err)
+		}
+		log.Printf("Created launch template %s\n", templateName)
+		return &LaunchTemplateResult{
+			TemplateID:   aws.ToString(createOutput.LaunchTemplate.LaunchTemplateId),
+			TemplateName: templateName,
+			Version:      aws.ToInt64(createOutput.LaunchTemplate.LatestVersionNumber),
+			Created:      true,
+		}, nil
+	}
+
+	existing, err := flattenTemplateData(current.LaunchTemplateData)
+	if err != nil {
+		return nil, err
+	}
+	result := &LaunchTemplateResult{
+		TemplateID:   aws.ToString(current.LaunchTemplateId),
+		TemplateName: templateName,
+		Version:      aws.ToInt64(current.VersionNumber),
+		Changes:      diffTemplateData(existing, wanted),
+	}
+
+	if pinnedVersion != "" {
+		if len(result.Changes) > 0 {
+			log.Printf("Launch template %s is pinned to version %d, which differs from the spec:\n%s\n", templateName, result.Version, strings.Join(result.Changes, "\n"))
+		}
+		return result, nil
+	}
+	if len(result.Changes) == 0 {
+		log.Printf("Launch template %s version %d is up to date\n", templateName, result.Version)
+		return result, nil
+	}
+
+	versionOutput, err := client.CreateLaunchTemplateVersion(context.Background(), &ec2.CreateLaunchTemplateVersionInput{
+		LaunchTemplateId:   current.LaunchTemplateId,
+		LaunchTemplateData: data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create launch template version: %v", err)
+	}
+	result.Version = aws.ToInt64(versionOutput.LaunchTemplateVersion.VersionNumber)
+	result.Created = true
+	log.Printf("Created launch template %s version %d:\n%s\n", templateName, result.Version, strings.Join(result.Changes, "\n"))
+
+	// Launches from the console or Auto Scaling groups use the default version
+	_, err = client.ModifyLaunchTemplate(context.Background(), &ec2.ModifyLaunchTemplateInput{
+		LaunchTemplateId: current.LaunchTemplateId,
+		DefaultVersion:   aws.String(strconv.FormatInt(result.Version, 10)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to make version %d the default of launch template %s: %v", result.Version, templateName, err)
+	}
+	return result, nil
+}
+
+// DiffLaunchTemplateVersions lists the differences between two versions of a launch template.
+func DiffLaunchTemplateVersions(client launchTemplateInterface, templateName, fromVersion, toVersion string) ([]string, error) {
+	var flattened [2]map[string]string
+	for i, version := range []string{fromVersion, toVersion} {
+		templateVersion, err := describeLaunchTemplateVersion(client, templateName, version)
+		if err != nil {
+			return nil, err
+		}
+		if templateVersion == nil {
+			return nil, fmt.Errorf("launch template %s has no version %s", templateName, version)
+		}
+		if flattened[i], err = flattenTemplateData(templateVersion.LaunchTemplateData); err != nil {
+			return nil, err
+		}
+	}
+	return diffTemplateData(flattened[0], flattened[1]), nil
+}
+
+// describeLaunchTemplateVersion returns the version, or nil when the template or version does not exist.
+func describeLaunchTemplateVersion(client launchTemplateInterface, templateName, version string) (*types.LaunchTemplateVersion, error) {
+	versionsOutput, err := client.DescribeLaunchTemplateVersions(context.Background(), &ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateName: aws.String(templateName),
+		Versions:           []string{version},
+	})
+	if errorCode(err) == "InvalidLaunchTemplateName.NotFoundException" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe launch template versions: %v", err)
+	}
+	if len(versionsOutput.LaunchTemplateVersions) == 0 {
+		return nil, nil
+	}
+	return &versionsOutput.LaunchTemplateVersions[0], nil
+}
+
+// flattenTemplateData turns request or response template data into path/value pairs, so both
+// can be compared. Unset fields are left out.
+func flattenTemplateData(data interface{}) (map[string]string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode launch template data: %v", err)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode launch template data: %v", err)
+	}
+
+	flattened := map[string]string{}
+	var walk func(prefix string, value interface{})
+	walk = func(prefix string, value interface{}) {
+		switch typed := value.(type) {
+		case nil:
+		case map[string]interface{}:
+			for key, child := range typed {
+				walk(strings.TrimPrefix(prefix+"."+key, "."), child)
+			}
+		case []interface{}:
+			for i, child := range typed {
+				walk(fmt.Sprintf("%s[%d]", prefix, i), child)
+			}
+		case string:
+			if typed != "" {
+				flattened[prefix] = typed
+			}
+		default:
+			flattened[prefix] = fmt.Sprint(typed)
+		}
+	}
+	walk("", decoded)
+	return flattened, nil
+}
+
+func diffTemplateData(from, to map[string]string) []string {
+	keys := map[string]bool{}
+	for key := range from {
+		keys[key] = true
+	}
+	for key := range to {
+		keys[key] = true
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	var changes []string
+	for _, key := range sortedKeys {
+		oldValue, inFrom := from[key]
+		newValue, inTo := to[key]
+		switch {
+		case !inFrom:
+			changes = append(changes, fmt.Sprintf("+ %s: %s", key, displayValue(newValue)))
+		case !inTo:
+			changes = append(changes, fmt.Sprintf("- %s: %s", key, displayValue(oldValue)))
+		case oldValue != newValue:
+			changes = append(changes, fmt.Sprintf("~ %s: %s -> %s", key, displayValue(oldValue), displayValue(newValue)))
+		}
+	}
+	return changes
+}
+
+// displayValue shortens long values such as the encoded user data to a checksum.
+func displayValue(value string) string {
+	if len(value) <= 64 {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("<%d bytes, sha256 %x>", len(value), sum[:6])
+}
@@ -0,0 +1,241 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of launchTemplateInterface for testing, storing versions in memory
+type MockLaunchTemplateClient struct {
+	Versions                          []types.ResponseLaunchTemplateData
+	CreateLaunchTemplateErr           error
+	CreateLaunchTemplateVersionErr    error
+	DescribeLaunchTemplateVersionsErr error
+	ModifyLaunchTemplateErr           error
+
+	defaultVersion string
+}
+
+func TestBuildLaunchTemplateData(t *testing.T) {
+	data := BuildLaunchTemplateData("sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{
+		BlockDeviceMappings: []types.BlockDeviceMapping{
+			{DeviceName: aws.String("/dev/sda1"), Ebs: &types.EbsBlockDevice{VolumeSize: aws.Int32(30), VolumeType: types.VolumeTypeGp3, Encrypted: aws.Bool(true)}},
+		},
+		LaunchTemplate: &types.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-ignored")},
+	})
+	assert.Equal(t, "ami-123456", aws.ToString(data.ImageId))
+	assert.Equal(t, types.InstanceType("t3.medium"), data.InstanceType)
+	assert.Equal(t, []string{"sg-123456"}, data.SecurityGroupIds)
+	assert.Equal(t, "jenkins-role", aws.ToString(data.IamInstanceProfile.Name))
+	assert.Equal(t, "IyEvYmluL2Jhc2g=", aws.ToString(data.UserData))
+	assert.Equal(t, "/dev/sda1", aws.ToString(data.BlockDeviceMappings[0].DeviceName))
+	assert.Equal(t, int32(30), aws.ToInt32(data.BlockDeviceMappings[0].Ebs.VolumeSize))
+	assert.True(t, aws.ToBool(data.BlockDeviceMappings[0].Ebs.Encrypted))
+}
+
+func TestEnsureLaunchTemplate(t *testing.T) {
+	data := BuildLaunchTemplateData("sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{})
+
+	t.Run("Create", func(t *testing.T) {
+		client := &MockLaunchTemplateClient{}
+		result, err := EnsureLaunchTemplate(client, "jenkins", "", data)
+		assert.NoError(t, err)
+		assert.Equal(t, &LaunchTemplateResult{TemplateID: "lt-123456", TemplateName: "jenkins", Version: 1, Created: true}, result)
+		assert.Len(t, client.Versions, 1)
+	})
+
+	t.Run("CreateError", func(t *testing.T) {
+		_, err := EnsureLaunchTemplate(&MockLaunchTemplateClient{CreateLaunchTemplateErr: fmt.Errorf("limit exceeded")}, "jenkins", "", data)
+		assert.Error(t, err)
+		assert.Equal(t, "failed to create launch template: limit exceeded", err.Error())
+	})
+
+	t.Run("DescribeError", func(t *testing.T) {
+		_, err := EnsureLaunchTemplate(&MockLaunchTemplateClient{DescribeLaunchTemplateVersionsErr: fmt.Errorf("access denied")}, "jenkins", "", data)
+		assert.Error(t, err)
+		assert.Equal(t, "failed to describe launch template versions: access denied", err.Error())
+	})
+
+	t.Run("UpToDate", func(t *testing.T) {
+		client := &MockLaunchTemplateClient{}
+		_, err := EnsureLaunchTemplate(client, "jenkins", "", data)
+		assert.NoError(t, err)
+		result, err := EnsureLaunchTemplate(client, "jenkins", "", data)
+		assert.NoError(t, err)
+		assert.False(t, result.Created)
+		assert.Equal(t, int64(1), result.Version)
+		assert.Empty(t, result.Changes)
+		assert.Len(t, client.Versions, 1)
+	})
+
+	t.Run("NewVersion", func(t *testing.T) {
+		client := &MockLaunchTemplateClient{}
+		_, err := EnsureLaunchTemplate(client, "jenkins", "", data)
+		assert.NoError(t, err)
+
+		changed := BuildLaunchTemplateData("sg-123456", "t3.large", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{})
+		result, err := EnsureLaunchTemplate(client, "jenkins", "", changed)
+		assert.NoError(t, err)
+		assert.True(t, result.Created)
+		assert.Equal(t, int64(2), result.Version)
+		assert.Equal(t, []string{"~ InstanceType: t3.medium -> t3.large"}, result.Changes)
+		assert.Equal(t, &types.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-123456"), Version: aws.String("2")}, result.Specification())
+		assert.Equal(t, "2", client.defaultVersion)
+	})
+
+	t.Run("DefaultVersionError", func(t *testing.T) {
+		client := &MockLaunchTemplateClient{}
+		_, err := EnsureLaunchTemplate(client, "jenkins", "", data)
+		assert.NoError(t, err)
+
+		client.ModifyLaunchTemplateErr = fmt.Errorf("access denied")
+		changed := BuildLaunchTemplateData("sg-123456", "t3.large", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{})
+		_, err = EnsureLaunchTemplate(client, "jenkins", "", changed)
+		assert.EqualError(t, err, "failed to make version 2 the default of launch template jenkins: access denied")
+	})
+
+	t.Run("NewVersionError", func(t *testing.T) {
+		client := &MockLaunchTemplateClient{}
+		_, err := EnsureLaunchTemplate(client, "jenkins", "", data)
+		assert.NoError(t, err)
+
+		client.CreateLaunchTemplateVersionErr = fmt.Errorf("version limit exceeded")
+		changed := BuildLaunchTemplateData("sg-654321", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{})
+		_, err = EnsureLaunchTemplate(client, "jenkins", "", changed)
+		assert.Error(t, err)
+		assert.Equal(t, "failed to create launch template version: version limit exceeded", err.Error())
+	})
+
+	t.Run("Pinned", func(t *testing.T) {
+		client := &MockLaunchTemplateClient{}
+		_, err := EnsureLaunchTemplate(client, "jenkins", "", data)
+		assert.NoError(t, err)
+
+		changed := BuildLaunchTemplateData("sg-123456", "t3.large", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{})
+		result, err := EnsureLaunchTemplate(client, "jenkins", "1", changed)
+		assert.NoError(t, err)
+		assert.False(t, result.Created)
+		assert.Equal(t, int64(1), result.Version)
+		assert.Equal(t, []string{"~ InstanceType: t3.medium -> t3.large"}, result.Changes)
+		assert.Len(t, client.Versions, 1)
+		assert.Empty(t, client.defaultVersion)
+	})
+
+	t.Run("PinnedMissingTemplate", func(t *testing.T) {
+		_, err := EnsureLaunchTemplate(&MockLaunchTemplateClient{}, "jenkins", "3", data)
+		assert.Error(t, err)
+		assert.Equal(t, "launch template jenkins does not exist, cannot use pinned version 3", err.Error())
+	})
+}
+
+func TestDiffLaunchTemplateVersions(t *testing.T) {
+	client := &MockLaunchTemplateClient{}
+	_, err := EnsureLaunchTemplate(client, "jenkins", "", BuildLaunchTemplateData("sg-123456", "t3.medium", "ami-123456", "jenkins-role", "#!/bin/bash", LaunchOptions{}))
+	assert.NoError(t, err)
+	_, err = EnsureLaunchTemplate(client, "jenkins", "", BuildLaunchTemplateData("sg-123456", "t3.medium", "ami-654321", "", "#!/bin/bash\necho hello", LaunchOptions{}))
+	assert.NoError(t, err)
+
+	changes, err := DiffLaunchTemplateVersions(client, "jenkins", "1", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"- IamInstanceProfile.Name: jenkins-role",
+		"~ ImageId: ami-123456 -> ami-654321",
+		"~ UserData: IyEvYmluL2Jhc2g= -> IyEvYmluL2Jhc2gKZWNobyBoZWxsbw==",
+	}, changes)
+
+	_, err = DiffLaunchTemplateVersions(client, "jenkins", "1", "5")
+	assert.Error(t, err)
+	assert.Equal(t, "launch template jenkins has no version 5", err.Error())
+}
+
+func TestDisplayValue(t *testing.T) {
+	assert.Equal(t, "short", displayValue("short"))
+	long := displayValue(fmt.Sprintf("%0100d", 0))
+	assert.Regexp(t, `^<100 bytes, sha256 [0-9a-f]{12}>$`, long)
+}
+
+func (client *MockLaunchTemplateClient) CreateLaunchTemplate(ctx context.Context, params *ec2.CreateLaunchTemplateInput, optFns ...func(*ec2.Options)) (*ec2.CreateLaunchTemplateOutput, error) {
+	if client.CreateLaunchTemplateErr != nil {
+		return nil, client.CreateLaunchTemplateErr
+	}
+	client.Versions = append(client.Versions, toResponseData(params.LaunchTemplateData))
+	return &ec2.CreateLaunchTemplateOutput{
+		LaunchTemplate: &types.LaunchTemplate{
+			LaunchTemplateId:    aws.String("lt-123456"),
+			LaunchTemplateName:  params.LaunchTemplateName,
+			LatestVersionNumber: aws.Int64(1),
+		},
+	}, nil
+}
+
+func (client *MockLaunchTemplateClient) CreateLaunchTemplateVersion(ctx context.Context, params *ec2.CreateLaunchTemplateVersionInput, optFns ...func(*ec2.Options)) (*ec2.CreateLaunchTemplateVersionOutput, error) {
+	if client.CreateLaunchTemplateVersionErr != nil {
+		return nil, client.CreateLaunchTemplateVersionErr
+	}
+	client.Versions = append(client.Versions, toResponseData(params.LaunchTemplateData))
+	return &ec2.CreateLaunchTemplateVersionOutput{
+		LaunchTemplateVersion: &types.LaunchTemplateVersion{
+			LaunchTemplateId: params.LaunchTemplateId,
+			VersionNumber:    aws.Int64(int64(len(client.Versions))),
+		},
+	}, nil
+}
+
+func (client *MockLaunchTemplateClient) DescribeLaunchTemplateVersions(ctx context.Context, params *ec2.DescribeLaunchTemplateVersionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	if client.DescribeLaunchTemplateVersionsErr != nil {
+		return nil, client.DescribeLaunchTemplateVersionsErr
+	}
+	if len(client.Versions) == 0 {
+		return nil, apiError("InvalidLaunchTemplateName.NotFoundException", "not found")
+	}
+
+	version := len(client.Versions)
+	if requested := params.Versions[0]; requested != "$Latest" && requested != "$Default" {
+		version, _ = strconv.Atoi(requested)
+	}
+	if version < 1 || version > len(client.Versions) {
+		return &ec2.DescribeLaunchTemplateVersionsOutput{}, nil
+	}
+	return &ec2.DescribeLaunchTemplateVersionsOutput{
+		LaunchTemplateVersions: []types.LaunchTemplateVersion{
+			{
+				LaunchTemplateId:   aws.String("lt-123456"),
+				LaunchTemplateName: params.LaunchTemplateName,
+				VersionNumber:      aws.Int64(int64(version)),
+				LaunchTemplateData: &client.Versions[version-1],
+			},
+		},
+	}, nil
+}
+
+func (client *MockLaunchTemplateClient) ModifyLaunchTemplate(ctx context.Context, params *ec2.ModifyLaunchTemplateInput, optFns ...func(*ec2.Options)) (*ec2.ModifyLaunchTemplateOutput, error) {
+	if client.ModifyLaunchTemplateErr != nil {
+		return nil, client.ModifyLaunchTemplateErr
+	}
+	client.defaultVersion = aws.ToString(params.DefaultVersion)
+	return &ec2.ModifyLaunchTemplateOutput{}, nil
+}
+
+// toResponseData mirrors what EC2 returns for the stored request data.
+func toResponseData(data *types.RequestLaunchTemplateData) types.ResponseLaunchTemplateData {
+	response := types.ResponseLaunchTemplateData{
+		ImageId:          data.ImageId,
+		InstanceType:     data.InstanceType,
+		SecurityGroupIds: data.SecurityGroupIds,
+		UserData:         data.UserData,
+	}
+	if data.IamInstanceProfile != nil {
+		response.IamInstanceProfile = &types.LaunchTemplateIamInstanceProfileSpecification{
+			Arn:  data.IamInstanceProfile.Arn,
+			Name: data.IamInstanceProfile.Name,
+		}
+	}
+	return response
+}
@@ -0,0 +1,163 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// NetworkInfo holds the addresses of an instance. The public fields stay empty for
+// instances in private subnets without an Elastic IP.
+type NetworkInfo struct {
+	PublicIP              string   `json:"publicIp,omitempty"`
+	PublicDNS             string   `json:"publicDns,omitempty"`
+	PrivateIP             string   `json:"privateIp,omitempty"`
+	PrivateDNS            string   `json:"privateDns,omitempty"`
+	IPv6Addresses         []string `json:"ipv6Addresses,omitempty"`
+	NetworkInterfaceID    string   `json:"networkInterfaceId,omitempty"` // primary network interface
+	AvailabilityZone      string   `json:"availabilityZone,omitempty"`
+	ElasticIPAllocationID string   `json:"elasticIpAllocationId,omitempty"`
+}
+
+// Address returns the address the instance is reached at, preferring public over private addresses.
+func (info NetworkInfo) Address() string {
+	for _, address := range []string{info.PublicDNS, info.PublicIP, info.PrivateDNS, info.PrivateIP} {
+		if address != "" {
+			return address
+		}
+	}
+	return ""
+}
+
+type elasticIPInterface interface {
+	AllocateAddress(ctx context.Context, params *ec2.AllocateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error)
+	AssociateAddress(ctx context.Context, params *ec2.AssociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error)
+	ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+}
+
+// networkInfo reads the addresses of the instance from a describe result.
+func networkInfo(output *ec2.DescribeInstancesOutput, instanceID string) (NetworkInfo, error) {
+	if output != nil {
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if aws.ToString(instance.InstanceId) == instanceID {
+					return instanceNetworkInfo(instance), nil
+				}
+			}
+		}
+	}
+	return NetworkInfo{}, fmt.Errorf("instance %s not found", instanceID)
+}
+
+func instanceNetworkInfo(instance types.Instance) NetworkInfo {
+	info := NetworkInfo{
+		PublicIP:   aws.ToString(instance.PublicIpAddress),
+		PublicDNS:  aws.ToString(instance.PublicDnsName),
+		PrivateIP:  aws.ToString(instance.PrivateIpAddress),
+		PrivateDNS: aws.ToString(instance.PrivateDnsName),
+	}
+	if instance.Placement != nil {
+		info.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+	}
+	for _, networkInterface := range instance.NetworkInterfaces {
+		if networkInterface.Attachment != nil && aws.ToInt32(networkInterface.Attachment.DeviceIndex) == 0 {
+			info.NetworkInterfaceID = aws.ToString(networkInterface.NetworkInterfaceId)
+		}
+		for _, address := range networkInterface.Ipv6Addresses {
+			info.IPv6Addresses = append(info.IPv6Addresses, aws.ToString(address.Ipv6Address))
+		}
+	}
+	return info
+}
+
+func describeNetworkInfo(client elasticIPInterface, instanceID string) (NetworkInfo, error) {
+	output, err := client.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceID},
+	})
+	if err != nil {
+		return NetworkInfo{}, fmt.Errorf("failed to describe instances: %v", err)
+	}
+	return networkInfo(output, instanceID)
+}
+
+// AssociateElasticIP gives the instance a stable public address by allocating an Elastic IP
+// and associating it with the primary network interface. The address is released again when
+// the association fails.
+func AssociateElasticIP(client elasticIPInterface, instanceID string) (NetworkInfo, error) {
+	info, err := describeNetworkInfo(client, instanceID)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	if info.NetworkInterfaceID == "" {
+		return NetworkInfo{}, fmt.Errorf("instance %s has no primary network interface", instanceID)
+	}
+
+	allocateOutput, err := client.AllocateAddress(context.Background(), &ec2.AllocateAddressInput{
+		Domain: types.DomainTypeVpc,
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeElasticIp,
+				Tags: []types.Tag{
+					{Key: aws.String("InstanceId"), Value: aws.String(instanceID)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return NetworkInfo{}, fmt.Errorf("failed to allocate Elastic IP: %v", err)
+	}
+	allocationID := aws.ToString(allocateOutput.AllocationId)
+
+	err = retryEventualConsistency("associating Elastic IP "+allocationID, func() error {
+		_, err := client.AssociateAddress(context.Background(), &ec2.AssociateAddressInput{
+			AllocationId:       aws.String(allocationID),
+			NetworkInterfaceId: aws.String(info.NetworkInterfaceID),
+		})
+		return err
+	})
+	if err != nil {
+		if releaseErr := ReleaseElasticIP(client, allocationID); releaseErr != nil {
+			log.Println(releaseErr)
+		}
+		return NetworkInfo{}, fmt.Errorf("failed to associate Elastic IP: %v", err)
+	}
+	log.Printf("Associated Elastic IP %s with instance %s\n", aws.ToString(allocateOutput.PublicIp), instanceID)
+
+	// The public DNS name changes with the new address. The allocation is returned
+	// even when this fails, so the address can be released.
+	info.PublicIP = aws.ToString(allocateOutput.PublicIp)
+	info.PublicDNS = ""
+	info.ElasticIPAllocationID = allocationID
+	updated, err := describeNetworkInfo(client, instanceID)
+	if err != nil {
+		return info, err
+	}
+	updated.ElasticIPAllocationID = allocationID
+	return updated, nil
+}
+
+type addressReleaseInterface interface {
+	ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error)
+}
+
+// ReleaseElasticIP releases an address allocated by AssociateElasticIP. The address must no longer
+// be associated, so release it after the instance has terminated. An unknown allocation is ignored.
+func ReleaseElasticIP(client addressReleaseInterface, allocationID string) error {
+	_, err := client.ReleaseAddress(context.Background(), &ec2.ReleaseAddressInput{
+		AllocationId: aws.String(allocationID),
+	})
+	if errorCode(err) == "InvalidAllocationID.NotFound" {
+		log.Printf("Elastic IP %s was already released\n", allocationID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release Elastic IP %s: %v", allocationID, err)
+	}
+	log.Printf("Released Elastic IP %s\n", allocationID)
+	return nil
+}
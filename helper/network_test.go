@@ -0,0 +1,148 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of the elasticIPInterface for testing
+type MockElasticIPClient struct {
+	AllocateAddressErr  error
+	AssociateAddressErr error
+	ReleaseAddressErr   error
+	associated          bool
+	released            []string
+}
+
+func TestNetworkInfo(t *testing.T) {
+	t.Run("EmptyReservations", func(t *testing.T) {
+		_, err := networkInfo(&ec2.DescribeInstancesOutput{}, "i-123456")
+		assert.Equal(t, "instance i-123456 not found", err.Error())
+
+		_, err = networkInfo(nil, "i-123456")
+		assert.Error(t, err)
+	})
+
+	t.Run("PrivateSubnet", func(t *testing.T) {
+		info, err := networkInfo(&ec2.DescribeInstancesOutput{
+			Reservations: []types.Reservation{{Instances: []types.Instance{{
+				InstanceId:       aws.String("i-123456"),
+				PrivateIpAddress: aws.String("10.0.1.15"),
+				PrivateDnsName:   aws.String("ip-10-0-1-15.ec2.internal"),
+				Placement:        &types.Placement{AvailabilityZone: aws.String("us-east-1a")},
+				NetworkInterfaces: []types.InstanceNetworkInterface{
+					{
+						NetworkInterfaceId: aws.String("eni-secondary"),
+						Attachment:         &types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(1)},
+					},
+					{
+						NetworkInterfaceId: aws.String("eni-primary"),
+						Attachment:         &types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(0)},
+						Ipv6Addresses:      []types.InstanceIpv6Address{{Ipv6Address: aws.String("2600:1f18::15")}},
+					},
+				},
+			}}}},
+		}, "i-123456")
+		assert.NoError(t, err)
+		assert.Equal(t, NetworkInfo{
+			PrivateIP:          "10.0.1.15",
+			PrivateDNS:         "ip-10-0-1-15.ec2.internal",
+			IPv6Addresses:      []string{"2600:1f18::15"},
+			NetworkInterfaceID: "eni-primary",
+			AvailabilityZone:   "us-east-1a",
+		}, info)
+		assert.Equal(t, "ip-10-0-1-15.ec2.internal", info.Address())
+	})
+
+	t.Run("Address", func(t *testing.T) {
+		assert.Equal(t, "ec2-1-2-3-4.compute-1.amazonaws.com", NetworkInfo{PublicIP: "1.2.3.4", PublicDNS: "ec2-1-2-3-4.compute-1.amazonaws.com", PrivateIP: "10.0.0.1"}.Address())
+		assert.Equal(t, "1.2.3.4", NetworkInfo{PublicIP: "1.2.3.4", PrivateIP: "10.0.0.1"}.Address())
+		assert.Equal(t, "10.0.0.1", NetworkInfo{PrivateIP: "10.0.0.1"}.Address())
+	})
+}
+
+func TestAssociateElasticIP(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		client := &MockElasticIPClient{}
+		info, err := AssociateElasticIP(client, "i-123456")
+		assert.NoError(t, err)
+		assert.Equal(t, "eipalloc-123456", info.ElasticIPAllocationID)
+		assert.Equal(t, "54.1.2.3", info.PublicIP)
+		assert.Equal(t, "ec2-54-1-2-3.compute-1.amazonaws.com", info.PublicDNS)
+		assert.Empty(t, client.released)
+	})
+
+	t.Run("AllocateAddressError", func(t *testing.T) {
+		_, err := AssociateElasticIP(&MockElasticIPClient{AllocateAddressErr: fmt.Errorf("address limit exceeded")}, "i-123456")
+		assert.Equal(t, "failed to allocate Elastic IP: address limit exceeded", err.Error())
+	})
+
+	t.Run("AssociateAddressErrorReleases", func(t *testing.T) {
+		client := &MockElasticIPClient{AssociateAddressErr: fmt.Errorf("UnauthorizedOperation")}
+		_, err := AssociateElasticIP(client, "i-123456")
+		assert.Equal(t, "failed to associate Elastic IP: UnauthorizedOperation", err.Error())
+		assert.Equal(t, []string{"eipalloc-123456"}, client.released)
+	})
+}
+
+func TestReleaseElasticIP(t *testing.T) {
+	client := &MockElasticIPClient{}
+	assert.NoError(t, ReleaseElasticIP(client, "eipalloc-123456"))
+	assert.Equal(t, []string{"eipalloc-123456"}, client.released)
+
+	client = &MockElasticIPClient{ReleaseAddressErr: apiError("InvalidAllocationID.NotFound", "unknown")}
+	assert.NoError(t, ReleaseElasticIP(client, "eipalloc-123456"))
+
+	client = &MockElasticIPClient{ReleaseAddressErr: apiError("InvalidIPAddress.InUse", "associated")}
+	assert.Equal(t, "failed to release Elastic IP eipalloc-123456: api error InvalidIPAddress.InUse: associated", ReleaseElasticIP(client, "eipalloc-123456").Error())
+}
+
+func (client *MockElasticIPClient) AllocateAddress(ctx context.Context, params *ec2.AllocateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error) {
+	if client.AllocateAddressErr != nil {
+		return nil, client.AllocateAddressErr
+	}
+	return &ec2.AllocateAddressOutput{
+		AllocationId: aws.String("eipalloc-123456"),
+		PublicIp:     aws.String("54.1.2.3"),
+	}, nil
+}
+
+func (client *MockElasticIPClient) AssociateAddress(ctx context.Context, params *ec2.AssociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error) {
+	if client.AssociateAddressErr != nil {
+		return nil, client.AssociateAddressErr
+	}
+	client.associated = true
+	return &ec2.AssociateAddressOutput{AssociationId: aws.String("eipassoc-123456")}, nil
+}
+
+func (client *MockElasticIPClient) ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error) {
+	if client.ReleaseAddressErr != nil {
+		return nil, client.ReleaseAddressErr
+	}
+	client.released = append(client.released, aws.ToString(params.AllocationId))
+	return &ec2.ReleaseAddressOutput{}, nil
+}
+
+func (client *MockElasticIPClient) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	instance := types.Instance{
+		InstanceId:       aws.String("i-123456"),
+		PrivateIpAddress: aws.String("10.0.1.15"),
+		NetworkInterfaces: []types.InstanceNetworkInterface{{
+			NetworkInterfaceId: aws.String("eni-primary"),
+			Attachment:         &types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(0)},
+		}},
+	}
+	if client.associated {
+		instance.PublicIpAddress = aws.String("54.1.2.3")
+		instance.PublicDnsName = aws.String("ec2-54-1-2-3.compute-1.amazonaws.com")
+	}
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []types.Reservation{{Instances: []types.Instance{instance}}},
+	}, nil
+}
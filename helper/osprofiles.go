@@ -0,0 +1,109 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// OSFamily identifies the Linux distribution of an AMI
+type OSFamily string
+
+const (
+	OSFamilyUbuntu      OSFamily = "ubuntu"
+	OSFamilyDebian      OSFamily = "debian"
+	OSFamilyAmazonLinux OSFamily = "al2023"
+	OSFamilyRHEL        OSFamily = "rhel"
+)
+
+type imageInterface interface {
+	DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error)
+}
+
+// BootstrapProfile holds the distro specific parts of the bootstrap.
+type BootstrapProfile struct {
+	Family            OSFamily
+	DefaultUser       string // login user of the AMI
+	BootstrapTemplate string // built-in user data template
+	InstallRecipe     string // built-in recipe that installs Jenkins over SSM
+}
+
+var bootstrapProfiles = map[OSFamily]BootstrapProfile{
+	OSFamilyUbuntu: {
+		Family:            OSFamilyUbuntu,
+		DefaultUser:       "ubuntu",
+		BootstrapTemplate: "bootstrap/ubuntu.sh.tmpl",
+		InstallRecipe:     "recipes/ubuntu.json",
+	},
+	OSFamilyDebian: {
+		Family:            OSFamilyDebian,
+		DefaultUser:       "admin",
+		BootstrapTemplate: "bootstrap/debian.sh.tmpl",
+		InstallRecipe:     "recipes/debian.json",
+	},
+	OSFamilyAmazonLinux: {
+		Family:            OSFamilyAmazonLinux,
+		DefaultUser:       "ec2-user",
+		BootstrapTemplate: "bootstrap/al2023.sh.tmpl",
+		InstallRecipe:     "recipes/al2023.json",
+	},
+	OSFamilyRHEL: {
+		Family:            OSFamilyRHEL,
+		DefaultUser:       "ec2-user",
+		BootstrapTemplate: "bootstrap/rhel.sh.tmpl",
+		InstallRecipe:     "recipes/rhel.json",
+	},
+}
+
+// GetBootstrapProfile returns the bootstrap profile of the given OS family.
+func GetBootstrapProfile(family OSFamily) (BootstrapProfile, error) {
+	profile, ok := bootstrapProfiles[family]
+	if !ok {
+		return BootstrapProfile{}, fmt.Errorf("unsupported OS family %s", family)
+	}
+	return profile, nil
+}
+
+// TemplateVars returns the user data variables with DefaultUser set to the login user of the
+// profile, unless the variables set it.
+func (profile BootstrapProfile) TemplateVars(vars map[string]string) map[string]string {
+	templateVars := map[string]string{"DefaultUser": profile.DefaultUser}
+	for name, value := range vars {
+		templateVars[name] = value
+	}
+	return templateVars
+}
+
+// DetectOSFamily looks up the AMI and derives its OS family from the platform details, name and description.
+func DetectOSFamily(client imageInterface, amiID string) (OSFamily, error) {
+	imagesOutput, err := client.DescribeImages(context.Background(), &ec2.DescribeImagesInput{
+		ImageIds: []string{amiID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe image: %v", err)
+	}
+	if len(imagesOutput.Images) == 0 {
+		return "", fmt.Errorf("image %s not found", amiID)
+	}
+	image := imagesOutput.Images[0]
+
+	platformDetails := strings.ToLower(aws.ToString(image.PlatformDetails))
+	text := strings.ToLower(aws.ToString(image.Name) + " " + aws.ToString(image.Description))
+
+	switch {
+	case strings.Contains(platformDetails, "red hat"):
+		return OSFamilyRHEL, nil
+	case strings.Contains(text, "ubuntu"):
+		return OSFamilyUbuntu, nil
+	case strings.Contains(text, "debian"):
+		return OSFamilyDebian, nil
+	case strings.Contains(text, "al2023") || strings.Contains(text, "amazon linux 2023"):
+		return OSFamilyAmazonLinux, nil
+	case strings.Contains(text, "rhel") || strings.Contains(text, "red hat"):
+		return OSFamilyRHEL, nil
+	}
+	return "", fmt.Errorf("unable to detect the OS family of image %s (%s), set osFamily explicitly", amiID, aws.ToString(image.Name))
+}
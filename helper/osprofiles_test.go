@@ -0,0 +1,95 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of imageInterface for testing
+type MockImageClient struct {
+	Images            []types.Image
+	DescribeImagesErr error
+
+	describeImagesInput *ec2.DescribeImagesInput
+}
+
+func TestDetectOSFamily(t *testing.T) {
+	tests := []struct {
+		name  string
+		image types.Image
+		want  OSFamily
+	}{
+		{
+			name:  "Ubuntu",
+			image: types.Image{Name: aws.String("ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240501"), PlatformDetails: aws.String("Linux/UNIX")},
+			want:  OSFamilyUbuntu,
+		},
+		{
+			name:  "Debian",
+			image: types.Image{Name: aws.String("debian-12-amd64-20240507-1740"), PlatformDetails: aws.String("Linux/UNIX")},
+			want:  OSFamilyDebian,
+		},
+		{
+			name:  "AmazonLinux2023",
+			image: types.Image{Name: aws.String("al2023-ami-2023.4.20240528.0-kernel-6.1-x86_64"), PlatformDetails: aws.String("Linux/UNIX")},
+			want:  OSFamilyAmazonLinux,
+		},
+		{
+			name:  "RHEL",
+			image: types.Image{Name: aws.String("RHEL-9.4.0_HVM-20240423-x86_64-62-Hourly2-GP3"), PlatformDetails: aws.String("Red Hat Enterprise Linux")},
+			want:  OSFamilyRHEL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			family, err := DetectOSFamily(&MockImageClient{Images: []types.Image{tt.image}}, "ami-123456")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, family)
+		})
+	}
+
+	t.Run("DescribeImagesError", func(t *testing.T) {
+		_, err := DetectOSFamily(&MockImageClient{DescribeImagesErr: fmt.Errorf("describe images error")}, "ami-123456")
+		assert.Error(t, err)
+		assert.Equal(t, "failed to describe image: describe images error", err.Error())
+	})
+
+	t.Run("ImageNotFound", func(t *testing.T) {
+		_, err := DetectOSFamily(&MockImageClient{}, "ami-123456")
+		assert.Error(t, err)
+		assert.Equal(t, "image ami-123456 not found", err.Error())
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		_, err := DetectOSFamily(&MockImageClient{Images: []types.Image{{Name: aws.String("Windows_Server-2022-English-Full-Base")}}}, "ami-123456")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unable to detect the OS family of image ami-123456")
+	})
+}
+
+func TestGetBootstrapProfile(t *testing.T) {
+	profile, err := GetBootstrapProfile(OSFamilyAmazonLinux)
+	assert.NoError(t, err)
+	assert.Equal(t, "ec2-user", profile.DefaultUser)
+
+	assert.Equal(t, map[string]string{"DefaultUser": "ec2-user"}, profile.TemplateVars(nil))
+	assert.Equal(t, map[string]string{"DefaultUser": "jenkins", "Env": "ci"}, profile.TemplateVars(map[string]string{"DefaultUser": "jenkins", "Env": "ci"}))
+
+	_, err = GetBootstrapProfile("windows")
+	assert.Error(t, err)
+	assert.Equal(t, "unsupported OS family windows", err.Error())
+}
+
+func (client *MockImageClient) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	if client.DescribeImagesErr != nil {
+		return nil, client.DescribeImagesErr
+	}
+	client.describeImagesInput = params
+	return &ec2.DescribeImagesOutput{Images: client.Images}, nil
+}
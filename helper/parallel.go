@@ -0,0 +1,43 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Instances launched and bootstrapped at the same time when maxConcurrency is not set
+const defaultMaxConcurrency = 4
+
+// RunConcurrently calls task for every index below count, with at most limit calls running
+// at once. A failing task does not stop the others; all failures are returned together.
+func RunConcurrently(count, limit int, task func(i int) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+
+	errs := make([]error, count)
+	semaphore := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			errs[i] = task(i)
+		}(i)
+	}
+	wg.Wait()
+
+	var failures []string
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d failed: %s", len(failures), count, strings.Join(failures, "; "))
+	}
+	return nil
+}
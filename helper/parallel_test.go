@@ -0,0 +1,45 @@
+package helper
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunConcurrently(t *testing.T) {
+	t.Run("RespectsLimit", func(t *testing.T) {
+		var running, maxRunning, calls int32
+		err := RunConcurrently(10, 3, func(i int) error {
+			current := atomic.AddInt32(&running, 1)
+			for {
+				observed := atomic.LoadInt32(&maxRunning)
+				if current <= observed || atomic.CompareAndSwapInt32(&maxRunning, observed, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&calls, 1)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(10), calls)
+		assert.LessOrEqual(t, maxRunning, int32(3))
+	})
+
+	t.Run("AggregatesErrors", func(t *testing.T) {
+		var calls int32
+		err := RunConcurrently(4, 2, func(i int) error {
+			atomic.AddInt32(&calls, 1)
+			if i%2 == 1 {
+				return fmt.Errorf("task %d failed", i)
+			}
+			return nil
+		})
+		assert.Equal(t, int32(4), calls)
+		assert.Equal(t, "2 of 4 failed: task 1 failed; task 3 failed", err.Error())
+	})
+}
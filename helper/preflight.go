@@ -0,0 +1,232 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamTypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Steps of the provisioning pipeline that can be checked before running
+const (
+	StepIAMRole            = "iamRole"
+	StepBoundary           = "permissionsBoundary"
+	StepAMI                = "ami"
+	StepAMIParameter       = "amiParameter"
+	StepSecurityGroup      = "securityGroup"
+	StepEC2Instance        = "ec2Instance"
+	StepEncryption         = "volumeEncryption"
+	StepLaunchTemplate     = "launchTemplate"
+	StepElasticIP          = "elasticIp"
+	StepDNSRecord          = "dnsRecord"
+	StepSSMCommands        = "ssmCommands"
+	StepSSMDocument        = "ssmDocument"
+	StepSSMOutput          = "ssmOutput"
+	StepSSMOutputLogs      = "ssmOutputLogs"
+	StepAdminPassword      = "adminPassword"
+	StepJenkinsAdminSecret = "jenkinsAdminSecret"
+)
+
+// API actions invoked by each step
+var stepActions = map[string][]string{
+	StepIAMRole: {
+		"iam:GetRole",
+		"iam:CreatePolicy",
+		"iam:CreateRole",
+		"iam:AttachRolePolicy",
+		"iam:CreateInstanceProfile",
+		"iam:AddRoleToInstanceProfile",
+	},
+	StepBoundary: {
+		"iam:PutRolePermissionsBoundary",
+	},
+	StepAMI: {
+		"ec2:DescribeImages",
+	},
+	StepAMIParameter: {
+		"ssm:GetParameter",
+	},
+	StepSecurityGroup: {
+		"ec2:DescribeSubnets",
+		"ec2:DescribeSecurityGroups",
+		"ec2:CreateSecurityGroup",
+		"ec2:AuthorizeSecurityGroupIngress",
+	},
+	StepEC2Instance: {
+		"ec2:DescribeImages",
+		"ec2:RunInstances",
+		"ec2:DescribeInstances",
+		"ec2:DescribeInstanceStatus",
+		"iam:PassRole",
+	},
+	StepEncryption: {
+		"ec2:DescribeVolumes",
+		"kms:CreateGrant",
+		"kms:Decrypt",
+		"kms:DescribeKey",
+		"kms:GenerateDataKeyWithoutPlaintext",
+		"kms:ReEncryptFrom",
+		"kms:ReEncryptTo",
+	},
+	StepLaunchTemplate: {
+		"ec2:CreateLaunchTemplate",
+		"ec2:CreateLaunchTemplateVersion",
+		"ec2:DescribeLaunchTemplateVersions",
+		"ec2:ModifyLaunchTemplate",
+	},
+	StepElasticIP: {
+		"ec2:AllocateAddress",
+		"ec2:AssociateAddress",
+		"ec2:ReleaseAddress",
+		"ec2:CreateTags",
+		"ec2:DescribeInstances",
+	},
+	StepDNSRecord: {
+		"route53:ListHostedZonesByName",
+		"route53:ChangeResourceRecordSets",
+		"route53:GetChange",
+	},
+	StepSSMCommands: {
+		"ssm:DescribeInstanceInformation",
+		"ssm:SendCommand",
+		"ssm:GetCommandInvocation",
+	},
+	StepSSMDocument: {
+		"ssm:GetDocument",
+		"ssm:CreateDocument",
+		"ssm:UpdateDocument",
+		"ssm:UpdateDocumentDefaultVersion",
+		"ssm:ListDocumentVersions",
+	},
+	StepSSMOutput: {
+		"s3:ListBucket",
+		"s3:GetObject",
+		"iam:PutRolePolicy",
+		// Granted to the instance role for the agent
+		"s3:PutObject",
+		"s3:GetEncryptionConfiguration",
+	},
+	StepSSMOutputLogs: {
+		"logs:GetLogEvents",
+		"iam:PutRolePolicy",
+		// Granted to the instance role for the agent
+		"logs:CreateLogGroup",
+		"logs:CreateLogStream",
+		"logs:DescribeLogGroups",
+		"logs:DescribeLogStreams",
+		"logs:PutLogEvents",
+	},
+	StepAdminPassword: {
+		"secretsmanager:CreateSecret",
+		"secretsmanager:PutSecretValue",
+	},
+	StepJenkinsAdminSecret: {
+		"secretsmanager:GetSecretValue",
+		"iam:PutRolePolicy",
+	},
+}
+
+type callerIdentityInterface interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+type policySimulatorInterface interface {
+	GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error)
+	SimulatePrincipalPolicy(ctx context.Context, params *iam.SimulatePrincipalPolicyInput, optFns ...func(*iam.Options)) (*iam.SimulatePrincipalPolicyOutput, error)
+}
+
+// RequiredActions returns the sorted, de-duplicated API actions used by the given steps.
+func RequiredActions(steps ...string) ([]string, error) {
+	seen := map[string]bool{}
+	var actions []string
+	for _, step := range steps {
+		stepList, ok := stepActions[step]
+		if !ok {
+			return nil, fmt.Errorf("unknown preflight step %s", step)
+		}
+		for _, action := range stepList {
+			if !seen[action] {
+				seen[action] = true
+				actions = append(actions, action)
+			}
+		}
+	}
+	sort.Strings(actions)
+	return actions, nil
+}
+
+// CheckPermissions simulates the caller's policies for every action used by the given steps
+// and reports all denied actions in a single error.
+func CheckPermissions(stsClient callerIdentityInterface, iamClient policySimulatorInterface, steps ...string) error {
+	actions, err := RequiredActions(steps...)
+	if err != nil {
+		return err
+	}
+
+	identity, err := stsClient.GetCallerIdentity(context.Background(), &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("failed to get caller identity: %v", err)
+	}
+	callerArn := aws.ToString(identity.Arn)
+
+	principalArn, err := principalArnForCaller(iamClient, callerArn)
+	if err != nil {
+		return err
+	}
+	log.Printf("Checking %d permissions for %s\n", len(actions), principalArn)
+
+	var denied []string
+	paginator := iam.NewSimulatePrincipalPolicyPaginator(iamClient, &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principalArn),
+		ActionNames:     actions,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to simulate principal policy: %v", err)
+		}
+		for _, result := range page.EvaluationResults {
+			if result.EvalDecision != iamTypes.PolicyEvaluationDecisionTypeAllowed {
+				denied = append(denied, fmt.Sprintf("%s (%s)", aws.ToString(result.EvalActionName), result.EvalDecision))
+			}
+		}
+	}
+
+	if len(denied) > 0 {
+		return fmt.Errorf("%s is missing %d permissions: %s", principalArn, len(denied), strings.Join(denied, ", "))
+	}
+	log.Printf("All required permissions are granted")
+	return nil
+}
+
+// principalArnForCaller maps the STS caller ARN to the IAM principal that can be simulated.
+// Assumed-role sessions are resolved to the role ARN, which may carry a path.
+func principalArnForCaller(client policySimulatorInterface, callerArn string) (string, error) {
+	parts := strings.SplitN(callerArn, ":", 6)
+	if len(parts) != 6 {
+		return "", fmt.Errorf("unexpected caller ARN %s", callerArn)
+	}
+	resource := parts[5]
+
+	switch {
+	case strings.HasPrefix(resource, "assumed-role/"):
+		roleName := strings.Split(strings.TrimPrefix(resource, "assumed-role/"), "/")[0]
+		roleOutput, err := client.GetRole(context.Background(), &iam.GetRoleInput{
+			RoleName: aws.String(roleName),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get role for caller %s: %v", callerArn, err)
+		}
+		return aws.ToString(roleOutput.Role.Arn), nil
+	case resource == "root":
+		return "", fmt.Errorf("cannot simulate policies for the account root user")
+	default:
+		return callerArn, nil
+	}
+}
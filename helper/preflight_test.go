@@ -0,0 +1,156 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockSTSClient struct {
+	CallerArn            string
+	GetCallerIdentityErr error
+}
+
+type MockPolicySimulatorClient struct {
+	DeniedActions              map[string]bool
+	GetRoleErr                 error
+	SimulatePrincipalPolicyErr error
+
+	policySourceArn string
+}
+
+func TestRequiredActions(t *testing.T) {
+	t.Run("Deduplicated", func(t *testing.T) {
+		actions, err := RequiredActions(StepEC2Instance, StepEC2Instance)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"ec2:DescribeImages", "ec2:DescribeInstanceStatus", "ec2:DescribeInstances", "ec2:RunInstances", "iam:PassRole"}, actions)
+	})
+
+	t.Run("ConditionalSteps", func(t *testing.T) {
+		tests := []struct {
+			step    string
+			actions []string
+		}{
+			{StepBoundary, []string{"iam:PutRolePermissionsBoundary"}},
+			{StepAMIParameter, []string{"ssm:GetParameter"}},
+			{StepSSMOutput, []string{"iam:PutRolePolicy", "s3:GetEncryptionConfiguration", "s3:GetObject", "s3:ListBucket", "s3:PutObject"}},
+			{StepSSMOutputLogs, []string{"iam:PutRolePolicy", "logs:CreateLogGroup", "logs:CreateLogStream", "logs:DescribeLogGroups", "logs:DescribeLogStreams", "logs:GetLogEvents", "logs:PutLogEvents"}},
+			{StepJenkinsAdminSecret, []string{"iam:PutRolePolicy", "secretsmanager:GetSecretValue"}},
+		}
+		for _, test := range tests {
+			actions, err := RequiredActions(test.step)
+			assert.NoError(t, err)
+			assert.Equal(t, test.actions, actions)
+
+			// Only required when the step is included
+			actions, err = RequiredActions(StepIAMRole, StepAMI)
+			assert.NoError(t, err)
+			assert.NotContains(t, actions, test.actions[0])
+		}
+	})
+
+	t.Run("UnknownStep", func(t *testing.T) {
+		_, err := RequiredActions("deploy")
+		assert.Error(t, err)
+		assert.Equal(t, "unknown preflight step deploy", err.Error())
+	})
+}
+
+func TestCheckPermissions(t *testing.T) {
+	userArn := "arn:aws:iam::123456789012:user/builder"
+
+	t.Run("GetCallerIdentityError", func(t *testing.T) {
+		err := CheckPermissions(&MockSTSClient{GetCallerIdentityErr: fmt.Errorf("no credentials")}, &MockPolicySimulatorClient{}, StepIAMRole)
+		assert.Error(t, err)
+		assert.Equal(t, "failed to get caller identity: no credentials", err.Error())
+	})
+
+	t.Run("AllAllowed", func(t *testing.T) {
+		simulator := &MockPolicySimulatorClient{}
+		err := CheckPermissions(&MockSTSClient{CallerArn: userArn}, simulator, StepIAMRole, StepSSMCommands)
+		assert.NoError(t, err)
+		assert.Equal(t, userArn, simulator.policySourceArn)
+	})
+
+	t.Run("MissingPermissions", func(t *testing.T) {
+		simulator := &MockPolicySimulatorClient{DeniedActions: map[string]bool{"iam:CreatePolicy": true, "ec2:RunInstances": true}}
+		err := CheckPermissions(&MockSTSClient{CallerArn: userArn}, simulator, StepIAMRole, StepEC2Instance)
+		assert.Error(t, err)
+		assert.Equal(t, userArn+" is missing 2 permissions: ec2:RunInstances (implicitDeny), iam:CreatePolicy (implicitDeny)", err.Error())
+	})
+
+	t.Run("AssumedRole", func(t *testing.T) {
+		simulator := &MockPolicySimulatorClient{}
+		err := CheckPermissions(&MockSTSClient{CallerArn: "arn:aws:sts::123456789012:assumed-role/jenkins/session"}, simulator, StepSSMCommands)
+		assert.NoError(t, err)
+		assert.Equal(t, "arn:aws:iam::123456789012:role/automation/jenkins", simulator.policySourceArn)
+	})
+
+	t.Run("AssumedRoleGetRoleError", func(t *testing.T) {
+		simulator := &MockPolicySimulatorClient{GetRoleErr: fmt.Errorf("access denied")}
+		err := CheckPermissions(&MockSTSClient{CallerArn: "arn:aws:sts::123456789012:assumed-role/jenkins/session"}, simulator, StepSSMCommands)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to get role for caller")
+	})
+
+	t.Run("RootUser", func(t *testing.T) {
+		err := CheckPermissions(&MockSTSClient{CallerArn: "arn:aws:iam::123456789012:root"}, &MockPolicySimulatorClient{}, StepSSMCommands)
+		assert.Error(t, err)
+		assert.Equal(t, "cannot simulate policies for the account root user", err.Error())
+	})
+
+	t.Run("SimulatePrincipalPolicyError", func(t *testing.T) {
+		simulator := &MockPolicySimulatorClient{SimulatePrincipalPolicyErr: fmt.Errorf("throttled")}
+		err := CheckPermissions(&MockSTSClient{CallerArn: userArn}, simulator, StepSSMCommands)
+		assert.Error(t, err)
+		assert.Equal(t, "failed to simulate principal policy: throttled", err.Error())
+	})
+}
+
+func (m *MockSTSClient) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if m.GetCallerIdentityErr != nil {
+		return nil, m.GetCallerIdentityErr
+	}
+	return &sts.GetCallerIdentityOutput{
+		Arn:     aws.String(m.CallerArn),
+		Account: aws.String("123456789012"),
+	}, nil
+}
+
+func (m *MockPolicySimulatorClient) GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error) {
+	if m.GetRoleErr != nil {
+		return nil, m.GetRoleErr
+	}
+	return &iam.GetRoleOutput{
+		Role: &types.Role{
+			RoleName: params.RoleName,
+			Arn:      aws.String("arn:aws:iam::123456789012:role/automation/" + aws.ToString(params.RoleName)),
+		},
+	}, nil
+}
+
+func (m *MockPolicySimulatorClient) SimulatePrincipalPolicy(ctx context.Context, params *iam.SimulatePrincipalPolicyInput, optFns ...func(*iam.Options)) (*iam.SimulatePrincipalPolicyOutput, error) {
+	if m.SimulatePrincipalPolicyErr != nil {
+		return nil, m.SimulatePrincipalPolicyErr
+	}
+	m.policySourceArn = aws.ToString(params.PolicySourceArn)
+
+	var results []types.EvaluationResult
+	for _, action := range params.ActionNames {
+		decision := types.PolicyEvaluationDecisionTypeAllowed
+		if m.DeniedActions[action] {
+			decision = types.PolicyEvaluationDecisionTypeImplicitDeny
+		}
+		results = append(results, types.EvaluationResult{
+			EvalActionName: aws.String(action),
+			EvalDecision:   decision,
+		})
+	}
+	return &iam.SimulatePrincipalPolicyOutput{EvaluationResults: results}, nil
+}
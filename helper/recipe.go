@@ -0,0 +1,291 @@
+package helper
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed recipes
+var builtInRecipes embed.FS
+
+// Recipe is an install script split into named steps, run over SSM. Commands run as root.
+type Recipe struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"` // exported at the start of every step
+	Steps       []CommandStep     `json:"steps"`
+}
+
+// CommandStep is a named group of shell commands, sent over SSM as one command.
+type CommandStep struct {
+	Name     string   `json:"name"`
+	Commands []string `json:"commands"`
+}
+
+var environmentNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LoadRecipe reads the given recipe file, or the built-in recipe of the profile when recipePath is
+// empty, and rejects it when it is malformed or contains commands that would block or prompt.
+func LoadRecipe(profile BootstrapProfile, recipePath string) (Recipe, error) {
+	var content []byte
+	var err error
+	if recipePath == "" {
+		recipePath = profile.InstallRecipe
+		content, err = builtInRecipes.ReadFile(recipePath)
+	} else {
+		content, err = os.ReadFile(recipePath)
+	}
+	if err != nil {
+		return Recipe{}, fmt.Errorf("failed to read recipe %s: %v", recipePath, err)
+	}
+
+	recipe, err := ParseRecipe(content)
+	if err != nil {
+		return Recipe{}, fmt.Errorf("invalid recipe %s: %v", recipePath, err)
+	}
+	return recipe, nil
+}
+
+// ParseRecipe decodes a JSON recipe and validates it.
+func ParseRecipe(content []byte) (Recipe, error) {
+	var recipe Recipe
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&recipe); err != nil {
+		return Recipe{}, fmt.Errorf("failed to decode recipe: %v", err)
+	}
+	if err := recipe.Validate(); err != nil {
+		return Recipe{}, err
+	}
+	return recipe, nil
+}
+
+// Validate checks the structure of the recipe and lints its commands.
+func (recipe Recipe) Validate() error {
+	var problems []string
+	if recipe.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if len(recipe.Steps) == 0 {
+		problems = append(problems, "at least one step is required")
+	}
+	for name := range recipe.Environment {
+		if !environmentNamePattern.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("invalid environment variable name %q", name))
+		}
+	}
+	seen := map[string]bool{}
+	for i, step := range recipe.Steps {
+		switch {
+		case step.Name == "":
+			problems = append(problems, fmt.Sprintf("step %d has no name", i+1))
+		case seen[step.Name]:
+			problems = append(problems, fmt.Sprintf("duplicate step %q", step.Name))
+		}
+		seen[step.Name] = true
+		if len(step.Commands) == 0 {
+			problems = append(problems, fmt.Sprintf("step %q has no commands", step.Name))
+		}
+		for _, command := range step.Commands {
+			if strings.TrimSpace(command) == "" {
+				problems = append(problems, fmt.Sprintf("step %q has an empty command", step.Name))
+			}
+		}
+	}
+	problems = append(problems, LintRecipe(recipe)...)
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// CommandSteps returns the steps to run, each starting with the exports of the recipe environment.
+func (recipe Recipe) CommandSteps() []CommandStep {
+	var names []string
+	for name := range recipe.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var exports []string
+	for _, name := range names {
+		exports = append(exports, fmt.Sprintf("export %s=%s", name, shellQuote(recipe.Environment[name])))
+	}
+
+	steps := make([]CommandStep, len(recipe.Steps))
+	for i, step := range recipe.Steps {
+		steps[i] = CommandStep{
+			Name:     step.Name,
+			Commands: append(append([]string{}, exports...), step.Commands...),
+		}
+	}
+	return steps
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Programs that wait for a terminal
+var interactivePrograms = map[string]bool{
+	"vi": true, "vim": true, "nano": true, "emacs": true, "less": true, "more": true, "top": true, "htop": true,
+}
+
+// Package manager subcommands that ask for confirmation without -y
+var confirmingSubcommands = map[string]map[string]bool{
+	"apt":     {"install": true, "upgrade": true, "dist-upgrade": true, "full-upgrade": true, "remove": true, "purge": true, "autoremove": true},
+	"apt-get": {"install": true, "upgrade": true, "dist-upgrade": true, "remove": true, "purge": true, "autoremove": true},
+	"dnf":     {"install": true, "upgrade": true, "update": true, "remove": true, "erase": true, "reinstall": true, "downgrade": true, "groupinstall": true},
+	"yum":     {"install": true, "upgrade": true, "update": true, "remove": true, "erase": true, "reinstall": true, "downgrade": true, "groupinstall": true},
+}
+
+// simpleCommand is one program invocation of a command line.
+type simpleCommand struct {
+	program     string
+	args        []string
+	assignments map[string]string // variables set in front of the program
+	sudo        bool
+	preserveEnv bool // sudo -E keeps the exported variables
+}
+
+// LintRecipe returns the commands of the recipe that would prompt for input or block the
+// non-interactive SSM shell, such as package installs without -y or an interactive su.
+func LintRecipe(recipe Recipe) []string {
+	var problems []string
+	for _, step := range recipe.Steps {
+		exported := map[string]string{}
+		for name, value := range recipe.Environment {
+			exported[name] = value
+		}
+		for _, command := range step.Commands {
+			for _, simple := range splitCommandLine(command) {
+				if simple.program == "export" {
+					for _, arg := range simple.args {
+						if name, value, ok := strings.Cut(arg, "="); ok {
+							exported[name] = strings.Trim(value, `"'`)
+						}
+					}
+					continue
+				}
+				for _, problem := range lintCommand(simple, exported) {
+					problems = append(problems, fmt.Sprintf("step %q: %q %s", step.Name, command, problem))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func lintCommand(command simpleCommand, exported map[string]string) []string {
+	var problems []string
+	subcommand := firstOperand(command.args)
+	switch program := path.Base(command.program); {
+	case interactivePrograms[program]:
+		problems = append(problems, "runs an interactive program")
+	case program == "su" && !hasArg(command.args, "-c", "--command"):
+		problems = append(problems, "opens an interactive shell, use su -c or runuser")
+	case program == "systemctl" && subcommand == "status":
+		problems = append(problems, "pages its output and exits non-zero for stopped units, use systemctl is-active")
+	case program == "add-apt-repository" && !hasArg(command.args, "-y", "--yes"):
+		problems = append(problems, "asks for confirmation, add -y")
+	case program == "unzip" && !hasShortFlag(command.args, 'o') && !hasShortFlag(command.args, 'n'):
+		problems = append(problems, "prompts when files exist, add -o")
+	case confirmingSubcommands[program][subcommand]:
+		if !hasArg(command.args, "--yes", "--assume-yes", "--assumeyes") && !hasShortFlag(command.args, 'y') {
+			problems = append(problems, "asks for confirmation, add -y")
+		}
+		if strings.HasPrefix(program, "apt") && !debianNoninteractive(command, exported) {
+			problems = append(problems, "may prompt for configuration, set DEBIAN_FRONTEND=noninteractive (sudo drops exported variables without -E)")
+		}
+	}
+	return problems
+}
+
+func debianNoninteractive(command simpleCommand, exported map[string]string) bool {
+	if command.assignments["DEBIAN_FRONTEND"] == "noninteractive" {
+		return true
+	}
+	return exported["DEBIAN_FRONTEND"] == "noninteractive" && (!command.sudo || command.preserveEnv)
+}
+
+// splitCommandLine splits a shell command line into the programs joined by pipes and lists.
+// Quoting is not interpreted, which is enough to find the programs of a recipe command.
+func splitCommandLine(line string) []simpleCommand {
+	separators := strings.NewReplacer("&&", ";", "||", ";", "|", ";")
+	var commands []simpleCommand
+	for _, segment := range strings.Split(separators.Replace(line), ";") {
+		fields := strings.Fields(segment)
+		command := simpleCommand{assignments: map[string]string{}}
+		for len(fields) > 0 {
+			field := fields[0]
+			if name, value, ok := strings.Cut(field, "="); ok && environmentNamePattern.MatchString(name) {
+				command.assignments[name] = strings.Trim(value, `"'`)
+				fields = fields[1:]
+				continue
+			}
+			if field != "sudo" {
+				break
+			}
+			command.sudo = true
+			fields = fields[1:]
+			for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+				switch {
+				case fields[0] == "-E" || strings.HasPrefix(fields[0], "--preserve-env"):
+					command.preserveEnv = true
+				case fields[0] == "-u" || fields[0] == "-g":
+					fields = fields[1:]
+				}
+				if len(fields) > 0 {
+					fields = fields[1:]
+				}
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		command.program = fields[0]
+		command.args = fields[1:]
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+// firstOperand returns the first argument that is not a flag, the subcommand of apt or systemctl.
+func firstOperand(args []string) string {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-o":
+			i++ // apt-get -o Option=value
+		case !strings.HasPrefix(args[i], "-"):
+			return args[i]
+		}
+	}
+	return ""
+}
+
+func hasArg(args []string, names ...string) bool {
+	for _, arg := range args {
+		for _, name := range names {
+			if arg == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasShortFlag reports whether a single-dash flag group such as -qy contains the flag.
+func hasShortFlag(args []string, flag rune) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.ContainsRune(arg[1:], flag) {
+			return true
+		}
+	}
+	return false
+}
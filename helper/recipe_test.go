@@ -0,0 +1,163 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltInRecipes(t *testing.T) {
+	for family, profile := range bootstrapProfiles {
+		t.Run(string(family), func(t *testing.T) {
+			recipe, err := LoadRecipe(profile, "")
+			assert.NoError(t, err)
+			assert.Equal(t, "jenkins-"+string(family), recipe.Name)
+			assert.Empty(t, LintRecipe(recipe))
+			// The recipes run on amd64 and arm64 images alike
+			for _, step := range recipe.Steps {
+				for _, command := range step.Commands {
+					assert.NotRegexp(t, `amd64|x86_64`, command, step.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadRecipe(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("File", func(t *testing.T) {
+		recipePath := filepath.Join(dir, "custom.json")
+		content := `{"name": "custom", "steps": [{"name": "install jenkins", "commands": ["dnf install -y jenkins"]}]}`
+		assert.NoError(t, os.WriteFile(recipePath, []byte(content), 0644))
+
+		recipe, err := LoadRecipe(bootstrapProfiles[OSFamilyRHEL], recipePath)
+		assert.NoError(t, err)
+		assert.Equal(t, "custom", recipe.Name)
+		assert.Equal(t, []CommandStep{{Name: "install jenkins", Commands: []string{"dnf install -y jenkins"}}}, recipe.Steps)
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := LoadRecipe(bootstrapProfiles[OSFamilyRHEL], filepath.Join(dir, "missing.json"))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to read recipe")
+	})
+
+	t.Run("InteractiveCommand", func(t *testing.T) {
+		recipePath := filepath.Join(dir, "interactive.json")
+		content := `{"name": "interactive", "steps": [{"name": "login", "commands": ["sudo su - jenkins"]}]}`
+		assert.NoError(t, os.WriteFile(recipePath, []byte(content), 0644))
+
+		_, err := LoadRecipe(bootstrapProfiles[OSFamilyUbuntu], recipePath)
+		assert.Equal(t, `invalid recipe `+recipePath+`: step "login": "sudo su - jenkins" opens an interactive shell, use su -c or runuser`, err.Error())
+	})
+}
+
+func TestParseRecipe(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "UnknownField",
+			content: `{"name": "jenkins", "step": []}`,
+			wantErr: `failed to decode recipe: json: unknown field "step"`,
+		},
+		{
+			name:    "MissingNameAndSteps",
+			content: `{}`,
+			wantErr: "name is required; at least one step is required",
+		},
+		{
+			name:    "InvalidSteps",
+			content: `{"name": "jenkins", "steps": [{"name": "install", "commands": ["dnf install -y jenkins"]}, {"name": "install", "commands": [" "]}, {"commands": []}]}`,
+			wantErr: `duplicate step "install"; step "install" has an empty command; step 3 has no name; step "" has no commands`,
+		},
+		{
+			name:    "InvalidEnvironment",
+			content: `{"name": "jenkins", "environment": {"DEBIAN-FRONTEND": "noninteractive"}, "steps": [{"name": "install", "commands": ["dnf install -y jenkins"]}]}`,
+			wantErr: `invalid environment variable name "DEBIAN-FRONTEND"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRecipe([]byte(tt.content))
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestLintRecipe(t *testing.T) {
+	tests := []struct {
+		name        string
+		environment map[string]string
+		command     string
+		want        string // expected problem, none when empty
+	}{
+		{name: "AptUpgradeWithoutYes", command: "DEBIAN_FRONTEND=noninteractive apt upgrade", want: "asks for confirmation, add -y"},
+		{name: "AptInstallWithoutYes", command: "sudo DEBIAN_FRONTEND=noninteractive apt install openjdk-17-jdk", want: "asks for confirmation, add -y"},
+		{name: "AptWithoutFrontend", command: "apt-get install -y jenkins", want: "may prompt for configuration, set DEBIAN_FRONTEND=noninteractive (sudo drops exported variables without -E)"},
+		{name: "AptWithEnvironment", environment: map[string]string{"DEBIAN_FRONTEND": "noninteractive"}, command: "apt-get install -y jenkins"},
+		{name: "AptSudoDropsEnvironment", environment: map[string]string{"DEBIAN_FRONTEND": "noninteractive"}, command: "sudo apt-get install -y jenkins", want: "may prompt for configuration, set DEBIAN_FRONTEND=noninteractive (sudo drops exported variables without -E)"},
+		{name: "AptSudoPreservesEnvironment", environment: map[string]string{"DEBIAN_FRONTEND": "noninteractive"}, command: "sudo -E apt-get install -qy jenkins"},
+		{name: "AptUpdate", command: "apt-get update"},
+		{name: "AptOptions", environment: map[string]string{"DEBIAN_FRONTEND": "noninteractive"}, command: "apt-get -o Dpkg::Options::=--force-confold upgrade --yes"},
+		{name: "DnfWithoutYes", command: "sudo dnf install jenkins", want: "asks for confirmation, add -y"},
+		{name: "DnfWithYes", command: "sudo dnf install -y jenkins"},
+		{name: "YumAssumeYes", command: "yum update --assumeyes"},
+		{name: "InteractiveSu", command: "sudo su - jenkins", want: "opens an interactive shell, use su -c or runuser"},
+		{name: "SuWithCommand", command: "su - jenkins -c 'docker ps'"},
+		{name: "SystemctlStatus", command: "sudo systemctl status jenkins", want: "pages its output and exits non-zero for stopped units, use systemctl is-active"},
+		{name: "SystemctlIsActive", command: "systemctl is-active jenkins"},
+		{name: "Editor", command: "sudo vi /etc/default/jenkins", want: "runs an interactive program"},
+		{name: "Pager", command: "journalctl -u jenkins | less", want: "runs an interactive program"},
+		{name: "AddAptRepository", command: "add-apt-repository ppa:openjdk-r/ppa", want: "asks for confirmation, add -y"},
+		{name: "UnzipWithoutOverwrite", command: "unzip awscliv2.zip", want: "prompts when files exist, add -o"},
+		{name: "UnzipOverwrite", command: "unzip -oq awscliv2.zip"},
+		{name: "ListOfCommands", command: "apt-get update && apt-get upgrade", want: "asks for confirmation, add -y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recipe := Recipe{Name: "test", Environment: tt.environment, Steps: []CommandStep{{Name: "step", Commands: []string{tt.command}}}}
+			problems := LintRecipe(recipe)
+			if tt.want == "" {
+				assert.Empty(t, problems)
+				return
+			}
+			assert.Contains(t, problems, `step "step": "`+tt.command+`" `+tt.want)
+		})
+	}
+
+	t.Run("ExportInStep", func(t *testing.T) {
+		recipe := Recipe{Name: "test", Steps: []CommandStep{
+			{Name: "install", Commands: []string{"export DEBIAN_FRONTEND=noninteractive", "apt-get install -y jenkins"}},
+			{Name: "upgrade", Commands: []string{"apt-get upgrade -y"}},
+		}}
+		// The export only applies to the step it is part of
+		assert.Equal(t, []string{
+			`step "upgrade": "apt-get upgrade -y" may prompt for configuration, set DEBIAN_FRONTEND=noninteractive (sudo drops exported variables without -E)`,
+		}, LintRecipe(recipe))
+	})
+}
+
+func TestRecipeCommandSteps(t *testing.T) {
+	recipe := Recipe{
+		Name:        "test",
+		Environment: map[string]string{"DEBIAN_FRONTEND": "noninteractive", "JENKINS_HOME": "/var/lib/jenkins's"},
+		Steps: []CommandStep{
+			{Name: "install", Commands: []string{"apt-get install -y jenkins"}},
+		},
+	}
+	assert.Equal(t, []CommandStep{
+		{Name: "install", Commands: []string{
+			"export DEBIAN_FRONTEND='noninteractive'",
+			`export JENKINS_HOME='/var/lib/jenkins'\''s'`,
+			"apt-get install -y jenkins",
+		}},
+	}, recipe.CommandSteps())
+	// The recipe itself is left unchanged
+	assert.Equal(t, []string{"apt-get install -y jenkins"}, recipe.Steps[0].Commands)
+}
@@ -0,0 +1,67 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RunReport records the resources used and created by a provisioning run.
+type RunReport struct {
+	StartedAt       time.Time             `json:"startedAt"`
+	FinishedAt      time.Time             `json:"finishedAt"`
+	AMI             *AMIResolution        `json:"ami,omitempty"`
+	OSFamily        OSFamily              `json:"osFamily,omitempty"`
+	RoleName        string                `json:"roleName,omitempty"`
+	SecurityGroupID string                `json:"securityGroupId,omitempty"`
+	LaunchTemplate  *LaunchTemplateResult `json:"launchTemplate,omitempty"`
+	SSMDocument     *SSMDocumentResult    `json:"ssmDocument,omitempty"`
+	Instances       []LaunchedInstance    `json:"instances,omitempty"`
+	DNSRecord       *DNSRecord            `json:"dnsRecord,omitempty"`
+	Progress        []ProgressEvent       `json:"progress,omitempty"`
+	Error           string                `json:"error,omitempty"`
+
+	mu sync.Mutex
+}
+
+// NewRunReport starts a report for a run beginning now.
+func NewRunReport() *RunReport {
+	return &RunReport{StartedAt: time.Now().UTC()}
+}
+
+// RecordProgress appends a waiter progress event. It is safe to call from concurrent waiters.
+func (report *RunReport) RecordProgress(event ProgressEvent) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Progress = append(report.Progress, event)
+}
+
+// Write stores the report as indented JSON at the given path.
+func (report *RunReport) Write(path string) error {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.FinishedAt = time.Now().UTC()
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run report: %v", err)
+	}
+	if err := os.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write run report: %v", err)
+	}
+	return nil
+}
+
+// ReadRunReport loads a report written by Write, e.g. to tear down the resources of a run.
+func ReadRunReport(path string) (*RunReport, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run report: %v", err)
+	}
+	report := &RunReport{}
+	if err := json.Unmarshal(content, report); err != nil {
+		return nil, fmt.Errorf("failed to decode run report: %v", err)
+	}
+	return report, nil
+}
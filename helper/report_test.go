@@ -0,0 +1,47 @@
+package helper
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunReportWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run-output.json")
+	report := NewRunReport()
+	report.AMI = &AMIResolution{Requested: "ubuntu-22.04-amd64", ImageID: "ami-123456", Source: AMISourceSSMParameter}
+	report.Instances = []LaunchedInstance{{InstanceID: "i-123456", InstanceType: "t3.medium", Lifecycle: "on-demand"}}
+	report.RecordProgress(ProgressEvent{InstanceID: "i-123456", Phase: PhaseStatusChecks, State: "initializing", ElapsedSeconds: 30})
+
+	assert.NoError(t, report.Write(path))
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var written map[string]interface{}
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, "i-123456", written["instances"].([]interface{})[0].(map[string]interface{})["instanceId"])
+	assert.Equal(t, "ami-123456", written["ami"].(map[string]interface{})["imageId"])
+	assert.Equal(t, "initializing", written["progress"].([]interface{})[0].(map[string]interface{})["state"])
+	assert.NotContains(t, written, "error")
+
+	assert.Error(t, report.Write(filepath.Join(t.TempDir(), "missing", "run-output.json")))
+}
+
+func TestReadRunReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run-output.json")
+	report := NewRunReport()
+	report.Instances = []LaunchedInstance{{InstanceID: "i-123456", Network: NetworkInfo{ElasticIPAllocationID: "eipalloc-123456"}}}
+	report.DNSRecord = &DNSRecord{HostedZoneID: "Z123", Name: "jenkins.example.com", Type: "A", TTL: 300, Values: []string{"54.1.2.3"}}
+	assert.NoError(t, report.Write(path))
+
+	read, err := ReadRunReport(path)
+	assert.NoError(t, err)
+	assert.Equal(t, report.Instances, read.Instances)
+	assert.Equal(t, report.DNSRecord, read.DNSRecord)
+
+	_, err = ReadRunReport(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
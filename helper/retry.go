@@ -0,0 +1,138 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// Retry defaults, more patient than the SDK's 3 attempts since the waiters poll in bursts
+const (
+	defaultRetryMaxAttempts = 8
+	defaultRetryMaxBackoff  = 30 * time.Second
+)
+
+// Error codes returned while a resource created moments ago has not propagated yet.
+// The SDK treats them as terminal, so the helpers retry them around the calls that hit them.
+var eventualConsistencyErrorCodes = []string{
+	"InvalidInstanceID.NotFound",
+	"InvalidGroup.NotFound",
+	"InvalidInstanceId",
+	"InvalidAllocationID.NotFound",
+}
+
+// A new instance profile is rejected with this message of an InvalidParameterValue error,
+// which has no code of its own
+const instanceProfileNotPropagatedMessage = "Invalid IAM Instance Profile"
+
+// Attempts and backoff cap of eventual consistency retries
+var (
+	eventualConsistencyAttempts   = 6
+	eventualConsistencyMaxBackoff = 20 * time.Second
+)
+
+// RetryOptions configures the retryer shared by all AWS clients.
+type RetryOptions struct {
+	MaxAttempts int
+	MaxBackoff  time.Duration
+	Adaptive    bool // rate limit requests client-side after throttling errors
+}
+
+// NewRetryer returns the retryer for config.WithRetryer. Both modes back off exponentially
+// with jitter and retry throttling, timeouts and 5xx errors.
+func NewRetryer(opts RetryOptions) func() aws.Retryer {
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = defaultRetryMaxBackoff
+	}
+	standardOptions := func(o *retry.StandardOptions) {
+		o.MaxAttempts = opts.MaxAttempts
+		o.MaxBackoff = opts.MaxBackoff
+		o.Backoff = retry.NewExponentialJitterBackoff(opts.MaxBackoff)
+		if opts.Adaptive {
+			// The adaptive rate limit paces the retries instead of the retry quota
+			o.RateLimiter = ratelimit.None
+		}
+	}
+
+	return func() aws.Retryer {
+		if opts.Adaptive {
+			return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+				o.StandardOptions = append(o.StandardOptions, standardOptions)
+			})
+		}
+		return retry.NewStandard(standardOptions)
+	}
+}
+
+// errorCode returns the code of an AWS API error, or an empty string for other errors.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// hasErrorCode reports whether err is an AWS API error with one of the codes.
+func hasErrorCode(err error, codes []string) bool {
+	code := errorCode(err)
+	for _, wanted := range codes {
+		if code != "" && code == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// isThrottlingError reports whether the request was rejected by API rate limiting.
+func isThrottlingError(err error) bool {
+	_, ok := retry.DefaultThrottleErrorCodes[errorCode(err)]
+	return ok
+}
+
+// isEventualConsistencyError reports whether the error comes from a resource that is not visible yet.
+func isEventualConsistencyError(err error) bool {
+	return hasErrorCode(err, eventualConsistencyErrorCodes) || strings.Contains(err.Error(), instanceProfileNotPropagatedMessage)
+}
+
+// isRetryableError reports whether the call may succeed when repeated. Other errors, such as
+// missing permissions or invalid parameters, are terminal.
+func isRetryableError(err error) bool {
+	if isThrottlingError(err) || isEventualConsistencyError(err) {
+		return true
+	}
+	_, ok := retry.DefaultRetryableErrorCodes[errorCode(err)]
+	return ok
+}
+
+// retryEventualConsistency calls operation until it succeeds, fails with a terminal error
+// or the attempts run out, backing off with jitter between attempts.
+func retryEventualConsistency(description string, operation func() error) error {
+	backoff := retry.NewExponentialJitterBackoff(eventualConsistencyMaxBackoff)
+	var err error
+	for attempt := 1; attempt <= eventualConsistencyAttempts; attempt++ {
+		if err = operation(); err == nil || !isRetryableError(err) {
+			return err
+		}
+		if attempt == eventualConsistencyAttempts {
+			break
+		}
+		delay, backoffErr := backoff.BackoffDelay(attempt, err)
+		if backoffErr != nil {
+			return err
+		}
+		log.Printf("%s failed, retrying in %s: %v\n", description, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+	}
+	return fmt.Errorf("%s failed after %d attempts: %v", description, eventualConsistencyAttempts, err)
+}
@@ -0,0 +1,86 @@
+package helper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRetryer(t *testing.T) {
+	retryer := NewRetryer(RetryOptions{Adaptive: true})()
+	assert.IsType(t, &retry.AdaptiveMode{}, retryer)
+	assert.Equal(t, defaultRetryMaxAttempts, retryer.MaxAttempts())
+
+	retryer = NewRetryer(RetryOptions{MaxAttempts: 5, MaxBackoff: time.Second})()
+	assert.IsType(t, &retry.Standard{}, retryer)
+	assert.Equal(t, 5, retryer.MaxAttempts())
+	delay, err := retryer.RetryDelay(10, fmt.Errorf("Throttling"))
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, delay, time.Second)
+}
+
+func TestErrorClassification(t *testing.T) {
+	throttled := fmt.Errorf("operation error EC2: DescribeInstances, %w", apiError("RequestLimitExceeded", "Request limit exceeded."))
+	notPropagated := apiError("InvalidParameterValue", "Value (jenkins-role) for parameter iamInstanceProfile.name is invalid. Invalid IAM Instance Profile name")
+	denied := apiError("UnauthorizedOperation", "You are not authorized to perform this operation.")
+
+	assert.True(t, isThrottlingError(throttled))
+	assert.False(t, isThrottlingError(notPropagated))
+	assert.True(t, isEventualConsistencyError(notPropagated))
+	assert.True(t, isRetryableError(throttled))
+	assert.True(t, isRetryableError(notPropagated))
+	assert.False(t, isRetryableError(denied))
+
+	// Only the code counts, not a message mentioning another code
+	mentioned := apiError("InvalidParameterValue", "Throttling is not a valid value")
+	assert.False(t, isThrottlingError(mentioned))
+	assert.False(t, isRetryableError(fmt.Errorf("RequestLimitExceeded")))
+}
+
+func TestRetryEventualConsistency(t *testing.T) {
+	maxBackoff := eventualConsistencyMaxBackoff
+	eventualConsistencyMaxBackoff = time.Millisecond
+	defer func() { eventualConsistencyMaxBackoff = maxBackoff }()
+
+	t.Run("SucceedsAfterPropagation", func(t *testing.T) {
+		calls := 0
+		err := retryEventualConsistency("launching", func() error {
+			calls++
+			if calls < 3 {
+				return apiError("InvalidInstanceID.NotFound", "The instance ID does not exist")
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("TerminalError", func(t *testing.T) {
+		calls := 0
+		err := retryEventualConsistency("launching", func() error {
+			calls++
+			return apiError("UnauthorizedOperation", "denied")
+		})
+		assert.Equal(t, "api error UnauthorizedOperation: denied", err.Error())
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("AttemptsExhausted", func(t *testing.T) {
+		calls := 0
+		err := retryEventualConsistency("launching", func() error {
+			calls++
+			return apiError("InvalidGroup.NotFound", "unknown group")
+		})
+		assert.Equal(t, "launching failed after 6 attempts: api error InvalidGroup.NotFound: unknown group", err.Error())
+		assert.Equal(t, eventualConsistencyAttempts, calls)
+	})
+}
+
+// apiError returns an error like those of the SDK for an API error code without a typed error.
+func apiError(code, message string) error {
+	return &smithy.GenericAPIError{Code: code, Message: message}
+}
@@ -3,14 +3,24 @@ package helper
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
 )
 
+type secretStoreInterface interface {
+	CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+	PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error)
+}
+
+// Name of the secret holding the provisioning values
+const infraProvisionSecret = "task1/InfraProvision"
+
 var cfg aws.Config
 
 func init() {
@@ -49,7 +59,7 @@ func FetchSecrets() (string, string, string, string, string, string, error) {
 	var secretData map[string]string
 	var amiID, subnetID, iamRoleName, instanceType, mongoDbConnectionString, region string
 
-	secretValue, err := getSecret("task1/InfraProvision")
+	secretValue, err := getSecret(infraProvisionSecret)
 	if err != nil {
 		return "", "", "", "", "", "", err
 	}
@@ -94,3 +104,31 @@ func FetchSecrets() (string, string, string, string, string, string, error) {
 
 	return amiID, subnetID, iamRoleName, instanceType, mongoDbConnectionString, region, nil
 }
+
+// StoreSecret creates the secret with the value, or stores the value as its new version when the
+// secret exists. It returns the ARN of the secret.
+func StoreSecret(client secretStoreInterface, name, value, description string) (string, error) {
+	createOutput, err := client.CreateSecret(context.Background(), &secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		SecretString: aws.String(value),
+		Description:  optionalString(description),
+	})
+	if err == nil {
+		log.Printf("Created secret %s\n", name)
+		return aws.ToString(createOutput.ARN), nil
+	}
+	var exists *smtypes.ResourceExistsException
+	if !errors.As(err, &exists) {
+		return "", fmt.Errorf("failed to create secret %s: %v", name, err)
+	}
+
+	putOutput, err := client.PutSecretValue(context.Background(), &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(name),
+		SecretString: aws.String(value),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update secret %s: %v", name, err)
+	}
+	log.Printf("Stored a new version of secret %s\n", name)
+	return aws.ToString(putOutput.ARN), nil
+}
@@ -0,0 +1,80 @@
+package helper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of the secretStoreInterface for testing.
+type MockSecretStoreClient struct {
+	CreateSecretErr   error
+	PutSecretValueErr error
+
+	createInput *secretsmanager.CreateSecretInput
+	putInput    *secretsmanager.PutSecretValueInput
+}
+
+func TestStoreSecret(t *testing.T) {
+	arn := "arn:aws:secretsmanager:us-east-1:123456789012:secret:jenkins/initialAdminPassword-AbCdEf"
+
+	t.Run("Create", func(t *testing.T) {
+		client := &MockSecretStoreClient{}
+		secretARN, err := StoreSecret(client, "jenkins/initialAdminPassword", "secret", "Initial Jenkins admin password")
+		assert.NoError(t, err)
+		assert.Equal(t, arn, secretARN)
+		assert.Equal(t, "secret", aws.ToString(client.createInput.SecretString))
+		assert.Nil(t, client.putInput)
+	})
+
+	t.Run("Exists", func(t *testing.T) {
+		client := &MockSecretStoreClient{CreateSecretErr: &smtypes.ResourceExistsException{Message: aws.String("the secret already exists")}}
+		secretARN, err := StoreSecret(client, "jenkins/initialAdminPassword", "secret", "")
+		assert.NoError(t, err)
+		assert.Equal(t, arn, secretARN)
+		assert.Equal(t, "jenkins/initialAdminPassword", aws.ToString(client.putInput.SecretId))
+		assert.Equal(t, "secret", aws.ToString(client.putInput.SecretString))
+	})
+
+	t.Run("CreateError", func(t *testing.T) {
+		client := &MockSecretStoreClient{CreateSecretErr: apiError("AccessDeniedException", "denied")}
+		_, err := StoreSecret(client, "jenkins/initialAdminPassword", "secret", "")
+		assert.EqualError(t, err, "failed to create secret jenkins/initialAdminPassword: api error AccessDeniedException: denied")
+		assert.Nil(t, client.putInput)
+	})
+
+	t.Run("PutError", func(t *testing.T) {
+		client := &MockSecretStoreClient{
+			CreateSecretErr:   &smtypes.ResourceExistsException{Message: aws.String("the secret already exists")},
+			PutSecretValueErr: apiError("InvalidRequestException", "scheduled for deletion"),
+		}
+		_, err := StoreSecret(client, "jenkins/initialAdminPassword", "secret", "")
+		assert.EqualError(t, err, "failed to update secret jenkins/initialAdminPassword: api error InvalidRequestException: scheduled for deletion")
+	})
+}
+
+func (client *MockSecretStoreClient) CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error) {
+	client.createInput = params
+	if client.CreateSecretErr != nil {
+		return nil, client.CreateSecretErr
+	}
+	return &secretsmanager.CreateSecretOutput{
+		ARN:  aws.String("arn:aws:secretsmanager:us-east-1:123456789012:secret:" + aws.ToString(params.Name) + "-AbCdEf"),
+		Name: params.Name,
+	}, nil
+}
+
+func (client *MockSecretStoreClient) PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error) {
+	client.putInput = params
+	if client.PutSecretValueErr != nil {
+		return nil, client.PutSecretValueErr
+	}
+	return &secretsmanager.PutSecretValueOutput{
+		ARN:  aws.String("arn:aws:secretsmanager:us-east-1:123456789012:secret:" + aws.ToString(params.SecretId) + "-AbCdEf"),
+		Name: params.SecretId,
+	}, nil
+}
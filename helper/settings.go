@@ -0,0 +1,334 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings holds the optional provisioning values read from the InfraProvision secret.
+// Keys missing from the secret keep their zero value.
+type Settings struct {
+	IAMRole       IAMRoleOptions
+	SkipPreflight bool
+
+	AMIOwners         []string          // account IDs allowed to own the resolved AMI
+	OSFamily          OSFamily          // detected from the AMI when empty
+	UserDataTemplates []string          // template files rendered into the user data, in order
+	UserDataVars      map[string]string // variables available to the user data templates
+	InstallRecipe     string            // recipe file replacing the built-in install recipe
+	SSMDocumentName   string            // run the recipe as this managed SSM document instead of raw shell
+	SSMOutput         SSMOutputOptions  // where the full output of the SSM commands is kept
+	BlockDevices      BlockDeviceOptions
+
+	AdminPasswordSecretName string // secret the initial Jenkins admin password is stored in
+	JenkinsConfig           JenkinsConfigOptions
+
+	LaunchTemplateName    string // launch from this template, created or updated from the settings
+	LaunchTemplateVersion string // pin the launch to this version instead of updating the template
+
+	Spot                  *SpotOptions // nil unless useSpot is set
+	FallbackInstanceTypes []string
+
+	InstanceCount int32            // instances to launch, one by default
+	SubnetIDs     []string         // subnets the instances are spread over, the subnetId secret when empty
+	ElasticIP     bool             // associate an Elastic IP with every instance
+	DNSRecord     DNSRecordOptions // no record is managed when the name is empty
+
+	MaxConcurrency int // instances launched and bootstrapped at the same time
+	Retry          RetryOptions
+	Waits          WaitOptions // waiter timeouts, the defaults when zero
+
+	RunOutputFile string // JSON report of the run
+}
+
+// Fetches the optional settings from Secrets Manager
+func FetchSettings() (Settings, error) {
+	secretValue, err := getSecret(infraProvisionSecret)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	var secretData map[string]string
+	if err := json.Unmarshal([]byte(secretValue), &secretData); err != nil {
+		return Settings{}, fmt.Errorf("error parsing secret string: %v", err)
+	}
+	return parseSettings(secretData)
+}
+
+func parseSettings(secretData map[string]string) (Settings, error) {
+	var settings Settings
+	var err error
+
+	settings.IAMRole.PermissionsBoundary = secretData["permissionsBoundaryArn"]
+	settings.IAMRole.Path = secretData["iamRolePath"]
+	settings.IAMRole.Description = secretData["iamRoleDescription"]
+	if settings.IAMRole.MaxSessionDuration, err = parseInt32(secretData, "iamRoleMaxSessionDuration"); err != nil {
+		return Settings{}, err
+	}
+	if settings.SkipPreflight, err = parseBool(secretData, "skipPreflight"); err != nil {
+		return Settings{}, err
+	}
+
+	settings.AMIOwners = parseList(secretData, "amiOwners")
+	settings.OSFamily = OSFamily(secretData["osFamily"])
+	if settings.OSFamily != "" {
+		if _, err := GetBootstrapProfile(settings.OSFamily); err != nil {
+			return Settings{}, fmt.Errorf("invalid osFamily in secret data: %v", err)
+		}
+	}
+	settings.UserDataTemplates = parseList(secretData, "userDataTemplates")
+	if settings.UserDataVars, err = parseMap(secretData, "userDataVars"); err != nil {
+		return Settings{}, err
+	}
+	settings.InstallRecipe = secretData["installRecipe"]
+	settings.SSMDocumentName = secretData["ssmDocumentName"]
+	settings.SSMOutput = SSMOutputOptions{
+		S3Bucket:    secretData["ssmOutputS3Bucket"],
+		S3KeyPrefix: secretData["ssmOutputS3KeyPrefix"],
+		LogGroup:    secretData["ssmOutputLogGroup"],
+		Dir:         secretData["ssmOutputDir"],
+	}
+
+	settings.AdminPasswordSecretName = secretData["adminPasswordSecretName"]
+	if settings.AdminPasswordSecretName == "" {
+		settings.AdminPasswordSecretName = defaultAdminPasswordSecretName
+	}
+	settings.JenkinsConfig = JenkinsConfigOptions{
+		Plugins:         parseList(secretData, "jenkinsPlugins"),
+		AdminSecretName: secretData["jenkinsAdminSecretName"],
+		CascFile:        secretData["jenkinsCascFile"],
+	}
+
+	if settings.BlockDevices, err = parseBlockDevices(secretData); err != nil {
+		return Settings{}, err
+	}
+
+	settings.LaunchTemplateName = secretData["launchTemplateName"]
+	settings.LaunchTemplateVersion = secretData["launchTemplateVersion"]
+	if settings.LaunchTemplateVersion != "" && settings.LaunchTemplateName == "" {
+		return Settings{}, fmt.Errorf("launchTemplateVersion in secret data requires launchTemplateName")
+	}
+
+	useSpot, err := parseBool(secretData, "useSpot")
+	if err != nil {
+		return Settings{}, err
+	}
+	if useSpot {
+		settings.Spot = &SpotOptions{
+			MaxPrice:             secretData["spotMaxPrice"],
+			InterruptionBehavior: secretData["spotInterruptionBehavior"],
+		}
+		switch settings.Spot.InterruptionBehavior {
+		case "", "terminate", "stop", "hibernate":
+		default:
+			return Settings{}, fmt.Errorf("invalid spotInterruptionBehavior in secret data: %s", settings.Spot.InterruptionBehavior)
+		}
+		if settings.Spot.FallbackToOnDemand, err = parseBool(secretData, "spotFallbackToOnDemand"); err != nil {
+			return Settings{}, err
+		}
+	}
+	settings.FallbackInstanceTypes = parseList(secretData, "fallbackInstanceTypes")
+
+	if settings.InstanceCount, err = parseInt32(secretData, "instanceCount"); err != nil {
+		return Settings{}, err
+	}
+	if secretData["instanceCount"] != "" && settings.InstanceCount < 1 {
+		return Settings{}, fmt.Errorf("invalid instanceCount in secret data: must be at least 1")
+	}
+	if settings.InstanceCount == 0 {
+		settings.InstanceCount = 1
+	}
+	settings.SubnetIDs = parseList(secretData, "subnetIds")
+	if settings.ElasticIP, err = parseBool(secretData, "elasticIp"); err != nil {
+		return Settings{}, err
+	}
+	if settings.DNSRecord, err = parseDNSRecord(secretData); err != nil {
+		return Settings{}, err
+	}
+
+	maxConcurrency, err := parseInt32(secretData, "maxConcurrency")
+	if err != nil {
+		return Settings{}, err
+	}
+	if maxConcurrency < 0 {
+		return Settings{}, fmt.Errorf("invalid maxConcurrency in secret data: must be positive")
+	}
+	settings.MaxConcurrency = int(maxConcurrency)
+	if settings.MaxConcurrency == 0 {
+		settings.MaxConcurrency = defaultMaxConcurrency
+	}
+
+	if settings.Retry, err = parseRetryOptions(secretData); err != nil {
+		return Settings{}, err
+	}
+	timeouts := map[string]*time.Duration{
+		"instanceRunningTimeoutSeconds": &settings.Waits.InstanceRunningTimeout,
+		"statusChecksTimeoutSeconds":    &settings.Waits.StatusChecksTimeout,
+		"ssmAgentTimeoutSeconds":        &settings.Waits.SSMAgentTimeout,
+		"ssmCommandTimeoutSeconds":      &settings.Waits.SSMCommandTimeout,
+		"jenkinsTimeoutSeconds":         &settings.Waits.JenkinsTimeout,
+	}
+	for key, timeout := range timeouts {
+		seconds, err := parseInt32(secretData, key)
+		if err != nil {
+			return Settings{}, err
+		}
+		if seconds < 0 {
+			return Settings{}, fmt.Errorf("invalid %s in secret data: must be positive", key)
+		}
+		*timeout = time.Duration(seconds) * time.Second
+	}
+
+	settings.RunOutputFile = secretData["runOutputFile"]
+	if settings.RunOutputFile == "" {
+		settings.RunOutputFile = "run-output.json"
+	}
+
+	return settings, nil
+}
+
+func parseBlockDevices(secretData map[string]string) (BlockDeviceOptions, error) {
+	var blockDevices BlockDeviceOptions
+	var err error
+
+	root := &blockDevices.Root
+	root.VolumeType = secretData["rootVolumeType"]
+	root.KMSKeyID = secretData["rootVolumeKmsKeyId"]
+	if root.SizeGiB, err = parseInt32(secretData, "rootVolumeSize"); err != nil {
+		return BlockDeviceOptions{}, err
+	}
+	if root.IOPS, err = parseInt32(secretData, "rootVolumeIops"); err != nil {
+		return BlockDeviceOptions{}, err
+	}
+	if root.Throughput, err = parseInt32(secretData, "rootVolumeThroughput"); err != nil {
+		return BlockDeviceOptions{}, err
+	}
+	if root.Encrypted, err = parseBool(secretData, "rootVolumeEncrypted"); err != nil {
+		return BlockDeviceOptions{}, err
+	}
+
+	for _, spec := range parseList(secretData, "dataVolumes") {
+		volume, err := ParseVolumeSpec(spec)
+		if err != nil {
+			return BlockDeviceOptions{}, fmt.Errorf("invalid dataVolumes in secret data: %v", err)
+		}
+		blockDevices.DataVolumes = append(blockDevices.DataVolumes, volume)
+	}
+
+	// ebsEncrypted and ebsKmsKeyId apply to every volume without its own setting
+	encryptAll, err := parseBool(secretData, "ebsEncrypted")
+	if err != nil {
+		return BlockDeviceOptions{}, err
+	}
+	kmsKeyID := secretData["ebsKmsKeyId"]
+	volumes := []*VolumeOptions{root}
+	for i := range blockDevices.DataVolumes {
+		volumes = append(volumes, &blockDevices.DataVolumes[i])
+	}
+	for _, volume := range volumes {
+		volume.Encrypted = volume.Encrypted || encryptAll
+		if volume.KMSKeyID == "" {
+			volume.KMSKeyID = kmsKeyID
+		}
+	}
+	return blockDevices, nil
+}
+
+func parseDNSRecord(secretData map[string]string) (DNSRecordOptions, error) {
+	dnsRecord := DNSRecordOptions{
+		Name:         secretData["dnsRecordName"],
+		HostedZoneID: secretData["dnsHostedZoneId"],
+		RecordType:   strings.ToUpper(secretData["dnsRecordType"]),
+	}
+	switch dnsRecord.RecordType {
+	case "", "A", "CNAME":
+	default:
+		return DNSRecordOptions{}, fmt.Errorf("invalid dnsRecordType in secret data: %s", secretData["dnsRecordType"])
+	}
+	ttl, err := parseInt32(secretData, "dnsRecordTtl")
+	if err != nil {
+		return DNSRecordOptions{}, err
+	}
+	dnsRecord.TTL = int64(ttl)
+	if dnsRecord.Name == "" && (dnsRecord.HostedZoneID != "" || dnsRecord.RecordType != "" || ttl != 0) {
+		return DNSRecordOptions{}, fmt.Errorf("dnsRecordName is required for the DNS record settings in secret data")
+	}
+	return dnsRecord, nil
+}
+
+func parseRetryOptions(secretData map[string]string) (RetryOptions, error) {
+	var retryOptions RetryOptions
+	maxAttempts, err := parseInt32(secretData, "retryMaxAttempts")
+	if err != nil {
+		return RetryOptions{}, err
+	}
+	maxBackoffSeconds, err := parseInt32(secretData, "retryMaxBackoffSeconds")
+	if err != nil {
+		return RetryOptions{}, err
+	}
+	if maxAttempts < 0 || maxBackoffSeconds < 0 {
+		return RetryOptions{}, fmt.Errorf("invalid retry settings in secret data: must be positive")
+	}
+	retryOptions.MaxAttempts = int(maxAttempts)
+	retryOptions.MaxBackoff = time.Duration(maxBackoffSeconds) * time.Second
+
+	switch secretData["retryMode"] {
+	case "", "adaptive":
+		retryOptions.Adaptive = true
+	case "standard":
+	default:
+		return RetryOptions{}, fmt.Errorf("invalid retryMode in secret data: %s", secretData["retryMode"])
+	}
+	return retryOptions, nil
+}
+
+func parseInt32(secretData map[string]string, key string) (int32, error) {
+	value, ok := secretData[key]
+	if !ok || value == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s in secret data: %v", key, err)
+	}
+	return int32(parsed), nil
+}
+
+func parseBool(secretData map[string]string, key string) (bool, error) {
+	value, ok := secretData[key]
+	if !ok || value == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s in secret data: %v", key, err)
+	}
+	return parsed, nil
+}
+
+// parseList reads a comma-separated value, ignoring empty entries.
+func parseList(secretData map[string]string, key string) []string {
+	var list []string
+	for _, item := range strings.Split(secretData[key], ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseMap reads a comma-separated list of key=value pairs.
+func parseMap(secretData map[string]string, key string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, item := range parseList(secretData, key) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid %s in secret data: expected key=value, got %q", key, item)
+		}
+		values[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return values, nil
+}
@@ -0,0 +1,226 @@
+package helper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSettings(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{})
+		assert.NoError(t, err)
+		assert.Equal(t, IAMRoleOptions{}, settings.IAMRole)
+		assert.Equal(t, "run-output.json", settings.RunOutputFile)
+		assert.Equal(t, int32(1), settings.InstanceCount)
+		assert.Equal(t, defaultMaxConcurrency, settings.MaxConcurrency)
+		assert.Equal(t, RetryOptions{Adaptive: true}, settings.Retry)
+		assert.Equal(t, "jenkins/initialAdminPassword", settings.AdminPasswordSecretName)
+	})
+
+	t.Run("JenkinsConfig", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"jenkinsPlugins":         "git, docker-workflow",
+			"jenkinsAdminSecretName": "jenkins/admin",
+			"jenkinsCascFile":        "jenkins/casc.yaml",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, JenkinsConfigOptions{
+			Plugins:         []string{"git", "docker-workflow"},
+			AdminSecretName: "jenkins/admin",
+			CascFile:        "jenkins/casc.yaml",
+		}, settings.JenkinsConfig)
+		assert.True(t, settings.JenkinsConfig.Enabled())
+	})
+
+	t.Run("IAMRoleOptions", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"permissionsBoundaryArn":    "arn:aws:iam::123456789012:policy/boundary",
+			"iamRolePath":               "/automation/",
+			"iamRoleMaxSessionDuration": "7200",
+			"iamRoleDescription":        "Jenkins host role",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, IAMRoleOptions{
+			PermissionsBoundary: "arn:aws:iam::123456789012:policy/boundary",
+			Path:                "/automation/",
+			MaxSessionDuration:  7200,
+			Description:         "Jenkins host role",
+		}, settings.IAMRole)
+	})
+
+	t.Run("InvalidMaxSessionDuration", func(t *testing.T) {
+		_, err := parseSettings(map[string]string{"iamRoleMaxSessionDuration": "two hours"})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid iamRoleMaxSessionDuration in secret data")
+	})
+
+	t.Run("SkipPreflight", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{"skipPreflight": "true"})
+		assert.NoError(t, err)
+		assert.True(t, settings.SkipPreflight)
+
+		_, err = parseSettings(map[string]string{"skipPreflight": "sometimes"})
+		assert.Error(t, err)
+	})
+
+	t.Run("UserData", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"userDataTemplates": "bootstrap/cloud-config.yaml, bootstrap/jenkins.sh.tmpl",
+			"userDataVars":      "jenkinsPort=8080, user = ubuntu",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"bootstrap/cloud-config.yaml", "bootstrap/jenkins.sh.tmpl"}, settings.UserDataTemplates)
+		assert.Equal(t, map[string]string{"jenkinsPort": "8080", "user": "ubuntu"}, settings.UserDataVars)
+
+		_, err = parseSettings(map[string]string{"userDataVars": "jenkinsPort"})
+		assert.Error(t, err)
+	})
+
+	t.Run("OSFamily", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{"osFamily": "rhel"})
+		assert.NoError(t, err)
+		assert.Equal(t, OSFamilyRHEL, settings.OSFamily)
+
+		_, err = parseSettings(map[string]string{"osFamily": "windows"})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid osFamily in secret data")
+	})
+
+	t.Run("AMIOwners", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{"amiOwners": "099720109477,137112412989"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"099720109477", "137112412989"}, settings.AMIOwners)
+	})
+
+	t.Run("BlockDevices", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"rootVolumeSize":       "40",
+			"rootVolumeType":       "gp3",
+			"rootVolumeIops":       "3000",
+			"rootVolumeThroughput": "125",
+			"rootVolumeEncrypted":  "true",
+			"rootVolumeKmsKeyId":   "alias/ebs",
+			"dataVolumes":          "100:gp3, 50:io2:3000",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, VolumeOptions{SizeGiB: 40, VolumeType: "gp3", IOPS: 3000, Throughput: 125, Encrypted: true, KMSKeyID: "alias/ebs"}, settings.BlockDevices.Root)
+		assert.Equal(t, []VolumeOptions{{SizeGiB: 100, VolumeType: "gp3"}, {SizeGiB: 50, VolumeType: "io2", IOPS: 3000}}, settings.BlockDevices.DataVolumes)
+
+		_, err = parseSettings(map[string]string{"dataVolumes": "large"})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid dataVolumes in secret data")
+	})
+
+	t.Run("EBSEncryptionDefaults", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"ebsEncrypted":       "true",
+			"ebsKmsKeyId":        "alias/ebs",
+			"rootVolumeKmsKeyId": "alias/root",
+			"dataVolumes":        "100:gp3,@snap-0123456789abcdef0",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, VolumeOptions{Encrypted: true, KMSKeyID: "alias/root"}, settings.BlockDevices.Root)
+		assert.Equal(t, []VolumeOptions{
+			{SizeGiB: 100, VolumeType: "gp3", Encrypted: true, KMSKeyID: "alias/ebs"},
+			{SnapshotID: "snap-0123456789abcdef0", Encrypted: true, KMSKeyID: "alias/ebs"},
+		}, settings.BlockDevices.DataVolumes)
+	})
+
+	t.Run("LaunchTemplate", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{"launchTemplateName": "jenkins", "launchTemplateVersion": "3"})
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins", settings.LaunchTemplateName)
+		assert.Equal(t, "3", settings.LaunchTemplateVersion)
+
+		_, err = parseSettings(map[string]string{"launchTemplateVersion": "3"})
+		assert.Error(t, err)
+	})
+
+	t.Run("Spot", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{})
+		assert.NoError(t, err)
+		assert.Nil(t, settings.Spot)
+
+		settings, err = parseSettings(map[string]string{
+			"useSpot":                  "true",
+			"spotMaxPrice":             "0.05",
+			"spotInterruptionBehavior": "stop",
+			"spotFallbackToOnDemand":   "true",
+			"fallbackInstanceTypes":    "t3a.medium,m5.large",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, &SpotOptions{MaxPrice: "0.05", InterruptionBehavior: "stop", FallbackToOnDemand: true}, settings.Spot)
+		assert.Equal(t, []string{"t3a.medium", "m5.large"}, settings.FallbackInstanceTypes)
+
+		_, err = parseSettings(map[string]string{"useSpot": "true", "spotInterruptionBehavior": "pause"})
+		assert.Error(t, err)
+	})
+	t.Run("MultipleInstances", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"instanceCount": "5",
+			"subnetIds":     "subnet-a, subnet-b",
+			"elasticIp":     "true",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(5), settings.InstanceCount)
+		assert.Equal(t, []string{"subnet-a", "subnet-b"}, settings.SubnetIDs)
+		assert.True(t, settings.ElasticIP)
+
+		_, err = parseSettings(map[string]string{"instanceCount": "0"})
+		assert.Error(t, err)
+	})
+
+	t.Run("MaxConcurrency", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{"maxConcurrency": "10"})
+		assert.NoError(t, err)
+		assert.Equal(t, 10, settings.MaxConcurrency)
+
+		_, err = parseSettings(map[string]string{"maxConcurrency": "-1"})
+		assert.Error(t, err)
+	})
+	t.Run("Retry", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"retryMaxAttempts":       "12",
+			"retryMaxBackoffSeconds": "60",
+			"retryMode":              "standard",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, RetryOptions{MaxAttempts: 12, MaxBackoff: time.Minute}, settings.Retry)
+
+		_, err = parseSettings(map[string]string{"retryMode": "legacy"})
+		assert.Error(t, err)
+	})
+	t.Run("WaiterTimeouts", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"instanceRunningTimeoutSeconds": "600",
+			"ssmAgentTimeoutSeconds":        "120",
+			"ssmCommandTimeoutSeconds":      "1800",
+			"jenkinsTimeoutSeconds":         "900",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 10*time.Minute, settings.Waits.InstanceRunningTimeout)
+		assert.Equal(t, time.Duration(0), settings.Waits.StatusChecksTimeout)
+		assert.Equal(t, 2*time.Minute, settings.Waits.SSMAgentTimeout)
+		assert.Equal(t, 30*time.Minute, settings.Waits.SSMCommandTimeout)
+		assert.Equal(t, 15*time.Minute, settings.Waits.JenkinsTimeout)
+
+		_, err = parseSettings(map[string]string{"statusChecksTimeoutSeconds": "-5"})
+		assert.Error(t, err)
+	})
+	t.Run("DNSRecord", func(t *testing.T) {
+		settings, err := parseSettings(map[string]string{
+			"dnsRecordName": "jenkins.example.com",
+			"dnsRecordType": "cname",
+			"dnsRecordTtl":  "60",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, DNSRecordOptions{Name: "jenkins.example.com", RecordType: "CNAME", TTL: 60}, settings.DNSRecord)
+
+		_, err = parseSettings(map[string]string{"dnsRecordName": "jenkins.example.com", "dnsRecordType": "AAAA"})
+		assert.Error(t, err)
+		_, err = parseSettings(map[string]string{"dnsHostedZoneId": "Z123456"})
+		assert.Error(t, err)
+	})
+}
@@ -29,6 +29,36 @@ type securitygroupInterface interface {
 	AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
 }
 
+type subnetInterface interface {
+	DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error)
+}
+
+// CheckSubnetsVPC returns the VPC of the subnets. The security group is created in the VPC of
+// the first subnet, so subnets of different VPCs are an error before anything is created.
+func CheckSubnetsVPC(client subnetInterface, subnetIDs []string) (string, error) {
+	subnetResult, err := client.DescribeSubnets(context.Background(), &ec2.DescribeSubnetsInput{
+		SubnetIds: subnetIDs,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe subnets: %v", err)
+	}
+	subnetVPCs := map[string]string{}
+	for _, subnet := range subnetResult.Subnets {
+		subnetVPCs[aws.ToString(subnet.SubnetId)] = aws.ToString(subnet.VpcId)
+	}
+	vpcID := subnetVPCs[subnetIDs[0]]
+	var others []string
+	for _, subnetID := range subnetIDs[1:] {
+		if subnetVPCs[subnetID] != vpcID {
+			others = append(others, fmt.Sprintf("%s in %s", subnetID, subnetVPCs[subnetID]))
+		}
+	}
+	if len(others) > 0 {
+		return "", fmt.Errorf("subnets must be in one VPC, %s is in %s but %s", subnetIDs[0], vpcID, strings.Join(others, ", "))
+	}
+	return vpcID, nil
+}
+
 // CreateSecurityGroup creates a security group or returns the default security group if specified.
 func CreateSecurityGroup(client securitygroupInterface, subnetID string, useDefault bool) (string, error) {
 	// Retrieve VPC ID from the subnet
@@ -18,6 +18,7 @@ type MockSecurityGroupClient struct {
 	DescribeSecurityGroupsErr        error
 	CreateSecurityGroupErr           error
 	AuthorizeSecurityGroupIngressErr error
+	SubnetVPCs                       map[string]string // VPC of each subnet, vpc-123456 when nil
 }
 
 func TestCreateSecurityGroup(t *testing.T) {
@@ -92,10 +93,38 @@ func TestCreateSecurityGroup(t *testing.T) {
 
 // Implementing the securitygroupInterface for MockSecurityGroupClient
 
+func TestCheckSubnetsVPC(t *testing.T) {
+	t.Run("SameVPC", func(t *testing.T) {
+		client := &MockSecurityGroupClient{SubnetVPCs: map[string]string{"subnet-a": "vpc-1", "subnet-b": "vpc-1"}}
+		vpcID, err := CheckSubnetsVPC(client, []string{"subnet-a", "subnet-b"})
+		assert.NoError(t, err)
+		assert.Equal(t, "vpc-1", vpcID)
+	})
+
+	t.Run("DifferentVPCs", func(t *testing.T) {
+		client := &MockSecurityGroupClient{SubnetVPCs: map[string]string{"subnet-a": "vpc-1", "subnet-b": "vpc-1", "subnet-c": "vpc-2"}}
+		_, err := CheckSubnetsVPC(client, []string{"subnet-a", "subnet-b", "subnet-c"})
+		assert.EqualError(t, err, "subnets must be in one VPC, subnet-a is in vpc-1 but subnet-c in vpc-2")
+	})
+
+	t.Run("DescribeSubnetsError", func(t *testing.T) {
+		client := &MockSecurityGroupClient{DescribeSubnetsErr: apiError("InvalidSubnetID.NotFound", "The subnet ID 'subnet-x' does not exist")}
+		_, err := CheckSubnetsVPC(client, []string{"subnet-a", "subnet-x"})
+		assert.EqualError(t, err, "failed to describe subnets: api error InvalidSubnetID.NotFound: The subnet ID 'subnet-x' does not exist")
+	})
+}
+
 func (client *MockSecurityGroupClient) DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
 	if client.DescribeSubnetsErr != nil {
 		return nil, client.DescribeSubnetsErr
 	}
+	if client.SubnetVPCs != nil {
+		output := &ec2.DescribeSubnetsOutput{}
+		for _, subnetID := range params.SubnetIds {
+			output.Subnets = append(output.Subnets, types.Subnet{SubnetId: aws.String(subnetID), VpcId: aws.String(client.SubnetVPCs[subnetID])})
+		}
+		return output, nil
+	}
 	return &ec2.DescribeSubnetsOutput{
 		Subnets: []types.Subnet{
 			{
@@ -0,0 +1,288 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+type ssmDocumentInterface interface {
+	GetDocument(ctx context.Context, params *ssm.GetDocumentInput, optFns ...func(*ssm.Options)) (*ssm.GetDocumentOutput, error)
+	CreateDocument(ctx context.Context, params *ssm.CreateDocumentInput, optFns ...func(*ssm.Options)) (*ssm.CreateDocumentOutput, error)
+	UpdateDocument(ctx context.Context, params *ssm.UpdateDocumentInput, optFns ...func(*ssm.Options)) (*ssm.UpdateDocumentOutput, error)
+	UpdateDocumentDefaultVersion(ctx context.Context, params *ssm.UpdateDocumentDefaultVersionInput, optFns ...func(*ssm.Options)) (*ssm.UpdateDocumentDefaultVersionOutput, error)
+	ListDocumentVersions(ctx context.Context, params *ssm.ListDocumentVersionsInput, optFns ...func(*ssm.Options)) (*ssm.ListDocumentVersionsOutput, error)
+}
+
+// SSMDocumentResult identifies the document version used to install Jenkins.
+type SSMDocumentResult struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Created bool   `json:"created"` // whether this run created the version
+}
+
+// commandDocument is an SSM Command document of schema version 2.2.
+type commandDocument struct {
+	SchemaVersion string                       `json:"schemaVersion"`
+	Description   string                       `json:"description"`
+	Parameters    map[string]documentParameter `json:"parameters,omitempty"`
+	MainSteps     []documentStep               `json:"mainSteps"`
+}
+
+type documentParameter struct {
+	Type           string `json:"type"`
+	Default        string `json:"default"`
+	Description    string `json:"description"`
+	AllowedPattern string `json:"allowedPattern"`
+}
+
+type documentStep struct {
+	Action    string             `json:"action"`
+	Name      string             `json:"name"`
+	OnFailure string             `json:"onFailure"`
+	Inputs    documentStepInputs `json:"inputs"`
+}
+
+type documentStepInputs struct {
+	TimeoutSeconds int      `json:"timeoutSeconds"`
+	RunCommand     []string `json:"runCommand"`
+}
+
+var invalidDocumentStepName = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// documentStepName converts a recipe step name into a valid document step name.
+func documentStepName(name string) string {
+	return invalidDocumentStepName.ReplaceAllString(name, "-")
+}
+
+// BuildCommandDocument converts the recipe into the content of a schema 2.2 Command document.
+// Every recipe step becomes an aws:runShellScript step that stops the document when it fails,
+// and every environment variable a parameter defaulting to its recipe value.
+func BuildCommandDocument(recipe Recipe, waits WaitOptions) (string, error) {
+	waits = waits.withDefaults()
+	document := commandDocument{
+		SchemaVersion: "2.2",
+		Description:   recipe.Description,
+		Parameters:    map[string]documentParameter{},
+	}
+	if document.Description == "" {
+		document.Description = "Runs the " + recipe.Name + " recipe"
+	}
+
+	var names []string
+	for name := range recipe.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var exports []string
+	for _, name := range names {
+		document.Parameters[name] = documentParameter{
+			Type:        "String",
+			Default:     recipe.Environment[name],
+			Description: "Exported as " + name + " at the start of every step",
+			// The value is substituted inside single quotes
+			AllowedPattern: "^[^']*$",
+		}
+		exports = append(exports, fmt.Sprintf("export %s='{{ %s }}'", name, name))
+	}
+
+	seen := map[string]string{}
+	for _, step := range recipe.Steps {
+		name := documentStepName(step.Name)
+		if other, ok := seen[name]; ok {
+			return "", fmt.Errorf("steps %q and %q have the same document step name %s", other, step.Name, name)
+		}
+		seen[name] = step.Name
+		for _, command := range step.Commands {
+			if strings.Contains(command, "{{") {
+				return "", fmt.Errorf("step %q: %q contains {{, which SSM documents read as a parameter", step.Name, command)
+			}
+		}
+
+		runCommand := append([]string{"set -e"}, exports...)
+		document.MainSteps = append(document.MainSteps, documentStep{
+			Action:    "aws:runShellScript",
+			Name:      name,
+			OnFailure: "exit",
+			Inputs: documentStepInputs{
+				TimeoutSeconds: int(waits.SSMCommandTimeout.Seconds()),
+				RunCommand:     append(runCommand, step.Commands...),
+			},
+		})
+	}
+
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode SSM document: %v", err)
+	}
+	return string(content), nil
+}
+
+// EnsureSSMDocument creates the Command document, or a new default version of it when the content
+// differs from the latest version. Content matching an earlier version reuses that version.
+func EnsureSSMDocument(client ssmDocumentInterface, name, content string) (*SSMDocumentResult, error) {
+	result := &SSMDocumentResult{Name: name}
+	latest, err := client.GetDocument(context.Background(), &ssm.GetDocumentInput{
+		Name:            aws.String(name),
+		DocumentVersion: aws.String("$LATEST"),
+	})
+	var notFound *ssmtypes.InvalidDocument
+	if err != nil && !errors.As(err, &notFound) {
+		return nil, fmt.Errorf("failed to get SSM document %s: %v", name, err)
+	}
+
+	if err != nil {
+		createOutput, err := client.CreateDocument(context.Background(), &ssm.CreateDocumentInput{
+			Name:           aws.String(name),
+			Content:        aws.String(content),
+			DocumentType:   ssmtypes.DocumentTypeCommand,
+			DocumentFormat: ssmtypes.DocumentFormatJson,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SSM document %s: %v", name, err)
+		}
+		result.Version = aws.ToString(createOutput.DocumentDescription.DocumentVersion)
+		result.Created = true
+		log.Printf("Created SSM document %s version %s\n", name, result.Version)
+		return result, nil
+	}
+
+	if sameDocumentContent(aws.ToString(latest.Content), content) {
+		result.Version = aws.ToString(latest.DocumentVersion)
+		log.Printf("SSM document %s version %s is up to date\n", name, result.Version)
+		return result, nil
+	}
+
+	var duplicate *ssmtypes.DuplicateDocumentContent
+	updateOutput, err := client.UpdateDocument(context.Background(), &ssm.UpdateDocumentInput{
+		Name:            aws.String(name),
+		Content:         aws.String(content),
+		DocumentVersion: aws.String("$LATEST"),
+		DocumentFormat:  ssmtypes.DocumentFormatJson,
+	})
+	switch {
+	case errors.As(err, &duplicate):
+		if result.Version, err = findDocumentVersion(client, name, content); err != nil {
+			return nil, err
+		}
+		log.Printf("SSM document %s already has the content as version %s\n", name, result.Version)
+	case err != nil:
+		return nil, fmt.Errorf("failed to update SSM document %s: %v", name, err)
+	default:
+		result.Version = aws.ToString(updateOutput.DocumentDescription.DocumentVersion)
+		result.Created = true
+		log.Printf("Created SSM document %s version %s\n", name, result.Version)
+	}
+
+	_, err = client.UpdateDocumentDefaultVersion(context.Background(), &ssm.UpdateDocumentDefaultVersionInput{
+		Name:            aws.String(name),
+		DocumentVersion: aws.String(result.Version),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set default version of SSM document %s: %v", name, err)
+	}
+	return result, nil
+}
+
+// findDocumentVersion returns the version of the document with the given content.
+func findDocumentVersion(client ssmDocumentInterface, name, content string) (string, error) {
+	paginator := ssm.NewListDocumentVersionsPaginator(client, &ssm.ListDocumentVersionsInput{Name: aws.String(name)})
+	for paginator.HasMorePages() {
+		versionsOutput, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return "", fmt.Errorf("failed to list versions of SSM document %s: %v", name, err)
+		}
+		for _, version := range versionsOutput.DocumentVersions {
+			documentOutput, err := client.GetDocument(context.Background(), &ssm.GetDocumentInput{
+				Name:            aws.String(name),
+				DocumentVersion: version.DocumentVersion,
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to get SSM document %s: %v", name, err)
+			}
+			if sameDocumentContent(aws.ToString(documentOutput.Content), content) {
+				return aws.ToString(version.DocumentVersion), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no version of SSM document %s has the content", name)
+}
+
+// sameDocumentContent compares two JSON documents regardless of formatting.
+func sameDocumentContent(a, b string) bool {
+	var decodedA, decodedB interface{}
+	if json.Unmarshal([]byte(a), &decodedA) != nil || json.Unmarshal([]byte(b), &decodedB) != nil {
+		return a == b
+	}
+	return reflect.DeepEqual(decodedA, decodedB)
+}
+
+// RunSSMDocument runs the document version on the instance and reports the result of every
+// document step. The document stops at its first failed step; the steps after it are reported
+// as skipped. The results are returned also on failure. The full output of every step is
+// printed and, with commandOutput set, stored locally.
+func RunSSMDocument(client ssmCommandInterface, instanceID string, document *SSMDocumentResult, recipe Recipe, waits WaitOptions, commandOutput *SSMOutput) ([]StepResult, error) {
+	waits = waits.withDefaults()
+	started := time.Now()
+	input := &ssm.SendCommandInput{
+		InstanceIds:     []string{instanceID},
+		DocumentName:    aws.String(document.Name),
+		DocumentVersion: aws.String(document.Version),
+	}
+	commandOutput.configure(input)
+	output, err := sendSSMCommand(client, input)
+	if err != nil {
+		return nil, err
+	}
+	commandID := aws.ToString(output.Command.CommandId)
+	log.Printf("Running SSM document %s version %s on %s, command ID %s\n", document.Name, document.Version, instanceID, commandID)
+
+	// Every document step has the command timeout of its own
+	total := waits
+	total.SSMCommandTimeout *= time.Duration(len(recipe.Steps))
+	waitErr := waitForSSMCommandCompletion(client, commandID, instanceID, total)
+
+	var results []StepResult
+	var stepErr error
+	for i, step := range recipe.Steps {
+		if stepErr != nil {
+			results = append(results, StepResult{Name: step.Name, CommandID: commandID, Status: stepStatusSkipped, ExitCode: -1})
+			continue
+		}
+		result, err := describeCommandInvocation(client, commandID, instanceID, documentStepName(step.Name))
+		result.Name = step.Name
+		if err == nil {
+			stdout, stderr, outputErr := commandOutput.collect(instanceID, documentStepName(step.Name), stepOutputFile(i, step.Name), &result)
+			if outputErr != nil {
+				log.Printf("Unable to collect the output of step %q on %s: %v\n", step.Name, instanceID, outputErr)
+			}
+			logStepOutput(instanceID, step.Name, stdout, stderr)
+		}
+		results = append(results, result)
+		switch {
+		case err != nil:
+			stepErr = stepError(result, err)
+		case result.Status != string(ssmtypes.CommandInvocationStatusSuccess) && waitErr != nil:
+			stepErr = stepError(result, waitErr)
+		case result.Status != string(ssmtypes.CommandInvocationStatusSuccess):
+			stepErr = stepError(result, fmt.Errorf("status %s", result.Status))
+		}
+	}
+	log.Printf("SSM document %s on %s finished in %.1fs\n", document.Name, instanceID, time.Since(started).Seconds())
+
+	if stepErr != nil {
+		return results, stepErr
+	}
+	return results, waitErr
+}
@@ -0,0 +1,216 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of ssmDocumentInterface for testing. Versions holds the content of
+// every version of the document, which does not exist while it is empty.
+type MockSSMDocumentClient struct {
+	Versions       []string
+	GetDocumentErr error
+
+	defaultVersion string
+	updateCalls    int
+}
+
+func TestBuildCommandDocument(t *testing.T) {
+	recipe, err := LoadRecipe(bootstrapProfiles[OSFamilyUbuntu], "")
+	assert.NoError(t, err)
+
+	content, err := BuildCommandDocument(recipe, WaitOptions{SSMCommandTimeout: 15 * time.Minute})
+	assert.NoError(t, err)
+	var document commandDocument
+	assert.NoError(t, json.Unmarshal([]byte(content), &document))
+
+	assert.Equal(t, "2.2", document.SchemaVersion)
+	assert.Equal(t, recipe.Description, document.Description)
+	assert.Equal(t, "noninteractive", document.Parameters["DEBIAN_FRONTEND"].Default)
+	assert.Len(t, document.MainSteps, len(recipe.Steps))
+	step := document.MainSteps[0]
+	assert.Equal(t, "aws:runShellScript", step.Action)
+	assert.Equal(t, "install-prerequisites", step.Name)
+	assert.Equal(t, "exit", step.OnFailure)
+	assert.Equal(t, 900, step.Inputs.TimeoutSeconds)
+	assert.Equal(t, []string{"set -e", "export DEBIAN_FRONTEND='{{ DEBIAN_FRONTEND }}'", "apt-get update"}, step.Inputs.RunCommand[:3])
+
+	t.Run("DefaultTimeout", func(t *testing.T) {
+		content, err := BuildCommandDocument(Recipe{Name: "jenkins", Steps: []CommandStep{{Name: "install", Commands: []string{"true"}}}}, WaitOptions{})
+		assert.NoError(t, err)
+		assert.Contains(t, content, `"timeoutSeconds": 600`)
+		assert.Contains(t, content, `"description": "Runs the jenkins recipe"`)
+		assert.NotContains(t, content, `"parameters"`)
+	})
+
+	t.Run("StepNameCollision", func(t *testing.T) {
+		_, err := BuildCommandDocument(Recipe{Name: "jenkins", Steps: []CommandStep{
+			{Name: "install jenkins", Commands: []string{"true"}},
+			{Name: "install/jenkins", Commands: []string{"true"}},
+		}}, WaitOptions{})
+		assert.EqualError(t, err, `steps "install jenkins" and "install/jenkins" have the same document step name install-jenkins`)
+	})
+
+	t.Run("ParameterSyntax", func(t *testing.T) {
+		_, err := BuildCommandDocument(Recipe{Name: "jenkins", Steps: []CommandStep{
+			{Name: "install", Commands: []string{"echo {{ .port }}"}},
+		}}, WaitOptions{})
+		assert.EqualError(t, err, `step "install": "echo {{ .port }}" contains {{, which SSM documents read as a parameter`)
+	})
+}
+
+func TestEnsureSSMDocument(t *testing.T) {
+	content := `{"schemaVersion": "2.2", "description": "v2", "mainSteps": []}`
+
+	t.Run("Create", func(t *testing.T) {
+		client := &MockSSMDocumentClient{}
+		result, err := EnsureSSMDocument(client, "jenkins-install", content)
+		assert.NoError(t, err)
+		assert.Equal(t, &SSMDocumentResult{Name: "jenkins-install", Version: "1", Created: true}, result)
+		assert.Equal(t, []string{content}, client.Versions)
+	})
+
+	t.Run("UpToDate", func(t *testing.T) {
+		// Formatting differences do not create a version
+		client := &MockSSMDocumentClient{Versions: []string{"{\n  \"schemaVersion\": \"2.2\",\n  \"description\": \"v2\",\n  \"mainSteps\": []\n}"}}
+		result, err := EnsureSSMDocument(client, "jenkins-install", content)
+		assert.NoError(t, err)
+		assert.Equal(t, &SSMDocumentResult{Name: "jenkins-install", Version: "1"}, result)
+		assert.Equal(t, 0, client.updateCalls)
+	})
+
+	t.Run("NewVersion", func(t *testing.T) {
+		client := &MockSSMDocumentClient{Versions: []string{`{"schemaVersion": "2.2", "description": "v1", "mainSteps": []}`}}
+		result, err := EnsureSSMDocument(client, "jenkins-install", content)
+		assert.NoError(t, err)
+		assert.Equal(t, &SSMDocumentResult{Name: "jenkins-install", Version: "2", Created: true}, result)
+		assert.Equal(t, "2", client.defaultVersion)
+	})
+
+	t.Run("EarlierVersion", func(t *testing.T) {
+		client := &MockSSMDocumentClient{Versions: []string{content, `{"schemaVersion": "2.2", "description": "v3", "mainSteps": []}`}}
+		result, err := EnsureSSMDocument(client, "jenkins-install", content)
+		assert.NoError(t, err)
+		assert.Equal(t, &SSMDocumentResult{Name: "jenkins-install", Version: "1"}, result)
+		assert.Len(t, client.Versions, 2)
+		assert.Equal(t, "1", client.defaultVersion)
+	})
+
+	t.Run("GetDocumentError", func(t *testing.T) {
+		client := &MockSSMDocumentClient{GetDocumentErr: apiError("AccessDeniedException", "denied")}
+		_, err := EnsureSSMDocument(client, "jenkins-install", content)
+		assert.EqualError(t, err, "failed to get SSM document jenkins-install: api error AccessDeniedException: denied")
+	})
+}
+
+func TestRunSSMDocument(t *testing.T) {
+	waits := WaitOptions{SSMCommandTimeout: time.Second}
+	document := &SSMDocumentResult{Name: "jenkins-install", Version: "3"}
+	recipe := Recipe{Name: "jenkins", Steps: []CommandStep{
+		{Name: "install docker", Commands: []string{"true"}},
+		{Name: "install jenkins", Commands: []string{"true"}},
+		{Name: "install aws cli", Commands: []string{"true"}},
+	}}
+
+	t.Run("Success", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess, Stdout: "done"}}}
+		results, err := RunSSMDocument(client, "i-123456", document, recipe, waits, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins-install", aws.ToString(client.sendInput.DocumentName))
+		assert.Equal(t, "3", aws.ToString(client.sendInput.DocumentVersion))
+		// One poll by the waiter, then the output of every document step
+		assert.Equal(t, []string{"", "install-docker", "install-jenkins", "install-aws-cli"}, client.pluginNames)
+		assert.Len(t, results, 3)
+		assert.Equal(t, "install jenkins", results[1].Name)
+		assert.Equal(t, "Success", results[1].Status)
+		assert.Equal(t, "done", results[1].Stdout)
+	})
+
+	t.Run("StepFailed", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{
+			{Status: ssmtypes.CommandInvocationStatusFailed},
+			{Status: ssmtypes.CommandInvocationStatusSuccess},
+			{Status: ssmtypes.CommandInvocationStatusFailed, ExitCode: 100, Stderr: "E: Unable to locate package jenkins\n"},
+		}}
+		results, err := RunSSMDocument(client, "i-123456", document, recipe, waits, nil)
+		assert.EqualError(t, err, `step "install jenkins" failed with exit code 100: E: Unable to locate package jenkins`)
+		assert.Equal(t, []string{"", "install-docker", "install-jenkins"}, client.pluginNames)
+		assert.Equal(t, "Failed", results[1].Status)
+		assert.Equal(t, StepResult{Name: "install aws cli", CommandID: "command-123456", Status: "Skipped", ExitCode: -1}, results[2])
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusInProgress}}}
+		results, err := RunSSMDocument(client, "i-123456", document, recipe, WaitOptions{SSMCommandTimeout: 100 * time.Millisecond}, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `step "install docker" failed: SSM command did not complete in time`)
+		assert.Equal(t, "InProgress", results[0].Status)
+		assert.Equal(t, "Skipped", results[1].Status)
+	})
+
+	t.Run("SendCommandError", func(t *testing.T) {
+		client := &MockSSMClient{SendCommandErr: apiError("InvalidDocument", "not found")}
+		_, err := RunSSMDocument(client, "i-123456", document, recipe, waits, nil)
+		assert.EqualError(t, err, "failed to send SSM command: api error InvalidDocument: not found")
+	})
+}
+
+func (client *MockSSMDocumentClient) GetDocument(ctx context.Context, params *ssm.GetDocumentInput, optFns ...func(*ssm.Options)) (*ssm.GetDocumentOutput, error) {
+	if client.GetDocumentErr != nil {
+		return nil, client.GetDocumentErr
+	}
+	if len(client.Versions) == 0 {
+		return nil, &ssmtypes.InvalidDocument{Message: aws.String(fmt.Sprintf("Document with name %s does not exist.", aws.ToString(params.Name)))}
+	}
+	version := len(client.Versions)
+	if aws.ToString(params.DocumentVersion) != "$LATEST" {
+		version, _ = strconv.Atoi(aws.ToString(params.DocumentVersion))
+	}
+	return &ssm.GetDocumentOutput{
+		Name:            params.Name,
+		DocumentVersion: aws.String(strconv.Itoa(version)),
+		Content:         aws.String(client.Versions[version-1]),
+	}, nil
+}
+
+func (client *MockSSMDocumentClient) CreateDocument(ctx context.Context, params *ssm.CreateDocumentInput, optFns ...func(*ssm.Options)) (*ssm.CreateDocumentOutput, error) {
+	client.Versions = append(client.Versions, aws.ToString(params.Content))
+	return &ssm.CreateDocumentOutput{
+		DocumentDescription: &ssmtypes.DocumentDescription{Name: params.Name, DocumentVersion: aws.String("1")},
+	}, nil
+}
+
+func (client *MockSSMDocumentClient) UpdateDocument(ctx context.Context, params *ssm.UpdateDocumentInput, optFns ...func(*ssm.Options)) (*ssm.UpdateDocumentOutput, error) {
+	client.updateCalls++
+	for _, content := range client.Versions {
+		if sameDocumentContent(content, aws.ToString(params.Content)) {
+			return nil, &ssmtypes.DuplicateDocumentContent{Message: aws.String("The content of the association document matches another document.")}
+		}
+	}
+	client.Versions = append(client.Versions, aws.ToString(params.Content))
+	return &ssm.UpdateDocumentOutput{
+		DocumentDescription: &ssmtypes.DocumentDescription{Name: params.Name, DocumentVersion: aws.String(strconv.Itoa(len(client.Versions)))},
+	}, nil
+}
+
+func (client *MockSSMDocumentClient) UpdateDocumentDefaultVersion(ctx context.Context, params *ssm.UpdateDocumentDefaultVersionInput, optFns ...func(*ssm.Options)) (*ssm.UpdateDocumentDefaultVersionOutput, error) {
+	client.defaultVersion = aws.ToString(params.DocumentVersion)
+	return &ssm.UpdateDocumentDefaultVersionOutput{}, nil
+}
+
+func (client *MockSSMDocumentClient) ListDocumentVersions(ctx context.Context, params *ssm.ListDocumentVersionsInput, optFns ...func(*ssm.Options)) (*ssm.ListDocumentVersionsOutput, error) {
+	var versions []ssmtypes.DocumentVersionInfo
+	for i := range client.Versions {
+		versions = append(versions, ssmtypes.DocumentVersionInfo{Name: params.Name, DocumentVersion: aws.String(strconv.Itoa(i + 1))})
+	}
+	return &ssm.ListDocumentVersionsOutput{DocumentVersions: versions}, nil
+}
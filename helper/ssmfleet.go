@@ -0,0 +1,254 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+type ssmFleetInterface interface {
+	SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error)
+	ListCommands(ctx context.Context, params *ssm.ListCommandsInput, optFns ...func(*ssm.Options)) (*ssm.ListCommandsOutput, error)
+	ListCommandInvocations(ctx context.Context, params *ssm.ListCommandInvocationsInput, optFns ...func(*ssm.Options)) (*ssm.ListCommandInvocationsOutput, error)
+}
+
+// How often the status of a fleet command is checked
+var fleetCommandPollInterval = 5 * time.Second
+
+// FleetTargets selects the managed instances a fleet command runs on. An instance has to match
+// every tag; a tag without values matches any instance having the tag key.
+type FleetTargets struct {
+	Tags          map[string][]string
+	ResourceGroup string
+}
+
+// AddTag adds a Key=Value1,Value2 or Key target.
+func (targets *FleetTargets) AddTag(spec string) error {
+	key, value, _ := strings.Cut(spec, "=")
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return fmt.Errorf("invalid tag target %q: expected Key=Value1,Value2 or Key", spec)
+	}
+	if targets.Tags == nil {
+		targets.Tags = map[string][]string{}
+	}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			targets.Tags[key] = append(targets.Tags[key], v)
+		}
+	}
+	if _, ok := targets.Tags[key]; !ok {
+		targets.Tags[key] = nil
+	}
+	return nil
+}
+
+// ssmTargets converts the targets into the Targets of SendCommand.
+func (targets FleetTargets) ssmTargets() ([]ssmtypes.Target, error) {
+	var keys []string
+	for key := range targets.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var result []ssmtypes.Target
+	var tagKeys []string
+	for _, key := range keys {
+		if len(targets.Tags[key]) == 0 {
+			tagKeys = append(tagKeys, key)
+			continue
+		}
+		result = append(result, ssmtypes.Target{Key: aws.String("tag:" + key), Values: targets.Tags[key]})
+	}
+	if len(tagKeys) > 0 {
+		result = append(result, ssmtypes.Target{Key: aws.String("tag-key"), Values: tagKeys})
+	}
+	if targets.ResourceGroup != "" {
+		result = append(result, ssmtypes.Target{Key: aws.String("resource-groups:Name"), Values: []string{targets.ResourceGroup}})
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no targets given, expected tags or a resource group")
+	}
+	return result, nil
+}
+
+// FleetCommandOptions configures a command run on all instances matching the targets.
+type FleetCommandOptions struct {
+	Targets        FleetTargets
+	MaxConcurrency string // instances running the command at once, a number or percentage; 50 when empty
+	MaxErrors      string // failed instances after which the command is not sent to more; 0 when empty
+	Comment        string
+}
+
+// FleetInstanceResult is the outcome of a fleet command on one instance.
+type FleetInstanceResult struct {
+	InstanceID      string  `json:"instanceId"`
+	InstanceName    string  `json:"instanceName,omitempty"`
+	Status          string  `json:"status"`
+	ExitCode        int32   `json:"exitCode"` // -1 when the command did not finish
+	DurationSeconds float64 `json:"durationSeconds"`
+	Output          string  `json:"output,omitempty"` // first 2,500 characters
+}
+
+// Succeeded reports whether the command completed successfully on the instance.
+func (result FleetInstanceResult) Succeeded() bool {
+	return result.Status == string(ssmtypes.CommandInvocationStatusSuccess)
+}
+
+// FleetCommandResult aggregates the outcome of a fleet command over its instances.
+type FleetCommandResult struct {
+	CommandID string                `json:"commandId"`
+	Status    string                `json:"status"`
+	Instances []FleetInstanceResult `json:"instances"`
+}
+
+// Failed returns the number of instances the command did not succeed on.
+func (result *FleetCommandResult) Failed() int {
+	failed := 0
+	for _, instance := range result.Instances {
+		if !instance.Succeeded() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// RunFleetCommand sends the shell commands to every instance matching the targets, in batches of
+// MaxConcurrency, and waits for the command to finish on all of them. The per-instance results
+// are returned also on failure; the command fails when it did not succeed on every instance.
+func RunFleetCommand(client ssmFleetInterface, commands []string, options FleetCommandOptions, waits WaitOptions) (*FleetCommandResult, error) {
+	waits = waits.withDefaults()
+	targets, err := options.Targets.ssmTargets()
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.SendCommand(context.Background(), &ssm.SendCommandInput{
+		Targets:        targets,
+		DocumentName:   aws.String("AWS-RunShellScript"),
+		MaxConcurrency: optionalString(options.MaxConcurrency),
+		MaxErrors:      optionalString(options.MaxErrors),
+		Comment:        optionalString(options.Comment),
+		Parameters: map[string][]string{
+			"commands": commands,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send SSM command: %v", err)
+	}
+	result := &FleetCommandResult{CommandID: aws.ToString(output.Command.CommandId)}
+	log.Printf("Sent SSM command %s to %d instances\n", result.CommandID, output.Command.TargetCount)
+
+	waitErr := waitForFleetCommand(client, result, waits)
+	if err := listFleetInvocations(client, result); err != nil {
+		return result, err
+	}
+	switch {
+	case waitErr != nil:
+		return result, waitErr
+	case len(result.Instances) == 0:
+		return result, fmt.Errorf("no instances match the targets")
+	case result.Failed() > 0:
+		return result, fmt.Errorf("SSM command %s failed on %d of %d instances", result.CommandID, result.Failed(), len(result.Instances))
+	}
+	return result, nil
+}
+
+// waitForFleetCommand polls the command until it has finished on all targets and records its status.
+func waitForFleetCommand(client ssmFleetInterface, result *FleetCommandResult, waits WaitOptions) error {
+	started := time.Now()
+	deadline := started.Add(waits.SSMCommandTimeout)
+	for {
+		listOutput, err := client.ListCommands(context.Background(), &ssm.ListCommandsInput{
+			CommandId: aws.String(result.CommandID),
+		})
+		if err != nil && !isRetryableError(err) {
+			return fmt.Errorf("failed to list SSM command %s: %v", result.CommandID, err)
+		}
+
+		state, detail := "error", ""
+		switch {
+		case err != nil:
+			detail = err.Error()
+		case len(listOutput.Commands) == 0:
+			state = "pending"
+		default:
+			command := listOutput.Commands[0]
+			result.Status = string(command.Status)
+			state = result.Status
+			detail = fmt.Sprintf("%d of %d completed, %d errors", command.CompletedCount, command.TargetCount, command.ErrorCount)
+		}
+		waits.reportCommand(result.CommandID, PhaseSSMCommand, started, state, detail)
+
+		switch ssmtypes.CommandStatus(result.Status) {
+		case ssmtypes.CommandStatusSuccess, ssmtypes.CommandStatusFailed, ssmtypes.CommandStatusTimedOut, ssmtypes.CommandStatusCancelled:
+			return nil
+		}
+		if time.Now().Add(fleetCommandPollInterval).After(deadline) {
+			return fmt.Errorf("SSM command %s did not complete within %s (status %s)", result.CommandID, waits.SSMCommandTimeout, state)
+		}
+		time.Sleep(fleetCommandPollInterval)
+	}
+}
+
+// listFleetInvocations records the result of the command on every instance it was sent to.
+func listFleetInvocations(client ssmFleetInterface, result *FleetCommandResult) error {
+	result.Instances = nil
+	paginator := ssm.NewListCommandInvocationsPaginator(client, &ssm.ListCommandInvocationsInput{
+		CommandId: aws.String(result.CommandID),
+		Details:   true,
+	})
+	for paginator.HasMorePages() {
+		listOutput, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to list invocations of SSM command %s: %v", result.CommandID, err)
+		}
+		for _, invocation := range listOutput.CommandInvocations {
+			instance := FleetInstanceResult{
+				InstanceID:   aws.ToString(invocation.InstanceId),
+				InstanceName: aws.ToString(invocation.InstanceName),
+				Status:       string(invocation.Status),
+				ExitCode:     -1,
+			}
+			var outputs []string
+			for _, plugin := range invocation.CommandPlugins {
+				instance.ExitCode = plugin.ResponseCode
+				if plugin.ResponseStartDateTime != nil && plugin.ResponseFinishDateTime != nil {
+					instance.DurationSeconds += plugin.ResponseFinishDateTime.Sub(*plugin.ResponseStartDateTime).Seconds()
+				}
+				if output := strings.TrimSpace(aws.ToString(plugin.Output)); output != "" {
+					outputs = append(outputs, output)
+				}
+			}
+			instance.Output = strings.Join(outputs, "\n")
+			result.Instances = append(result.Instances, instance)
+		}
+	}
+	sort.Slice(result.Instances, func(i, j int) bool {
+		return result.Instances[i].InstanceID < result.Instances[j].InstanceID
+	})
+	return nil
+}
+
+// WriteFleetSummary writes a table of the per-instance results followed by the totals.
+func WriteFleetSummary(w io.Writer, result *FleetCommandResult) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "INSTANCE\tNAME\tSTATUS\tEXIT CODE\tDURATION")
+	for _, instance := range result.Instances {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%.1fs\n", instance.InstanceID, instance.InstanceName, instance.Status, instance.ExitCode, instance.DurationSeconds)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	failed := result.Failed()
+	_, err := fmt.Fprintf(w, "%d succeeded, %d failed of %d instances (command %s, status %s)\n", len(result.Instances)-failed, failed, len(result.Instances), result.CommandID, result.Status)
+	return err
+}
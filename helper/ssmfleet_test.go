@@ -0,0 +1,211 @@
+package helper
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of the ssmFleetInterface for testing. Each ListCommands call returns the
+// next command status, the last one repeating.
+type MockSSMFleetClient struct {
+	SendCommandErr            error
+	Statuses                  []ssmtypes.CommandStatus
+	Invocations               []ssmtypes.CommandInvocation
+	ListCommandInvocationsErr error
+
+	sendInput        *ssm.SendCommandInput
+	listCommandsCall int
+}
+
+func TestFleetTargets(t *testing.T) {
+	var targets FleetTargets
+	assert.NoError(t, targets.AddTag("Role=jenkins,agent"))
+	assert.NoError(t, targets.AddTag("Env = prod"))
+	assert.NoError(t, targets.AddTag("Managed"))
+	assert.EqualError(t, targets.AddTag("=prod"), `invalid tag target "=prod": expected Key=Value1,Value2 or Key`)
+	targets.ResourceGroup = "jenkins-fleet"
+
+	ssmTargets, err := targets.ssmTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []ssmtypes.Target{
+		{Key: aws.String("tag:Env"), Values: []string{"prod"}},
+		{Key: aws.String("tag:Role"), Values: []string{"jenkins", "agent"}},
+		{Key: aws.String("tag-key"), Values: []string{"Managed"}},
+		{Key: aws.String("resource-groups:Name"), Values: []string{"jenkins-fleet"}},
+	}, ssmTargets)
+
+	_, err = FleetTargets{}.ssmTargets()
+	assert.EqualError(t, err, "no targets given, expected tags or a resource group")
+}
+
+func TestRunFleetCommand(t *testing.T) {
+	pollInterval := fleetCommandPollInterval
+	fleetCommandPollInterval = time.Millisecond
+	defer func() { fleetCommandPollInterval = pollInterval }()
+
+	options := FleetCommandOptions{
+		Targets:        FleetTargets{Tags: map[string][]string{"Role": {"jenkins"}}},
+		MaxConcurrency: "10%",
+		MaxErrors:      "1",
+	}
+	waits := WaitOptions{SSMCommandTimeout: time.Second}
+	started := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	invocation := func(instanceID string, status ssmtypes.CommandInvocationStatus, exitCode int32, output string) ssmtypes.CommandInvocation {
+		return ssmtypes.CommandInvocation{
+			InstanceId: aws.String(instanceID),
+			Status:     status,
+			CommandPlugins: []ssmtypes.CommandPlugin{{
+				ResponseCode:           exitCode,
+				Output:                 aws.String(output),
+				ResponseStartDateTime:  aws.Time(started),
+				ResponseFinishDateTime: aws.Time(started.Add(1500 * time.Millisecond)),
+			}},
+		}
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		client := &MockSSMFleetClient{
+			Statuses: []ssmtypes.CommandStatus{ssmtypes.CommandStatusInProgress, ssmtypes.CommandStatusSuccess},
+			Invocations: []ssmtypes.CommandInvocation{
+				invocation("i-222222", ssmtypes.CommandInvocationStatusSuccess, 0, "active\n"),
+				invocation("i-111111", ssmtypes.CommandInvocationStatusSuccess, 0, "active\n"),
+			},
+		}
+		result, err := RunFleetCommand(client, []string{"systemctl is-active jenkins"}, options, waits)
+		assert.NoError(t, err)
+		assert.Equal(t, "Success", result.Status)
+		assert.Equal(t, 2, client.listCommandsCall)
+		assert.Equal(t, "tag:Role", aws.ToString(client.sendInput.Targets[0].Key))
+		assert.Equal(t, "10%", aws.ToString(client.sendInput.MaxConcurrency))
+		assert.Equal(t, "1", aws.ToString(client.sendInput.MaxErrors))
+		assert.Nil(t, client.sendInput.InstanceIds)
+		assert.Equal(t, []FleetInstanceResult{
+			{InstanceID: "i-111111", Status: "Success", DurationSeconds: 1.5, Output: "active"},
+			{InstanceID: "i-222222", Status: "Success", DurationSeconds: 1.5, Output: "active"},
+		}, result.Instances)
+	})
+
+	t.Run("Progress", func(t *testing.T) {
+		var events []ProgressEvent
+		client := &MockSSMFleetClient{
+			Statuses:    []ssmtypes.CommandStatus{ssmtypes.CommandStatusSuccess},
+			Invocations: []ssmtypes.CommandInvocation{invocation("i-111111", ssmtypes.CommandInvocationStatusSuccess, 0, "active")},
+		}
+		_, err := RunFleetCommand(client, []string{"systemctl is-active jenkins"}, options, WaitOptions{
+			SSMCommandTimeout: time.Second,
+			Progress:          func(event ProgressEvent) { events = append(events, event) },
+		})
+		assert.NoError(t, err)
+		assert.Len(t, events, 1)
+		assert.Equal(t, "command-123456", events[0].CommandID)
+		assert.Empty(t, events[0].InstanceID)
+		assert.Equal(t, "command command-123456 ssmCommand: Success after 0s (0 of 1 completed, 0 errors)", events[0].String())
+	})
+
+	t.Run("PartialFailure", func(t *testing.T) {
+		client := &MockSSMFleetClient{
+			Statuses: []ssmtypes.CommandStatus{ssmtypes.CommandStatusFailed},
+			Invocations: []ssmtypes.CommandInvocation{
+				invocation("i-111111", ssmtypes.CommandInvocationStatusSuccess, 0, "active"),
+				invocation("i-222222", ssmtypes.CommandInvocationStatusFailed, 3, "inactive"),
+			},
+		}
+		result, err := RunFleetCommand(client, []string{"systemctl is-active jenkins"}, options, waits)
+		assert.EqualError(t, err, "SSM command command-123456 failed on 1 of 2 instances")
+		assert.Equal(t, 1, result.Failed())
+		assert.Equal(t, int32(3), result.Instances[1].ExitCode)
+	})
+
+	t.Run("NoInstances", func(t *testing.T) {
+		client := &MockSSMFleetClient{Statuses: []ssmtypes.CommandStatus{ssmtypes.CommandStatusSuccess}}
+		_, err := RunFleetCommand(client, []string{"uptime"}, options, waits)
+		assert.EqualError(t, err, "no instances match the targets")
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		client := &MockSSMFleetClient{
+			Statuses:    []ssmtypes.CommandStatus{ssmtypes.CommandStatusInProgress},
+			Invocations: []ssmtypes.CommandInvocation{{InstanceId: aws.String("i-111111"), Status: ssmtypes.CommandInvocationStatusInProgress}},
+		}
+		result, err := RunFleetCommand(client, []string{"uptime"}, options, WaitOptions{SSMCommandTimeout: 20 * time.Millisecond})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "did not complete within 20ms (status InProgress)")
+		// The instances are reported also on timeout
+		assert.Equal(t, int32(-1), result.Instances[0].ExitCode)
+	})
+
+	t.Run("ListInvocationsError", func(t *testing.T) {
+		client := &MockSSMFleetClient{
+			Statuses:                  []ssmtypes.CommandStatus{ssmtypes.CommandStatusSuccess},
+			ListCommandInvocationsErr: apiError("AccessDeniedException", "denied"),
+		}
+		_, err := RunFleetCommand(client, []string{"uptime"}, options, waits)
+		assert.EqualError(t, err, "failed to list invocations of SSM command command-123456: api error AccessDeniedException: denied")
+	})
+
+	t.Run("SendCommandError", func(t *testing.T) {
+		client := &MockSSMFleetClient{SendCommandErr: apiError("InvalidTarget", "invalid")}
+		result, err := RunFleetCommand(client, []string{"uptime"}, options, waits)
+		assert.EqualError(t, err, "failed to send SSM command: api error InvalidTarget: invalid")
+		assert.Nil(t, result)
+	})
+
+	t.Run("NoTargets", func(t *testing.T) {
+		client := &MockSSMFleetClient{}
+		_, err := RunFleetCommand(client, []string{"uptime"}, FleetCommandOptions{}, waits)
+		assert.Error(t, err)
+		assert.Nil(t, client.sendInput)
+	})
+}
+
+func TestWriteFleetSummary(t *testing.T) {
+	result := &FleetCommandResult{
+		CommandID: "command-123456",
+		Status:    "Failed",
+		Instances: []FleetInstanceResult{
+			{InstanceID: "i-111111", InstanceName: "jenkins-1", Status: "Success", DurationSeconds: 1.5},
+			{InstanceID: "i-222222", Status: "Failed", ExitCode: 3, DurationSeconds: 0.25},
+		},
+	}
+	var buffer bytes.Buffer
+	assert.NoError(t, WriteFleetSummary(&buffer, result))
+	assert.Equal(t, "INSTANCE  NAME       STATUS   EXIT CODE  DURATION\n"+
+		"i-111111  jenkins-1  Success  0          1.5s\n"+
+		"i-222222             Failed   3          0.2s\n"+
+		"1 succeeded, 1 failed of 2 instances (command command-123456, status Failed)\n", buffer.String())
+}
+
+func (client *MockSSMFleetClient) SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
+	client.sendInput = params
+	if client.SendCommandErr != nil {
+		return nil, client.SendCommandErr
+	}
+	return &ssm.SendCommandOutput{
+		Command: &ssmtypes.Command{CommandId: aws.String("command-123456"), TargetCount: int32(len(client.Invocations))},
+	}, nil
+}
+
+func (client *MockSSMFleetClient) ListCommands(ctx context.Context, params *ssm.ListCommandsInput, optFns ...func(*ssm.Options)) (*ssm.ListCommandsOutput, error) {
+	status := client.Statuses[len(client.Statuses)-1]
+	if client.listCommandsCall < len(client.Statuses) {
+		status = client.Statuses[client.listCommandsCall]
+	}
+	client.listCommandsCall++
+	return &ssm.ListCommandsOutput{
+		Commands: []ssmtypes.Command{{CommandId: params.CommandId, Status: status, TargetCount: int32(len(client.Invocations))}},
+	}, nil
+}
+
+func (client *MockSSMFleetClient) ListCommandInvocations(ctx context.Context, params *ssm.ListCommandInvocationsInput, optFns ...func(*ssm.Options)) (*ssm.ListCommandInvocationsOutput, error) {
+	if client.ListCommandInvocationsErr != nil {
+		return nil, client.ListCommandInvocationsErr
+	}
+	return &ssm.ListCommandInvocationsOutput{CommandInvocations: client.Invocations}, nil
+}
@@ -0,0 +1,247 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// Directory the command output of every run is stored in when the settings leave it unset
+const defaultSSMOutputDir = "ssm-output"
+
+type outputObjectInterface interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+type outputLogsInterface interface {
+	GetLogEvents(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error)
+}
+
+// Plugin the output of AWS-RunShellScript is streamed under in CloudWatch Logs
+const runShellScriptPlugin = "aws-runShellScript"
+
+// SSMOutputOptions configures where the output of the SSM commands is kept in full.
+// GetCommandInvocation only returns the first 24,000 characters of stdout and 8,000 of stderr.
+type SSMOutputOptions struct {
+	S3Bucket    string // the agent writes the full stdout and stderr of every command here
+	S3KeyPrefix string
+	LogGroup    string // CloudWatch Logs group the output is streamed to while the command runs
+	Dir         string // local directory the output of every run is stored in
+}
+
+// SSMOutput sends the output of the commands of a run to S3 or CloudWatch Logs and stores it locally.
+type SSMOutput struct {
+	Options    SSMOutputOptions
+	Client     outputObjectInterface // reads the full output from S3, unused without a bucket
+	LogsClient outputLogsInterface   // reads the full output from CloudWatch Logs, unused without a log group
+	RunID      string                // subdirectory of the run below Options.Dir
+}
+
+// configure sets the output locations on the command. A nil output leaves the command unchanged.
+func (output *SSMOutput) configure(input *ssm.SendCommandInput) {
+	if output == nil {
+		return
+	}
+	if output.Options.S3Bucket != "" {
+		input.OutputS3BucketName = aws.String(output.Options.S3Bucket)
+		input.OutputS3KeyPrefix = optionalString(output.Options.S3KeyPrefix)
+	}
+	if output.Options.LogGroup != "" {
+		input.CloudWatchOutputConfig = &ssmtypes.CloudWatchOutputConfig{
+			CloudWatchLogGroupName:  aws.String(output.Options.LogGroup),
+			CloudWatchOutputEnabled: true,
+		}
+	}
+}
+
+// collect returns the full output of a finished step, read from S3 when a bucket is set, from
+// CloudWatch Logs for the streams not found there when a log group is set, and from the
+// invocation otherwise. It stores the output below the run directory as <file>.stdout and
+// <file>.stderr. pluginName selects the document step; it is empty for AWS-RunShellScript.
+func (output *SSMOutput) collect(instanceID, pluginName, file string, result *StepResult) (string, string, error) {
+	stdout, stderr := result.Stdout, result.Stderr
+	if output == nil || result.CommandID == "" {
+		return stdout, stderr, nil
+	}
+	full := map[string]string{}
+	var fetchErr error
+	if output.Options.S3Bucket != "" {
+		objects, err := output.fetchS3Output(result.CommandID, instanceID, pluginName)
+		fetchErr = err
+		for name, content := range objects {
+			full[name] = content
+		}
+	}
+	if output.Options.LogGroup != "" && len(full) < 2 {
+		streams, err := output.fetchLogsOutput(result.CommandID, instanceID, pluginName)
+		if fetchErr == nil {
+			fetchErr = err
+		}
+		for name, content := range streams {
+			if _, ok := full[name]; !ok {
+				full[name] = content
+			}
+		}
+	}
+	if output.Options.S3Bucket != "" || output.Options.LogGroup != "" {
+		stdout, stderr = useFullOutput(full, stdout, stderr, fmt.Sprintf("step %q on %s", result.Name, instanceID))
+	}
+
+	dir := output.Options.Dir
+	if dir == "" {
+		dir = defaultSSMOutputDir
+	}
+	dir = filepath.Join(dir, output.RunID, instanceID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return stdout, stderr, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	for _, stream := range []struct{ suffix, content string }{{".stdout", stdout}, {".stderr", stderr}} {
+		outputPath := filepath.Join(dir, file+stream.suffix)
+		if err := os.WriteFile(outputPath, []byte(stream.content), 0644); err != nil {
+			return stdout, stderr, fmt.Errorf("failed to store command output: %v", err)
+		}
+		result.OutputFiles = append(result.OutputFiles, outputPath)
+	}
+	return stdout, stderr, fetchErr
+}
+
+// fetchS3Output reads the stdout and stderr objects the agent wrote for the command on the
+// instance, below <prefix>/<command ID>/<instance ID>/<plugin>/<step>/.
+func (output *SSMOutput) fetchS3Output(commandID, instanceID, pluginName string) (map[string]string, error) {
+	prefix := strings.Trim(output.Options.S3KeyPrefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	prefix += commandID + "/" + instanceID + "/"
+
+	objects := map[string]string{}
+	paginator := s3.NewListObjectsV2Paginator(output.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(output.Options.S3Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		listOutput, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list command output in s3://%s/%s: %v", output.Options.S3Bucket, prefix, err)
+		}
+		for _, object := range listOutput.Contents {
+			key := aws.ToString(object.Key)
+			name := path.Base(key)
+			if name != "stdout" && name != "stderr" {
+				continue
+			}
+			if pluginName != "" && path.Base(path.Dir(key)) != pluginName {
+				continue
+			}
+			content, err := output.readS3Object(key)
+			if err != nil {
+				return nil, err
+			}
+			objects[name] += content
+		}
+	}
+	return objects, nil
+}
+
+// fetchLogsOutput reads the stdout and stderr log streams the agent wrote for the command on the
+// instance, named <command ID>/<instance ID>/<plugin>/stdout and stderr.
+func (output *SSMOutput) fetchLogsOutput(commandID, instanceID, pluginName string) (map[string]string, error) {
+	if pluginName == "" {
+		pluginName = runShellScriptPlugin
+	}
+	streams := map[string]string{}
+	for _, name := range []string{"stdout", "stderr"} {
+		streamName := path.Join(commandID, instanceID, pluginName, name)
+		paginator := cloudwatchlogs.NewGetLogEventsPaginator(output.LogsClient, &cloudwatchlogs.GetLogEventsInput{
+			LogGroupName:  aws.String(output.Options.LogGroup),
+			LogStreamName: aws.String(streamName),
+			StartFromHead: aws.Bool(true),
+		}, func(o *cloudwatchlogs.GetLogEventsPaginatorOptions) {
+			// The last page repeats its token
+			o.StopOnDuplicateToken = true
+		})
+		var messages []string
+		found := true
+		for paginator.HasMorePages() {
+			eventsOutput, err := paginator.NextPage(context.Background())
+			var notFound *logstypes.ResourceNotFoundException
+			if errors.As(err, &notFound) {
+				found = false
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to get log events of %s in %s: %v", streamName, output.Options.LogGroup, err)
+			}
+			for _, event := range eventsOutput.Events {
+				messages = append(messages, aws.ToString(event.Message))
+			}
+		}
+		if found {
+			streams[name] = strings.Join(messages, "\n")
+		}
+	}
+	return streams, nil
+}
+
+// useFullOutput replaces the invocation output by the full output of each stream that was found.
+// A missing stream keeps the invocation output; the agent uploads no output for an empty stream.
+func useFullOutput(full map[string]string, stdout, stderr, location string) (string, string) {
+	for _, stream := range []struct {
+		name    string
+		content *string
+	}{{"stdout", &stdout}, {"stderr", &stderr}} {
+		content, ok := full[stream.name]
+		switch {
+		case ok:
+			*stream.content = content
+		case *stream.content != "":
+			log.Printf("Warning: no full %s of %s was written by the agent, keeping the output returned by SSM, which may be truncated\n", stream.name, location)
+		}
+	}
+	return stdout, stderr
+}
+
+func (output *SSMOutput) readS3Object(key string) (string, error) {
+	objectOutput, err := output.Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(output.Options.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get s3://%s/%s: %v", output.Options.S3Bucket, key, err)
+	}
+	defer objectOutput.Body.Close()
+	content, err := io.ReadAll(objectOutput.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read s3://%s/%s: %v", output.Options.S3Bucket, key, err)
+	}
+	return string(content), nil
+}
+
+// logStepOutput prints the output of a finished step.
+func logStepOutput(instanceID, name, stdout, stderr string) {
+	if stdout = strings.TrimSpace(stdout); stdout != "" {
+		log.Printf("Output of step %q on %s:\n%s\n", name, instanceID, stdout)
+	}
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		log.Printf("Error output of step %q on %s:\n%s\n", name, instanceID, stderr)
+	}
+}
+
+// stepOutputFile names the stored output of the step, numbered in the order the steps run.
+func stepOutputFile(index int, name string) string {
+	return fmt.Sprintf("%02d-%s", index+1, documentStepName(name))
+}
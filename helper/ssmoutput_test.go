@@ -0,0 +1,267 @@
+package helper
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock implementation of the outputObjectInterface for testing, holding the objects by key.
+type MockS3Client struct {
+	Objects          map[string]string
+	ListObjectsV2Err error
+
+	listInput *s3.ListObjectsV2Input
+	gotKeys   []string
+}
+
+// Mock implementation of the outputLogsInterface for testing, holding the events by stream name.
+// Each page holds one event.
+type MockLogsClient struct {
+	Streams         map[string][]string
+	GetLogEventsErr error
+
+	gotStreams []string
+}
+
+func TestSSMOutputConfigure(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		var output *SSMOutput
+		input := &ssm.SendCommandInput{}
+		output.configure(input)
+		assert.Equal(t, &ssm.SendCommandInput{}, input)
+	})
+
+	t.Run("S3AndCloudWatch", func(t *testing.T) {
+		output := &SSMOutput{Options: SSMOutputOptions{S3Bucket: "jenkins-logs", S3KeyPrefix: "ssm", LogGroup: "/jenkins/ssm"}}
+		input := &ssm.SendCommandInput{}
+		output.configure(input)
+		assert.Equal(t, "jenkins-logs", aws.ToString(input.OutputS3BucketName))
+		assert.Equal(t, "ssm", aws.ToString(input.OutputS3KeyPrefix))
+		assert.Equal(t, "/jenkins/ssm", aws.ToString(input.CloudWatchOutputConfig.CloudWatchLogGroupName))
+		assert.True(t, input.CloudWatchOutputConfig.CloudWatchOutputEnabled)
+	})
+
+	t.Run("LocalOnly", func(t *testing.T) {
+		output := &SSMOutput{Options: SSMOutputOptions{Dir: t.TempDir()}}
+		input := &ssm.SendCommandInput{}
+		output.configure(input)
+		assert.Nil(t, input.OutputS3BucketName)
+		assert.Nil(t, input.CloudWatchOutputConfig)
+	})
+}
+
+func TestSSMOutputCollect(t *testing.T) {
+	fullOutput := strings.Repeat("x", 30000)
+
+	t.Run("S3", func(t *testing.T) {
+		dir := t.TempDir()
+		client := &MockS3Client{Objects: map[string]string{
+			"ssm/command-123456/i-123456/awsrunShellScript/install-jenkins/stdout": fullOutput,
+			"ssm/command-123456/i-123456/awsrunShellScript/install-jenkins/stderr": "warning",
+			"ssm/command-123456/i-123456/awsrunShellScript/install-docker/stdout":  "docker installed",
+		}}
+		output := &SSMOutput{Options: SSMOutputOptions{S3Bucket: "jenkins-logs", S3KeyPrefix: "/ssm/", Dir: dir}, Client: client, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", CommandID: "command-123456", Stdout: fullOutput[:24000]}
+
+		stdout, stderr, err := output.collect("i-123456", "install-jenkins", "02-install-jenkins", &result)
+		assert.NoError(t, err)
+		assert.Equal(t, fullOutput, stdout)
+		assert.Equal(t, "warning", stderr)
+		assert.Equal(t, "ssm/command-123456/i-123456/", aws.ToString(client.listInput.Prefix))
+		assert.Len(t, client.gotKeys, 2)
+
+		stdoutFile := filepath.Join(dir, "run-1", "i-123456", "02-install-jenkins.stdout")
+		assert.Equal(t, []string{stdoutFile, filepath.Join(dir, "run-1", "i-123456", "02-install-jenkins.stderr")}, result.OutputFiles)
+		content, err := os.ReadFile(stdoutFile)
+		assert.NoError(t, err)
+		assert.Equal(t, fullOutput, string(content))
+	})
+
+	t.Run("S3ObjectsMissing", func(t *testing.T) {
+		client := &MockS3Client{Objects: map[string]string{
+			"command-123456/i-123456/awsrunShellScript/0.awsrunShellScript/stderr": "warning",
+		}}
+		output := &SSMOutput{Options: SSMOutputOptions{S3Bucket: "jenkins-logs", Dir: t.TempDir()}, Client: client, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", CommandID: "command-123456", Stdout: "jenkins installed", Stderr: "warn"}
+
+		// Only the stream found in S3 replaces the invocation output
+		stdout, stderr, err := output.collect("i-123456", "", "01-install-jenkins", &result)
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins installed", stdout)
+		assert.Equal(t, "warning", stderr)
+
+		client.Objects = nil
+		stdout, stderr, err = output.collect("i-123456", "", "01-install-jenkins", &result)
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins installed", stdout)
+		assert.Equal(t, "warn", stderr)
+	})
+
+	t.Run("CloudWatchLogs", func(t *testing.T) {
+		client := &MockLogsClient{Streams: map[string][]string{
+			"command-123456/i-123456/aws-runShellScript/stdout": {fullOutput[:20000], fullOutput[20000:]},
+		}}
+		output := &SSMOutput{Options: SSMOutputOptions{LogGroup: "/jenkins/ssm", Dir: t.TempDir()}, LogsClient: client, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", CommandID: "command-123456", Stdout: fullOutput[:24000]}
+
+		stdout, stderr, err := output.collect("i-123456", "", "01-install-jenkins", &result)
+		assert.NoError(t, err)
+		assert.Equal(t, fullOutput[:20000]+"\n"+fullOutput[20000:], stdout)
+		assert.Empty(t, stderr)
+		assert.Equal(t, []string{
+			"command-123456/i-123456/aws-runShellScript/stdout",
+			"command-123456/i-123456/aws-runShellScript/stdout",
+			"command-123456/i-123456/aws-runShellScript/stdout",
+			"command-123456/i-123456/aws-runShellScript/stderr",
+		}, client.gotStreams)
+	})
+
+	t.Run("CloudWatchLogsDocumentStep", func(t *testing.T) {
+		client := &MockLogsClient{Streams: map[string][]string{
+			"command-123456/i-123456/install-jenkins/stderr": {"warning"},
+		}}
+		output := &SSMOutput{Options: SSMOutputOptions{LogGroup: "/jenkins/ssm", Dir: t.TempDir()}, LogsClient: client, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", CommandID: "command-123456", Stdout: "jenkins installed"}
+
+		stdout, stderr, err := output.collect("i-123456", "install-jenkins", "02-install-jenkins", &result)
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins installed", stdout)
+		assert.Equal(t, "warning", stderr)
+	})
+
+	t.Run("CloudWatchLogsAfterS3", func(t *testing.T) {
+		s3Client := &MockS3Client{Objects: map[string]string{
+			"command-123456/i-123456/awsrunShellScript/0.awsrunShellScript/stdout": "from s3",
+		}}
+		logsClient := &MockLogsClient{Streams: map[string][]string{
+			"command-123456/i-123456/aws-runShellScript/stdout": {"from logs"},
+			"command-123456/i-123456/aws-runShellScript/stderr": {"warning"},
+		}}
+		output := &SSMOutput{Options: SSMOutputOptions{S3Bucket: "jenkins-logs", LogGroup: "/jenkins/ssm", Dir: t.TempDir()}, Client: s3Client, LogsClient: logsClient, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", CommandID: "command-123456"}
+
+		// Streams found in S3 are not replaced
+		stdout, stderr, err := output.collect("i-123456", "", "01-install-jenkins", &result)
+		assert.NoError(t, err)
+		assert.Equal(t, "from s3", stdout)
+		assert.Equal(t, "warning", stderr)
+	})
+
+	t.Run("CloudWatchLogsError", func(t *testing.T) {
+		client := &MockLogsClient{GetLogEventsErr: apiError("AccessDeniedException", "denied")}
+		output := &SSMOutput{Options: SSMOutputOptions{LogGroup: "/jenkins/ssm", Dir: t.TempDir()}, LogsClient: client, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", CommandID: "command-123456", Stdout: "truncated"}
+
+		stdout, _, err := output.collect("i-123456", "", "01-install-jenkins", &result)
+		assert.EqualError(t, err, "failed to get log events of command-123456/i-123456/aws-runShellScript/stdout in /jenkins/ssm: api error AccessDeniedException: denied")
+		assert.Equal(t, "truncated", stdout)
+		assert.Len(t, result.OutputFiles, 2)
+	})
+
+	t.Run("Invocation", func(t *testing.T) {
+		dir := t.TempDir()
+		output := &SSMOutput{Options: SSMOutputOptions{Dir: dir}, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", CommandID: "command-123456", Stdout: "jenkins installed"}
+
+		stdout, _, err := output.collect("i-123456", "", "01-install-jenkins", &result)
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins installed", stdout)
+		content, err := os.ReadFile(result.OutputFiles[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "jenkins installed", string(content))
+	})
+
+	t.Run("S3Error", func(t *testing.T) {
+		client := &MockS3Client{ListObjectsV2Err: apiError("AccessDenied", "denied")}
+		output := &SSMOutput{Options: SSMOutputOptions{S3Bucket: "jenkins-logs", Dir: t.TempDir()}, Client: client, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", CommandID: "command-123456", Stdout: "truncated"}
+
+		// The truncated invocation output is kept
+		stdout, _, err := output.collect("i-123456", "", "01-install-jenkins", &result)
+		assert.Equal(t, "failed to list command output in s3://jenkins-logs/command-123456/i-123456/: api error AccessDenied: denied", err.Error())
+		assert.Equal(t, "truncated", stdout)
+		assert.Len(t, result.OutputFiles, 2)
+	})
+
+	t.Run("NotSent", func(t *testing.T) {
+		output := &SSMOutput{Options: SSMOutputOptions{Dir: t.TempDir()}, RunID: "run-1"}
+		result := StepResult{Name: "install jenkins", ExitCode: -1}
+		_, _, err := output.collect("i-123456", "", "01-install-jenkins", &result)
+		assert.NoError(t, err)
+		assert.Empty(t, result.OutputFiles)
+	})
+}
+
+func TestExecuteSSMStepsOutput(t *testing.T) {
+	dir := t.TempDir()
+	client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess, Stdout: "done"}}}
+	output := &SSMOutput{Options: SSMOutputOptions{LogGroup: "/jenkins/ssm", Dir: dir}, LogsClient: &MockLogsClient{}, RunID: "run-1"}
+	steps := []CommandStep{{Name: "install docker", Commands: []string{"dnf install -y docker"}}}
+
+	results, err := ExecuteSSMSteps(client, "i-123456", steps, WaitOptions{SSMCommandTimeout: time.Second}, output)
+	assert.NoError(t, err)
+	assert.Equal(t, "/jenkins/ssm", aws.ToString(client.sendInput.CloudWatchOutputConfig.CloudWatchLogGroupName))
+	assert.Equal(t, []string{
+		filepath.Join(dir, "run-1", "i-123456", "01-install-docker.stdout"),
+		filepath.Join(dir, "run-1", "i-123456", "01-install-docker.stderr"),
+	}, results[0].OutputFiles)
+}
+
+func (client *MockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	client.listInput = params
+	if client.ListObjectsV2Err != nil {
+		return nil, client.ListObjectsV2Err
+	}
+	output := &s3.ListObjectsV2Output{}
+	for key := range client.Objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			output.Contents = append(output.Contents, s3types.Object{Key: aws.String(key)})
+		}
+	}
+	return output, nil
+}
+
+func (client *MockS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	key := aws.ToString(params.Key)
+	client.gotKeys = append(client.gotKeys, key)
+	content, ok := client.Objects[key]
+	if !ok {
+		return nil, apiError("NoSuchKey", key)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(content))}, nil
+}
+
+func (client *MockLogsClient) GetLogEvents(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	name := aws.ToString(params.LogStreamName)
+	client.gotStreams = append(client.gotStreams, name)
+	if client.GetLogEventsErr != nil {
+		return nil, client.GetLogEventsErr
+	}
+	events, ok := client.Streams[name]
+	if !ok {
+		return nil, &logstypes.ResourceNotFoundException{Message: aws.String("The specified log stream does not exist.")}
+	}
+	// The token is the index of the next event; the last page repeats it
+	index, _ := strconv.Atoi(aws.ToString(params.NextToken))
+	output := &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: aws.String(strconv.Itoa(index))}
+	if index < len(events) {
+		output.Events = []logstypes.OutputLogEvent{{Message: aws.String(events[index])}}
+		output.NextForwardToken = aws.String(strconv.Itoa(index + 1))
+	}
+	return output, nil
+}
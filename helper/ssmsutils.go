@@ -2,91 +2,284 @@ package helper
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 )
 
+type ssmCommandInterface interface {
+	SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error)
+	GetCommandInvocation(ctx context.Context, params *ssm.GetCommandInvocationInput, optFns ...func(*ssm.Options)) (*ssm.GetCommandInvocationOutput, error)
+}
+
+type ssmAgentInterface interface {
+	DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error)
+}
+
+type instanceDescribeInterface interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+}
+
+// How often the registration of the SSM agent is checked
+var ssmAgentPollInterval = 10 * time.Second
+
+// WaitForSSMAgent waits until the SSM agent of the instance has registered and reports Online,
+// so commands are not rejected with InvalidInstanceId. On timeout the error lists likely causes.
+func WaitForSSMAgent(client ssmAgentInterface, ec2Client instanceDescribeInterface, instanceID string, waits WaitOptions) error {
+	waits = waits.withDefaults()
+	log.Printf("Waiting for the SSM agent on %s to come online...", instanceID)
+	started := time.Now()
+	deadline := started.Add(waits.SSMAgentTimeout)
+
+	pingStatus := ""
+	for {
+		informationOutput, err := client.DescribeInstanceInformation(context.Background(), &ssm.DescribeInstanceInformationInput{
+			Filters: []ssmtypes.InstanceInformationStringFilter{
+				{
+					Key:    aws.String("InstanceIds"),
+					Values: []string{instanceID},
+				},
+			},
+		})
+		if err != nil && !isRetryableError(err) {
+			return fmt.Errorf("failed to describe instance information: %v", err)
+		}
+
+		state, detail := "notRegistered", ""
+		switch {
+		case err != nil:
+			state, detail = "error", err.Error()
+		case len(informationOutput.InstanceInformationList) > 0:
+			information := informationOutput.InstanceInformationList[0]
+			pingStatus = string(information.PingStatus)
+			state = pingStatus
+			detail = strings.TrimSpace(aws.ToString(information.PlatformName) + " " + aws.ToString(information.AgentVersion))
+		}
+		waits.report(instanceID, PhaseSSMAgent, started, state, detail)
+
+		if pingStatus == string(ssmtypes.PingStatusOnline) {
+			log.Printf("SSM agent on %s is online", instanceID)
+			return nil
+		}
+		if time.Now().Add(ssmAgentPollInterval).After(deadline) {
+			break
+		}
+		time.Sleep(ssmAgentPollInterval)
+	}
+
+	hints := ssmAgentHints(ec2Client, instanceID, pingStatus)
+	return fmt.Errorf("SSM agent on %s did not come online within %s: %s", instanceID, waits.SSMAgentTimeout, strings.Join(hints, "; "))
+}
+
+// WaitForUserData waits until cloud-init has run the user data of the instance. The agent comes
+// online before cloud-init is done, and the recipe steps expect what the user data installs.
+func WaitForUserData(client ssmCommandInterface, instanceID string, waits WaitOptions) error {
+	log.Printf("Waiting for the user data on %s to finish...", instanceID)
+	result, err := runSSMCommand(client, instanceID, []string{
+		"cloud-init status --wait > /dev/null; code=$?",
+		"cloud-init status --long",
+		// 2 means done with recoverable errors, such as deprecated configuration keys
+		`if [ $code -ne 0 ] && [ $code -ne 2 ]; then echo "cloud-init exited with $code, see /var/log/cloud-init-output.log" >&2; exit 1; fi`,
+	}, waits, nil)
+	if err != nil {
+		return fmt.Errorf("user data on %s did not finish: %v", instanceID, err)
+	}
+	log.Printf("User data on %s finished: %s\n", instanceID, strings.Join(strings.Fields(result.Stdout), " "))
+	return nil
+}
+
+// ssmAgentHints lists likely reasons for an agent that did not come online.
+func ssmAgentHints(ec2Client instanceDescribeInterface, instanceID, pingStatus string) []string {
+	var hints []string
+	if pingStatus == string(ssmtypes.PingStatusConnectionLost) {
+		hints = append(hints, "the agent registered but lost its connection, check that it is still running")
+	}
+
+	describeOutput, err := ec2Client.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceID},
+	})
+	if err == nil && len(describeOutput.Reservations) > 0 && len(describeOutput.Reservations[0].Instances) > 0 {
+		instance := describeOutput.Reservations[0].Instances[0]
+		if instance.IamInstanceProfile == nil {
+			hints = append(hints, "no instance profile is attached, the agent needs one allowing AmazonSSMManagedInstanceCore")
+		}
+		if instance.PublicIpAddress == nil {
+			hints = append(hints, "the instance has no public IP, its subnet needs a NAT gateway or VPC endpoints for ssm, ssmmessages and ec2messages")
+		}
+	}
+
+	return append(hints, "check that the user data installed and started the agent in /var/log/cloud-init-output.log")
+}
+
 // Wait for the SSM command to reach a terminal state (from inprogress to Success)
-func waitForSSMCommandCompletion(ssmClient *ssm.Client, commandID, instanceID string) error {
-	waiter := ssm.NewCommandExecutedWaiter(ssmClient)
+func waitForSSMCommandCompletion(client ssmCommandInterface, commandID, instanceID string, waits WaitOptions) error {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), waits.SSMCommandTimeout)
+	defer cancel()
+	var lastErr error
+	var maxDelay time.Duration
+	waiter := ssm.NewCommandExecutedWaiter(client, func(o *ssm.CommandExecutedWaiterOptions) {
+		maxDelay = o.MaxDelay
+		retryable := o.Retryable
+		o.Retryable = func(ctx context.Context, input *ssm.GetCommandInvocationInput, output *ssm.GetCommandInvocationOutput, err error) (bool, error) {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				lastErr = err
+			}
+			state, detail := commandInvocationProgress(output, err)
+			waits.report(instanceID, PhaseSSMCommand, started, state, detail)
+			return retryable(ctx, input, output, err)
+		}
+	})
 	describeCommandInput := &ssm.GetCommandInvocationInput{
 		CommandId:  aws.String(commandID),
 		InstanceId: aws.String(instanceID),
 	}
-	if err := waiter.Wait(context.Background(), describeCommandInput, 10*time.Minute); err != nil {
-		return fmt.Errorf("SSM command did not complete in time: %v", err)
+	// The context ends the wait; the waiter's own limit is longer so that it does not give up first
+	err := waiter.Wait(ctx, describeCommandInput, waits.SSMCommandTimeout+maxDelay)
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("SSM command failed: %v", err)
+	case lastErr != nil:
+		// The waiter keeps polling through errors, so report the last one
+		return fmt.Errorf("SSM command did not complete in time (%s), last error: %v", waits.SSMCommandTimeout, lastErr)
+	default:
+		return fmt.Errorf("SSM command did not complete in time (%s)", waits.SSMCommandTimeout)
 	}
-	return nil
 }
 
-func ExecuteSSMCommands(cfg aws.Config, instanceID string) error {
-	ssmClient := ssm.NewFromConfig(cfg)
-	commands := []string{
-		"sudo apt update",
-		"sudo apt install -y apt-transport-https ca-certificates curl software-properties-common",
-		"curl -fsSL https://download.docker.com/linux/ubuntu/gpg | sudo apt-key add -",
-		"sudo add-apt-repository \"deb [arch=amd64] https://download.docker.com/linux/ubuntu $(lsb_release -cs) stable\"",
-		"sudo apt update",
-		"sudo apt install -y docker-ce",
-		"sudo systemctl start docker",
-		"sudo systemctl enable docker",
-		"sudo usermod -aG docker ubuntu",
-		"sudo curl -L \"https://github.com/docker/compose/releases/latest/download/docker-compose-$(uname -s)-$(uname -m)\" -o /usr/local/bin/docker-compose",
-		"sudo chmod +x /usr/local/bin/docker-compose",
-		"docker --version",
-		"docker-compose --version",
-		"sudo apt update",
-		"sudo apt upgrade",
-		"sudo apt install openjdk-17-jdk",
-		"sudo wget -O /usr/share/keyrings/jenkins-keyring.asc https://pkg.jenkins.io/debian-stable/jenkins.io-2023.key",
-		"echo \"deb [signed-by=/usr/share/keyrings/jenkins-keyring.asc] https://pkg.jenkins.io/debian-stable binary/\" | sudo tee /etc/apt/sources.list.d/jenkins.list > /dev/null",
-		"sudo apt-get update",
-		"sudo apt-get install -y fontconfig openjdk-17-jre",
-		"sudo apt-get install -y jenkins",
-		"sudo systemctl status jenkins",
-		"sudo usermod -aG docker jenkins",
-		"sudo systemctl restart jenkins",
-		"sudo systemctl restart docker",
-		"sudo su - jenkins",
-		"sudo apt-get install -y unzip",
-		"curl \"https://awscli.amazonaws.com/awscli-exe-linux-x86_64.zip\" -o \"awscliv2.zip\"",
-		"unzip awscliv2.zip",
-		"sudo ./aws/install",
-	}
-
-	commandInput := &ssm.SendCommandInput{
+// StepResult is the outcome of one command step on an instance.
+type StepResult struct {
+	Name            string   `json:"name"`
+	CommandID       string   `json:"commandId,omitempty"`
+	Status          string   `json:"status"`
+	ExitCode        int32    `json:"exitCode"` // -1 when the step did not finish
+	DurationSeconds float64  `json:"durationSeconds"`
+	Stdout          string   `json:"stdout,omitempty"`
+	Stderr          string   `json:"stderr,omitempty"`
+	OutputFiles     []string `json:"outputFiles,omitempty"` // full stdout and stderr stored locally
+}
+
+// Status of the steps left out after an earlier step failed
+const stepStatusSkipped = "Skipped"
+
+// sendSSMCommand sends the command, retrying while the agent of a fresh instance has not registered.
+func sendSSMCommand(client ssmCommandInterface, input *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	// A fresh instance is rejected as InvalidInstanceId until its agent has registered
+	var output *ssm.SendCommandOutput
+	err := retryEventualConsistency("sending SSM command to "+strings.Join(input.InstanceIds, ", "), func() error {
+		var err error
+		output, err = client.SendCommand(context.Background(), input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send SSM command: %v", err)
+	}
+	return output, nil
+}
+
+// describeCommandInvocation returns the status, exit code and output of the command on the
+// instance, or of one step of its document when pluginName is set.
+func describeCommandInvocation(client ssmCommandInterface, commandID, instanceID, pluginName string) (StepResult, error) {
+	result := StepResult{CommandID: commandID, ExitCode: -1}
+	input := &ssm.GetCommandInvocationInput{
+		CommandId:  aws.String(commandID),
+		InstanceId: aws.String(instanceID),
+	}
+	if pluginName != "" {
+		input.PluginName = aws.String(pluginName)
+	}
+	describeCommandOutput, err := client.GetCommandInvocation(context.Background(), input)
+	if err != nil {
+		return result, fmt.Errorf("failed to describe command invocation: %v", err)
+	}
+	result.Status = string(describeCommandOutput.Status)
+	result.ExitCode = describeCommandOutput.ResponseCode
+	result.Stdout = aws.ToString(describeCommandOutput.StandardOutputContent)
+	result.Stderr = aws.ToString(describeCommandOutput.StandardErrorContent)
+	return result, nil
+}
+
+// stepError describes the failed step by its exit code and error output when it has them.
+func stepError(result StepResult, err error) error {
+	if result.ExitCode > 0 {
+		return fmt.Errorf("step %q failed with exit code %d: %s", result.Name, result.ExitCode, strings.TrimSpace(result.Stderr))
+	}
+	return fmt.Errorf("step %q failed: %v", result.Name, err)
+}
+
+// runSSMCommand sends the shell commands to the instance, waits for them to complete and
+// returns the status, exit code and output of the invocation. A failed or timed out command is
+// returned as an error carrying its status and error output.
+func runSSMCommand(client ssmCommandInterface, instanceID string, commands []string, waits WaitOptions, commandOutput *SSMOutput) (StepResult, error) {
+	started := time.Now()
+	input := &ssm.SendCommandInput{
 		InstanceIds:  []string{instanceID},
 		DocumentName: aws.String("AWS-RunShellScript"),
 		Parameters: map[string][]string{
 			"commands": commands,
 		},
 	}
-
-	output, err := ssmClient.SendCommand(context.Background(), commandInput)
+	commandOutput.configure(input)
+	output, err := sendSSMCommand(client, input)
 	if err != nil {
-		return fmt.Errorf("failed to send SSM command: %v", err)
+		return StepResult{ExitCode: -1}, err
 	}
-
-	log.Printf("Successfully sent SSM command to install SSM Agent, Docker and Jenkins")
-	log.Printf("SSM Command ID: %s\n", *output.Command.CommandId)
+	commandID := aws.ToString(output.Command.CommandId)
+	log.Printf("SSM Command ID for %s: %s\n", instanceID, commandID)
 
 	// Wait for the command to complete using waiter
-	if err := waitForSSMCommandCompletion(ssmClient, aws.ToString(output.Command.CommandId), instanceID); err != nil {
-		return err
-	}
+	waitErr := waitForSSMCommandCompletion(client, commandID, instanceID, waits.withDefaults())
 
-	describeCommandOutput, err := ssmClient.GetCommandInvocation(context.Background(), &ssm.GetCommandInvocationInput{
-		CommandId:  output.Command.CommandId,
-		InstanceId: aws.String(instanceID),
-	})
+	result, err := describeCommandInvocation(client, commandID, instanceID, "")
+	result.DurationSeconds = time.Since(started).Seconds()
 	if err != nil {
-		return fmt.Errorf("failed to describe command invocation: %v", err)
+		if waitErr != nil {
+			return result, waitErr
+		}
+		return result, err
 	}
-	log.Printf("Command Status: %s\n", describeCommandOutput.Status)
-	log.Printf("Command Output: %v\n", describeCommandOutput.StandardOutputContent)
-	return nil
+	if waitErr != nil {
+		status := result.Status
+		if result.ExitCode >= 0 {
+			status = fmt.Sprintf("%s, exit code %d", status, result.ExitCode)
+		}
+		return result, fmt.Errorf("%v (status %s): %s", waitErr, status, strings.TrimSpace(result.Stderr))
+	}
+	return result, nil
+}
+
+// ExecuteSSMSteps runs the steps on the instance one after another, each as its own SSM command
+// with `set -e`, so a step fails at its first failing shell command. It stops at the first failed
+// step and reports the steps left out as skipped. The results are returned also on failure.
+// The full output of every step is printed and, with output set, stored locally.
+func ExecuteSSMSteps(client ssmCommandInterface, instanceID string, steps []CommandStep, waits WaitOptions, output *SSMOutput) ([]StepResult, error) {
+	var results []StepResult
+	for i, step := range steps {
+		log.Printf("Running step %d/%d %q on %s", i+1, len(steps), step.Name, instanceID)
+		result, err := runSSMCommand(client, instanceID, append([]string{"set -e"}, step.Commands...), waits, output)
+		result.Name = step.Name
+		stdout, stderr, outputErr := output.collect(instanceID, "", stepOutputFile(i, step.Name), &result)
+		if outputErr != nil {
+			log.Printf("Unable to collect the output of step %q on %s: %v\n", step.Name, instanceID, outputErr)
+		}
+		logStepOutput(instanceID, step.Name, stdout, stderr)
+		results = append(results, result)
+		if err != nil {
+			for _, skipped := range steps[i+1:] {
+				results = append(results, StepResult{Name: skipped.Name, Status: stepStatusSkipped, ExitCode: -1})
+			}
+			return results, stepError(result, err)
+		}
+		log.Printf("Step %q on %s succeeded in %.1fs", step.Name, instanceID, result.DurationSeconds)
+	}
+	return results, nil
 }
@@ -3,77 +3,283 @@ package helper
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
 )
 
-func TestExecuteSSMCommands(t *testing.T) {
-	// Load AWS SDK config
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		t.Fatalf("unable to load SDK config, %v", err)
+// Mock implementation of the ssmCommandInterface for testing. Each GetCommandInvocation call
+// returns the next invocation, the last one repeating.
+type MockSSMClient struct {
+	SendCommandErr error
+	Invocations    []MockInvocation
+
+	sendInput       *ssm.SendCommandInput
+	sentCommands    [][]string
+	pluginNames     []string
+	invocationCalls int
+}
+
+type MockInvocation struct {
+	Status   ssmtypes.CommandInvocationStatus
+	ExitCode int32
+	Stdout   string
+	Stderr   string
+	Err      error
+}
+
+func TestRunSSMCommand(t *testing.T) {
+	// Short timeout so the waiter gives up after its first poll
+	waits := WaitOptions{SSMCommandTimeout: time.Second}
+	commands := []string{"sudo apt-get update", "sudo apt-get install -y jenkins"}
+
+	t.Run("Success", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess, Stdout: "jenkins installed"}}}
+		result, err := runSSMCommand(client, "i-123456", commands, waits, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "command-123456", result.CommandID)
+		assert.Equal(t, "Success", result.Status)
+		assert.Equal(t, "jenkins installed", result.Stdout)
+		assert.Equal(t, []string{"i-123456"}, client.sendInput.InstanceIds)
+		assert.Equal(t, "AWS-RunShellScript", aws.ToString(client.sendInput.DocumentName))
+		assert.Equal(t, commands, client.sendInput.Parameters["commands"])
+		// One poll by the waiter, one to retrieve the output
+		assert.Equal(t, 2, client.invocationCalls)
+	})
+
+	t.Run("SendCommandError", func(t *testing.T) {
+		client := &MockSSMClient{SendCommandErr: apiError("AccessDeniedException", "denied")}
+		_, err := runSSMCommand(client, "i-123456", commands, waits, nil)
+		assert.Equal(t, "failed to send SSM command: api error AccessDeniedException: denied", err.Error())
+		assert.Equal(t, 0, client.invocationCalls)
+	})
+
+	t.Run("CommandFailed", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusFailed, ExitCode: 100, Stderr: "E: Unable to locate package jenkins\n"}}}
+		_, err := runSSMCommand(client, "i-123456", commands, waits, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "SSM command failed")
+		assert.Contains(t, err.Error(), "(status Failed, exit code 100): E: Unable to locate package jenkins")
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		var events []ProgressEvent
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusInProgress}}}
+		_, err := runSSMCommand(client, "i-123456", commands, WaitOptions{
+			SSMCommandTimeout: 100 * time.Millisecond,
+			Progress:          func(event ProgressEvent) { events = append(events, event) },
+		}, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "SSM command did not complete in time (100ms)")
+		assert.Contains(t, err.Error(), "(status InProgress)")
+		assert.Len(t, events, 1)
+		assert.Equal(t, PhaseSSMCommand, events[0].Phase)
+		assert.Equal(t, "InProgress", events[0].State)
+	})
+
+	t.Run("OutputRetrievalError", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{
+			{Status: ssmtypes.CommandInvocationStatusSuccess},
+			{Err: apiError("InternalServerError", "unavailable")},
+		}}
+		_, err := runSSMCommand(client, "i-123456", commands, waits, nil)
+		assert.Equal(t, "failed to describe command invocation: api error InternalServerError: unavailable", err.Error())
+	})
+
+	t.Run("WaitErrorWithoutOutput", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Err: apiError("AccessDeniedException", "denied")}}}
+		_, err := runSSMCommand(client, "i-123456", commands, WaitOptions{SSMCommandTimeout: 100 * time.Millisecond}, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "SSM command did not complete in time")
+		assert.Contains(t, err.Error(), "AccessDeniedException")
+	})
+}
+
+func TestExecuteSSMSteps(t *testing.T) {
+	waits := WaitOptions{SSMCommandTimeout: time.Second}
+	steps := []CommandStep{
+		{Name: "install docker", Commands: []string{"sudo apt-get install -y docker.io"}},
+		{Name: "install jenkins", Commands: []string{"sudo apt-get install -y jenkins"}},
+		{Name: "install aws cli", Commands: []string{"sudo ./aws/install"}},
 	}
 
-	// Replace "i-096170992864d5385" with a valid instance ID
-	instanceID := "i-096170992864d5385"
-
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		{
-			name: "Successful Execution",
-			args: args{
-				cfg:        cfg,
-				instanceID: instanceID,
-			},
-			wantErr: false,
-		},
-		{
-			name: "Failed Command Execution",
-			args: args{
-				cfg:        cfg,
-				instanceID: instanceID,
-			},
-			wantErr: true,
-		},
-		{
-			name: "Failed to Send SSM Command",
-			args: args{
-				cfg:        aws.Config{},
-				instanceID: instanceID,
-			},
-			wantErr: true,
-		},
-		{
-			name: "Failed to Describe Command Invocation",
-			args: args{
-				cfg:        cfg,
-				instanceID: "invalid-instance-id",
-			},
-			wantErr: true,
-		},
-		{
-			name: "Timeout",
-			args: args{
-				cfg:        cfg,
-				instanceID: instanceID,
+	t.Run("Success", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess, Stdout: "done\n"}}}
+		results, err := ExecuteSSMSteps(client, "i-123456", steps, waits, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]string{
+			{"set -e", "sudo apt-get install -y docker.io"},
+			{"set -e", "sudo apt-get install -y jenkins"},
+			{"set -e", "sudo ./aws/install"},
+		}, client.sentCommands)
+		assert.Len(t, results, 3)
+		for i, result := range results {
+			assert.Equal(t, steps[i].Name, result.Name)
+			assert.Equal(t, "command-123456", result.CommandID)
+			assert.Equal(t, "Success", result.Status)
+			assert.Equal(t, int32(0), result.ExitCode)
+			assert.Equal(t, "done\n", result.Stdout)
+		}
+	})
+
+	t.Run("StopsAtFirstFailure", func(t *testing.T) {
+		// Waiter poll and output retrieval of the first step, then of the failing second step
+		client := &MockSSMClient{Invocations: []MockInvocation{
+			{Status: ssmtypes.CommandInvocationStatusSuccess},
+			{Status: ssmtypes.CommandInvocationStatusSuccess},
+			{Status: ssmtypes.CommandInvocationStatusFailed, ExitCode: 100, Stderr: "E: Unable to locate package jenkins\n"},
+		}}
+		results, err := ExecuteSSMSteps(client, "i-123456", steps, waits, nil)
+		assert.Equal(t, `step "install jenkins" failed with exit code 100: E: Unable to locate package jenkins`, err.Error())
+		assert.Len(t, client.sentCommands, 2)
+		assert.Equal(t, []StepResult{
+			{Name: "install docker", CommandID: "command-123456", Status: "Success", ExitCode: 0, DurationSeconds: results[0].DurationSeconds},
+			{Name: "install jenkins", CommandID: "command-123456", Status: "Failed", ExitCode: 100, DurationSeconds: results[1].DurationSeconds, Stderr: "E: Unable to locate package jenkins\n"},
+			{Name: "install aws cli", Status: "Skipped", ExitCode: -1},
+		}, results)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusInProgress}}}
+		results, err := ExecuteSSMSteps(client, "i-123456", steps, WaitOptions{SSMCommandTimeout: 100 * time.Millisecond}, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `step "install docker" failed: SSM command did not complete in time`)
+		assert.Equal(t, int32(-1), results[0].ExitCode)
+		assert.Equal(t, "InProgress", results[0].Status)
+		assert.Equal(t, "Skipped", results[1].Status)
+	})
+
+	t.Run("SendCommandError", func(t *testing.T) {
+		client := &MockSSMClient{SendCommandErr: apiError("AccessDeniedException", "denied")}
+		results, err := ExecuteSSMSteps(client, "i-123456", steps, waits, nil)
+		assert.Equal(t, `step "install docker" failed: failed to send SSM command: api error AccessDeniedException: denied`, err.Error())
+		assert.Len(t, results, 3)
+		assert.Equal(t, int32(-1), results[0].ExitCode)
+	})
+}
+
+// Mock implementation of the ssmAgentInterface for testing. Each call returns the next
+// ping status, the last one repeating; an empty status means the agent is not registered.
+type MockSSMAgentClient struct {
+	PingStatuses                   []ssmtypes.PingStatus
+	DescribeInstanceInformationErr error
+
+	calls int
+}
+
+func TestWaitForUserData(t *testing.T) {
+	waits := WaitOptions{SSMCommandTimeout: time.Second}
+
+	t.Run("Done", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusSuccess, Stdout: "status: done\n"}}}
+		assert.NoError(t, WaitForUserData(client, "i-123456", waits))
+		assert.Equal(t, "cloud-init status --wait > /dev/null; code=$?", client.sentCommands[0][0])
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		client := &MockSSMClient{Invocations: []MockInvocation{{Status: ssmtypes.CommandInvocationStatusFailed, ExitCode: 1, Stdout: "status: error\n", Stderr: "cloud-init exited with 1, see /var/log/cloud-init-output.log\n"}}}
+		err := WaitForUserData(client, "i-123456", waits)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "user data on i-123456 did not finish")
+		assert.Contains(t, err.Error(), "cloud-init exited with 1")
+	})
+}
+
+func TestWaitForSSMAgent(t *testing.T) {
+	pollInterval := ssmAgentPollInterval
+	ssmAgentPollInterval = time.Millisecond
+	defer func() { ssmAgentPollInterval = pollInterval }()
+
+	t.Run("Online", func(t *testing.T) {
+		var events []ProgressEvent
+		client := &MockSSMAgentClient{PingStatuses: []ssmtypes.PingStatus{"", "", ssmtypes.PingStatusOnline}}
+		err := WaitForSSMAgent(client, MockEC2Client{}, "i-123456", WaitOptions{
+			SSMAgentTimeout: time.Second,
+			Progress:        func(event ProgressEvent) { events = append(events, event) },
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, client.calls)
+		assert.Equal(t, "notRegistered", events[0].State)
+		assert.Equal(t, "Online", events[2].State)
+		assert.Equal(t, PhaseSSMAgent, events[2].Phase)
+	})
+
+	t.Run("TimeoutWithHints", func(t *testing.T) {
+		client := &MockSSMAgentClient{PingStatuses: []ssmtypes.PingStatus{ssmtypes.PingStatusConnectionLost}}
+		err := WaitForSSMAgent(client, MockEC2Client{}, "i-123456", WaitOptions{SSMAgentTimeout: 20 * time.Millisecond})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "SSM agent on i-123456 did not come online within 20ms")
+		assert.Contains(t, err.Error(), "lost its connection")
+		assert.Contains(t, err.Error(), "no instance profile is attached")
+		assert.Contains(t, err.Error(), "NAT gateway or VPC endpoints")
+	})
+
+	t.Run("DescribeError", func(t *testing.T) {
+		client := &MockSSMAgentClient{DescribeInstanceInformationErr: apiError("AccessDeniedException", "denied")}
+		err := WaitForSSMAgent(client, MockEC2Client{}, "i-123456", WaitOptions{SSMAgentTimeout: time.Second})
+		assert.Equal(t, "failed to describe instance information: api error AccessDeniedException: denied", err.Error())
+	})
+}
+
+func (client *MockSSMAgentClient) DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	if client.DescribeInstanceInformationErr != nil {
+		return nil, client.DescribeInstanceInformationErr
+	}
+	status := client.PingStatuses[len(client.PingStatuses)-1]
+	if client.calls < len(client.PingStatuses) {
+		status = client.PingStatuses[client.calls]
+	}
+	client.calls++
+	if status == "" {
+		return &ssm.DescribeInstanceInformationOutput{}, nil
+	}
+	return &ssm.DescribeInstanceInformationOutput{
+		InstanceInformationList: []ssmtypes.InstanceInformation{
+			{
+				InstanceId:   aws.String(params.Filters[0].Values[0]),
+				PingStatus:   status,
+				PlatformName: aws.String("Ubuntu"),
+				AgentVersion: aws.String("3.3.0.0"),
 			},
-			wantErr: false, // Timeout is not treated as an error in this test
 		},
+	}, nil
+}
+
+func (client *MockSSMClient) SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
+	client.sendInput = params
+	client.sentCommands = append(client.sentCommands, params.Parameters["commands"])
+	if client.SendCommandErr != nil {
+		return nil, client.SendCommandErr
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := ExecuteSSMCommands(tt.args.cfg, tt.args.instanceID); (err != nil) != tt.wantErr {
-				t.Errorf("ExecuteSSMCommands() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
+	return &ssm.SendCommandOutput{
+		Command: &ssmtypes.Command{CommandId: aws.String("command-123456")},
+	}, nil
 }
 
-type args struct {
-	cfg        aws.Config
-	instanceID string
+func (client *MockSSMClient) GetCommandInvocation(ctx context.Context, params *ssm.GetCommandInvocationInput, optFns ...func(*ssm.Options)) (*ssm.GetCommandInvocationOutput, error) {
+	invocation := client.Invocations[len(client.Invocations)-1]
+	if client.invocationCalls < len(client.Invocations) {
+		invocation = client.Invocations[client.invocationCalls]
+	}
+	client.invocationCalls++
+	client.pluginNames = append(client.pluginNames, aws.ToString(params.PluginName))
+	if invocation.Err != nil {
+		return nil, invocation.Err
+	}
+	responseCode := invocation.ExitCode
+	if invocation.Status == ssmtypes.CommandInvocationStatusPending || invocation.Status == ssmtypes.CommandInvocationStatusInProgress {
+		responseCode = -1
+	}
+	return &ssm.GetCommandInvocationOutput{
+		CommandId:             params.CommandId,
+		InstanceId:            params.InstanceId,
+		Status:                invocation.Status,
+		StatusDetails:         aws.String(string(invocation.Status)),
+		ResponseCode:          responseCode,
+		StandardOutputContent: aws.String(invocation.Stdout),
+		StandardErrorContent:  aws.String(invocation.Stderr),
+	}, nil
 }
@@ -0,0 +1,128 @@
+package helper
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// EC2 rejects user data larger than 16 KB (measured before base64 encoding)
+const maxUserDataSize = 16 * 1024
+
+//go:embed bootstrap
+var bootstrapTemplates embed.FS
+
+// UserDataPart is one template rendered into the instance user data.
+type UserDataPart struct {
+	Name     string // used as the MIME part filename
+	Template string // text/template source
+}
+
+// LoadUserDataParts reads the given template files, or the built-in template of the profile when none are given.
+func LoadUserDataParts(profile BootstrapProfile, paths []string) ([]UserDataPart, error) {
+	if len(paths) == 0 {
+		content, err := bootstrapTemplates.ReadFile(profile.BootstrapTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read built-in bootstrap template: %v", err)
+		}
+		return []UserDataPart{{Name: filepath.Base(profile.BootstrapTemplate), Template: string(content)}}, nil
+	}
+
+	var parts []UserDataPart
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read user data template %s: %v", path, err)
+		}
+		parts = append(parts, UserDataPart{Name: filepath.Base(path), Template: string(content)})
+	}
+	return parts, nil
+}
+
+// BuildUserData renders the parts with the given variables. A single part is used as-is,
+// several parts are combined into a multipart MIME document for cloud-init.
+func BuildUserData(parts []UserDataPart, vars map[string]string) (string, error) {
+	if len(parts) == 0 {
+		return "", fmt.Errorf("no user data templates given")
+	}
+
+	rendered := make([]string, len(parts))
+	for i, part := range parts {
+		content, err := renderUserDataPart(part, vars)
+		if err != nil {
+			return "", err
+		}
+		rendered[i] = content
+	}
+
+	userData := rendered[0]
+	if len(parts) > 1 {
+		var err error
+		userData, err = buildMultipartUserData(parts, rendered)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(userData) > maxUserDataSize {
+		return "", fmt.Errorf("user data is %d bytes, exceeding the EC2 limit of %d bytes", len(userData), maxUserDataSize)
+	}
+	return userData, nil
+}
+
+func renderUserDataPart(part UserDataPart, vars map[string]string) (string, error) {
+	tmpl, err := template.New(part.Name).Option("missingkey=error").Parse(part.Template)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse user data template %s: %v", part.Name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("failed to render user data template %s: %v", part.Name, err)
+	}
+	return buf.String(), nil
+}
+
+func buildMultipartUserData(parts []UserDataPart, rendered []string) (string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	for i, content := range rendered {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", userDataContentType(content)+`; charset="us-ascii"`)
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Transfer-Encoding", "7bit")
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, parts[i].Name))
+		partWriter, err := writer.CreatePart(header)
+		if err != nil {
+			return "", fmt.Errorf("failed to create MIME part %s: %v", parts[i].Name, err)
+		}
+		if _, err := partWriter.Write([]byte(content)); err != nil {
+			return "", fmt.Errorf("failed to write MIME part %s: %v", parts[i].Name, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to close MIME document: %v", err)
+	}
+
+	return fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n%s", writer.Boundary(), body.String()), nil
+}
+
+// userDataContentType maps the first line of a part to the cloud-init content type.
+func userDataContentType(content string) string {
+	switch {
+	case strings.HasPrefix(content, "#cloud-config"):
+		return "text/cloud-config"
+	case strings.HasPrefix(content, "#cloud-boothook"):
+		return "text/cloud-boothook"
+	case strings.HasPrefix(content, "#include"):
+		return "text/x-include-url"
+	default:
+		return "text/x-shellscript"
+	}
+}
@@ -0,0 +1,82 @@
+package helper
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadUserDataParts(t *testing.T) {
+	t.Run("BuiltIn", func(t *testing.T) {
+		for family, profile := range bootstrapProfiles {
+			parts, err := LoadUserDataParts(profile, nil)
+			assert.NoError(t, err, family)
+			assert.Len(t, parts, 1)
+			assert.True(t, strings.HasPrefix(parts[0].Template, "#!/bin/bash"))
+			assert.NotRegexp(t, `arch=amd64|_amd64/|x86_64\.zip`, parts[0].Template, family)
+
+			userData, err := BuildUserData(parts, profile.TemplateVars(nil))
+			assert.NoError(t, err, family)
+			assert.Contains(t, userData, "usermod -aG docker "+profile.DefaultUser+"\n", family)
+		}
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := LoadUserDataParts(bootstrapProfiles[OSFamilyUbuntu], []string{"does-not-exist.sh"})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to read user data template does-not-exist.sh")
+	})
+}
+
+func TestBuildUserData(t *testing.T) {
+	t.Run("NoParts", func(t *testing.T) {
+		_, err := BuildUserData(nil, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("SingleScript", func(t *testing.T) {
+		userData, err := BuildUserData([]UserDataPart{
+			{Name: "setup.sh", Template: "#!/bin/bash\necho {{ .greeting }}\n"},
+		}, map[string]string{"greeting": "hello"})
+		assert.NoError(t, err)
+		assert.Equal(t, "#!/bin/bash\necho hello\n", userData)
+	})
+
+	t.Run("MissingVariable", func(t *testing.T) {
+		_, err := BuildUserData([]UserDataPart{
+			{Name: "setup.sh", Template: "#!/bin/bash\necho {{ .greeting }}\n"},
+		}, map[string]string{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to render user data template setup.sh")
+	})
+
+	t.Run("InvalidTemplate", func(t *testing.T) {
+		_, err := BuildUserData([]UserDataPart{
+			{Name: "setup.sh", Template: "#!/bin/bash\necho {{ .greeting\n"},
+		}, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to parse user data template setup.sh")
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		userData, err := BuildUserData([]UserDataPart{
+			{Name: "cloud-config.yaml", Template: "#cloud-config\npackages:\n  - {{ .package }}\n"},
+			{Name: "setup.sh", Template: "#!/bin/bash\necho done\n"},
+		}, map[string]string{"package": "git"})
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(userData, "Content-Type: multipart/mixed; boundary="))
+		assert.Contains(t, userData, "Content-Type: text/cloud-config")
+		assert.Contains(t, userData, "Content-Type: text/x-shellscript")
+		assert.Contains(t, userData, `filename="cloud-config.yaml"`)
+		assert.Contains(t, userData, "  - git\n")
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		_, err := BuildUserData([]UserDataPart{
+			{Name: "setup.sh", Template: "#!/bin/bash\n" + strings.Repeat("#", maxUserDataSize)},
+		}, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "exceeding the EC2 limit")
+	})
+}
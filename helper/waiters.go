@@ -0,0 +1,153 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Phases reported in progress events
+const (
+	PhaseInstanceRunning = "instanceRunning"
+	PhaseStatusChecks    = "statusChecks"
+	PhaseSSMAgent        = "ssmAgent"
+	PhaseSSMCommand      = "ssmCommand"
+)
+
+// Waiter timeouts used when the settings leave them unset
+const (
+	defaultInstanceRunningTimeout = 5 * time.Minute
+	defaultStatusChecksTimeout    = 10 * time.Minute
+	defaultSSMAgentTimeout        = 5 * time.Minute
+	defaultSSMCommandTimeout      = 10 * time.Minute
+	defaultJenkinsTimeout         = 5 * time.Minute
+
+	instanceTerminatedTimeout = 10 * time.Minute
+)
+
+// ProgressEvent describes the state observed by one poll of a waiter.
+type ProgressEvent struct {
+	Time           time.Time `json:"time"`
+	InstanceID     string    `json:"instanceId"`
+	CommandID      string    `json:"commandId,omitempty"` // set instead of the instance for fleet commands
+	Phase          string    `json:"phase"`
+	State          string    `json:"state"`
+	Detail         string    `json:"detail,omitempty"`
+	ElapsedSeconds int       `json:"elapsedSeconds"`
+}
+
+func (event ProgressEvent) String() string {
+	subject := event.InstanceID
+	if subject == "" {
+		subject = "command " + event.CommandID
+	}
+	message := fmt.Sprintf("%s %s: %s after %ds", subject, event.Phase, event.State, event.ElapsedSeconds)
+	if event.Detail != "" {
+		message += " (" + event.Detail + ")"
+	}
+	return message
+}
+
+// WaitOptions configures the waiters of the launch and the SSM commands.
+type WaitOptions struct {
+	InstanceRunningTimeout time.Duration
+	StatusChecksTimeout    time.Duration
+	SSMAgentTimeout        time.Duration
+	SSMCommandTimeout      time.Duration
+	JenkinsTimeout         time.Duration       // until Jenkins answers HTTP after the install
+	Progress               func(ProgressEvent) // called after every poll when set
+}
+
+func (opts WaitOptions) withDefaults() WaitOptions {
+	if opts.InstanceRunningTimeout == 0 {
+		opts.InstanceRunningTimeout = defaultInstanceRunningTimeout
+	}
+	if opts.StatusChecksTimeout == 0 {
+		opts.StatusChecksTimeout = defaultStatusChecksTimeout
+	}
+	if opts.SSMAgentTimeout == 0 {
+		opts.SSMAgentTimeout = defaultSSMAgentTimeout
+	}
+	if opts.SSMCommandTimeout == 0 {
+		opts.SSMCommandTimeout = defaultSSMCommandTimeout
+	}
+	if opts.JenkinsTimeout == 0 {
+		opts.JenkinsTimeout = defaultJenkinsTimeout
+	}
+	return opts
+}
+
+func (opts WaitOptions) report(instanceID, phase string, started time.Time, state, detail string) {
+	opts.emit(ProgressEvent{InstanceID: instanceID, Phase: phase, State: state, Detail: detail}, started)
+}
+
+// reportCommand records the progress of a command sent to many instances at once.
+func (opts WaitOptions) reportCommand(commandID, phase string, started time.Time, state, detail string) {
+	opts.emit(ProgressEvent{CommandID: commandID, Phase: phase, State: state, Detail: detail}, started)
+}
+
+func (opts WaitOptions) emit(event ProgressEvent, started time.Time) {
+	if opts.Progress == nil {
+		return
+	}
+	now := time.Now()
+	event.Time = now.UTC()
+	event.ElapsedSeconds = int(now.Sub(started).Seconds())
+	opts.Progress(event)
+}
+
+func instanceStateProgress(output *ec2.DescribeInstancesOutput, err error) (string, string) {
+	if err != nil {
+		return "error", err.Error()
+	}
+	if output != nil {
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.State == nil {
+					continue
+				}
+				var detail string
+				if instance.StateReason != nil {
+					detail = aws.ToString(instance.StateReason.Message)
+				}
+				return string(instance.State.Name), detail
+			}
+		}
+	}
+	return "pending", ""
+}
+
+func instanceStatusProgress(output *ec2.DescribeInstanceStatusOutput, err error) (string, string) {
+	if err != nil {
+		return "error", err.Error()
+	}
+	if output == nil || len(output.InstanceStatuses) == 0 {
+		return "pending", ""
+	}
+	status := output.InstanceStatuses[0]
+	if status.InstanceStatus == nil {
+		return "pending", ""
+	}
+	var details []string
+	if status.SystemStatus != nil {
+		details = append(details, "system "+string(status.SystemStatus.Status))
+	}
+	for _, detail := range status.InstanceStatus.Details {
+		details = append(details, fmt.Sprintf("%s %s", detail.Name, detail.Status))
+	}
+	return string(status.InstanceStatus.Status), strings.Join(details, ", ")
+}
+
+func commandInvocationProgress(output *ssm.GetCommandInvocationOutput, err error) (string, string) {
+	if err != nil {
+		return "error", err.Error()
+	}
+	if output == nil {
+		return "pending", ""
+	}
+	return string(output.Status), aws.ToString(output.StatusDetails)
+}
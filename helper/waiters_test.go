@@ -0,0 +1,73 @@
+package helper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitOptionsWithDefaults(t *testing.T) {
+	waits := WaitOptions{SSMCommandTimeout: time.Hour}.withDefaults()
+	assert.Equal(t, defaultInstanceRunningTimeout, waits.InstanceRunningTimeout)
+	assert.Equal(t, defaultStatusChecksTimeout, waits.StatusChecksTimeout)
+	assert.Equal(t, time.Hour, waits.SSMCommandTimeout)
+}
+
+func TestProgressStates(t *testing.T) {
+	state, detail := instanceStateProgress(&ec2.DescribeInstancesOutput{
+		Reservations: []types.Reservation{{Instances: []types.Instance{{
+			State:       &types.InstanceState{Name: types.InstanceStateNamePending},
+			StateReason: &types.StateReason{Message: aws.String("pending: launching")},
+		}}}},
+	}, nil)
+	assert.Equal(t, "pending", state)
+	assert.Equal(t, "pending: launching", detail)
+
+	state, detail = instanceStatusProgress(&ec2.DescribeInstanceStatusOutput{
+		InstanceStatuses: []types.InstanceStatus{{
+			InstanceStatus: &types.InstanceStatusSummary{
+				Status:  types.SummaryStatusInitializing,
+				Details: []types.InstanceStatusDetails{{Name: types.StatusNameReachability, Status: types.StatusTypeInitializing}},
+			},
+			SystemStatus: &types.InstanceStatusSummary{Status: types.SummaryStatusOk},
+		}},
+	}, nil)
+	assert.Equal(t, "initializing", state)
+	assert.Equal(t, "system ok, reachability initializing", detail)
+
+	state, _ = instanceStatusProgress(&ec2.DescribeInstanceStatusOutput{}, nil)
+	assert.Equal(t, "pending", state)
+
+	state, detail = commandInvocationProgress(&ssm.GetCommandInvocationOutput{
+		Status:        ssmtypes.CommandInvocationStatusInProgress,
+		StatusDetails: aws.String("InProgress"),
+	}, nil)
+	assert.Equal(t, "InProgress", state)
+	assert.Equal(t, "InProgress", detail)
+
+	state, detail = commandInvocationProgress(nil, fmt.Errorf("throttled"))
+	assert.Equal(t, "error", state)
+	assert.Equal(t, "throttled", detail)
+}
+
+func TestWaitForInstanceRunningProgress(t *testing.T) {
+	var events []ProgressEvent
+	waits := WaitOptions{
+		InstanceRunningTimeout: time.Second,
+		Progress:               func(event ProgressEvent) { events = append(events, event) },
+	}
+	_, err := waitForInstanceRunning(MockEC2Client{}, "i-123456", waits)
+	assert.Error(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "i-123456", events[0].InstanceID)
+	assert.Equal(t, PhaseInstanceRunning, events[0].Phase)
+	assert.Equal(t, "pending", events[0].State)
+	assert.Equal(t, "i-123456 instanceRunning: pending after 0s", events[0].String())
+}
@@ -2,12 +2,22 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"main.go/helper"
 )
 
@@ -17,6 +27,9 @@ var (
 	AmiID        string
 	SubnetID     string
 	IAMRoleName  string
+	Settings     helper.Settings
+
+	report = helper.NewRunReport()
 )
 
 func init() {
@@ -25,39 +38,376 @@ func init() {
 	if err != nil {
 		log.Fatalf("Error fetching secrets from SecretsManager: %v", err)
 	}
+	Settings, err = helper.FetchSettings()
+	if err != nil {
+		log.Fatalf("Error fetching settings from SecretsManager: %v", err)
+	}
 }
 
 func main() {
-	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(Region))
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+	provision()
+}
+
+func loadConfig() (aws.Config, error) {
+	return config.LoadDefaultConfig(context.Background(),
+		config.WithRegion(Region),
+		config.WithRetryer(helper.NewRetryer(Settings.Retry)),
+	)
+}
+
+// provision creates the IAM role, security group and instances, then installs Jenkins over SSM.
+func provision() {
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("unable to load SDK config, %v", err)
+		fatalf("unable to load SDK config, %v", err)
 	}
 
 	ec2Client := ec2.NewFromConfig(cfg)
 	iamClient := iam.NewFromConfig(cfg)
+	stsClient := sts.NewFromConfig(cfg)
+	ssmClient := ssm.NewFromConfig(cfg)
+
+	if Settings.SkipPreflight {
+		log.Println("Skipping preflight permission check")
+	} else {
+		steps := []string{helper.StepIAMRole, helper.StepAMI, helper.StepSecurityGroup, helper.StepEC2Instance, helper.StepSSMCommands, helper.StepAdminPassword}
+		if Settings.IAMRole.PermissionsBoundary != "" {
+			steps = append(steps, helper.StepBoundary)
+		}
+		if helper.AMIUsesSSMParameter(AmiID) {
+			steps = append(steps, helper.StepAMIParameter)
+		}
+		if Settings.BlockDevices.RequiresEncryption() {
+			steps = append(steps, helper.StepEncryption)
+		}
+		if Settings.LaunchTemplateName != "" {
+			steps = append(steps, helper.StepLaunchTemplate)
+		}
+		if Settings.ElasticIP {
+			steps = append(steps, helper.StepElasticIP)
+		}
+		if Settings.DNSRecord.Name != "" {
+			steps = append(steps, helper.StepDNSRecord)
+		}
+		if Settings.SSMDocumentName != "" {
+			steps = append(steps, helper.StepSSMDocument)
+		}
+		if Settings.SSMOutput.S3Bucket != "" {
+			steps = append(steps, helper.StepSSMOutput)
+		}
+		if Settings.SSMOutput.LogGroup != "" {
+			steps = append(steps, helper.StepSSMOutputLogs)
+		}
+		if Settings.JenkinsConfig.AdminSecretName != "" {
+			steps = append(steps, helper.StepJenkinsAdminSecret)
+		}
+		err = helper.CheckPermissions(stsClient, iamClient, steps...)
+		if err != nil {
+			fatalf("preflight permission check failed: %v", err)
+		}
+	}
 
-	roleName, err := helper.EnsureIAMRole(iamClient, IAMRoleName)
+	subnetIDs := Settings.SubnetIDs
+	if len(subnetIDs) == 0 {
+		subnetIDs = []string{SubnetID}
+	}
+	if len(subnetIDs) > 1 {
+		// The instances of all subnets share the security group
+		if _, err := helper.CheckSubnetsVPC(ec2Client, subnetIDs); err != nil {
+			fatalf("invalid subnets: %v", err)
+		}
+	}
+
+	ami, err := helper.ResolveAMI(ec2Client, ssmClient, AmiID, Settings.AMIOwners)
+	if err != nil {
+		fatalf("unable to resolve AMI: %v", err)
+	}
+	report.AMI = ami
+	log.Printf("Using AMI %s\n", ami.ImageID)
+
+	roleName, err := helper.EnsureIAMRole(iamClient, IAMRoleName, Settings.IAMRole)
 	if err != nil {
-		log.Fatalf("unable to ensure IAM role: %v", err)
+		fatalf("unable to ensure IAM role: %v", err)
 	}
+	report.RoleName = roleName
 	log.Printf("Successfully created or ensured IAM role %s\n", roleName)
 	log.Println("Waiting for IAM role to be available...")
 	time.Sleep(10 * time.Second)
 
-	securityGroupID, err := helper.CreateSecurityGroup(ec2Client, SubnetID, true)
+	securityGroupID, err := helper.CreateSecurityGroup(ec2Client, subnetIDs[0], true)
 	if err != nil {
-		log.Fatalf("unable to create security group: %v", err)
+		fatalf("unable to create security group: %v", err)
 	}
+	report.SecurityGroupID = securityGroupID
 	log.Printf("Security group: %s\n", securityGroupID)
 
-	instanceID, publicDNS, err := helper.CreateEC2Instance(ec2Client, securityGroupID, InstanceType, AmiID, roleName)
+	osFamily := Settings.OSFamily
+	if osFamily == "" {
+		osFamily, err = helper.DetectOSFamily(ec2Client, ami.ImageID)
+		if err != nil {
+			fatalf("unable to detect OS family: %v", err)
+		}
+	}
+	profile, err := helper.GetBootstrapProfile(osFamily)
+	if err != nil {
+		fatalf("unable to get bootstrap profile: %v", err)
+	}
+	report.OSFamily = profile.Family
+	log.Printf("Using %s bootstrap profile\n", profile.Family)
+
+	recipe, err := helper.LoadRecipe(profile, Settings.InstallRecipe)
+	if err != nil {
+		fatalf("unable to load install recipe: %v", err)
+	}
+	log.Printf("Using install recipe %s\n", recipe.Name)
+	if Settings.SSMDocumentName != "" {
+		content, err := helper.BuildCommandDocument(recipe, Settings.Waits)
+		if err != nil {
+			fatalf("unable to build SSM document: %v", err)
+		}
+		report.SSMDocument, err = helper.EnsureSSMDocument(ssmClient, Settings.SSMDocumentName, content)
+		if err != nil {
+			fatalf("unable to ensure SSM document: %v", err)
+		}
+	}
+	secretsClient := secretsmanager.NewFromConfig(cfg)
+	var configSteps []helper.CommandStep
+	if Settings.JenkinsConfig.Enabled() {
+		configOptions := Settings.JenkinsConfig
+		configOptions.Region = Region
+		if configSteps, err = helper.BuildJenkinsConfigSteps(configOptions); err != nil {
+			fatalf("unable to build Jenkins configuration: %v", err)
+		}
+		if configOptions.AdminSecretName != "" {
+			secretARN, err := helper.CheckJenkinsAdminSecret(secretsClient, configOptions.AdminSecretName)
+			if err != nil {
+				fatalf("invalid Jenkins admin secret: %v", err)
+			}
+			// The instances read the secret with their role
+			if err := helper.GrantSecretRead(iamClient, roleName, secretARN); err != nil {
+				fatalf("unable to allow the role to read the Jenkins admin secret: %v", err)
+			}
+		}
+	}
+	// The agent writes the full command output with the instance role
+	if err := helper.GrantOutputWrite(iamClient, roleName, Settings.SSMOutput); err != nil {
+		fatalf("unable to allow the role to write the SSM command output: %v", err)
+	}
+	ssmOutput := &helper.SSMOutput{
+		Options:    Settings.SSMOutput,
+		Client:     s3.NewFromConfig(cfg),
+		LogsClient: cloudwatchlogs.NewFromConfig(cfg),
+		RunID:      report.StartedAt.Format("20060102T150405Z"),
+	}
+
+	userDataParts, err := helper.LoadUserDataParts(profile, Settings.UserDataTemplates)
+	if err != nil {
+		fatalf("unable to load user data templates: %v", err)
+	}
+	userData, err := helper.BuildUserData(userDataParts, profile.TemplateVars(Settings.UserDataVars))
+	if err != nil {
+		fatalf("unable to build user data: %v", err)
+	}
+
+	blockDeviceMappings, err := helper.BuildBlockDeviceMappings(ec2Client, ami.ImageID, Settings.BlockDevices)
+	if err != nil {
+		fatalf("unable to build block device mappings: %v", err)
+	}
+	launchOptions := helper.LaunchOptions{
+		BlockDeviceMappings:   blockDeviceMappings,
+		Spot:                  Settings.Spot,
+		FallbackInstanceTypes: Settings.FallbackInstanceTypes,
+		Count:                 Settings.InstanceCount,
+		SubnetIDs:             subnetIDs,
+		MaxConcurrency:        Settings.MaxConcurrency,
+		Waits:                 waitOptions(),
+	}
+
+	if Settings.LaunchTemplateName != "" {
+		templateData := helper.BuildLaunchTemplateData(securityGroupID, InstanceType, ami.ImageID, roleName, userData, launchOptions)
+		launchTemplate, err := helper.EnsureLaunchTemplate(ec2Client, Settings.LaunchTemplateName, Settings.LaunchTemplateVersion, templateData)
+		if err != nil {
+			fatalf("unable to ensure launch template: %v", err)
+		}
+		report.LaunchTemplate = launchTemplate
+		launchOptions.LaunchTemplate = launchTemplate.Specification()
+		log.Printf("Launching from launch template %s version %d\n", launchTemplate.TemplateName, launchTemplate.Version)
+	}
+
+	instances, launchErr := helper.CreateEC2Instances(ec2Client, securityGroupID, InstanceType, ami.ImageID, roleName, userData, launchOptions)
+	report.Instances = instances
+	if len(instances) == 0 {
+		fatalf("unable to create instances: %v", launchErr)
+	}
+	if launchErr != nil {
+		log.Printf("Some instances failed to start: %v\n", launchErr)
+	}
+	for _, instance := range instances {
+		if instance.Error == "" {
+			log.Printf("Created instance %s in %s at %s\n", instance.InstanceID, instance.Network.AvailabilityZone, instance.Network.Address())
+		}
+	}
+
+	// Bootstrap the started instances in parallel; a failing instance does not stop the others
+	bootstrapErr := helper.RunConcurrently(len(instances), Settings.MaxConcurrency, func(i int) error {
+		instance := &report.Instances[i]
+		if instance.Error != "" {
+			return nil
+		}
+		if err := bootstrapInstance(ec2Client, ssmClient, secretsClient, instance, recipe, configSteps, ssmOutput); err != nil {
+			instance.Error = err.Error()
+			return fmt.Errorf("%s: %v", instance.InstanceID, err)
+		}
+		return nil
+	})
+
+	var dnsErr error
+	if Settings.DNSRecord.Name != "" {
+		var healthy []helper.NetworkInfo
+		for _, instance := range report.Instances {
+			if instance.Error == "" {
+				healthy = append(healthy, instance.Network)
+			}
+		}
+		if len(healthy) > 0 {
+			report.DNSRecord, dnsErr = helper.UpsertDNSRecord(route53.NewFromConfig(cfg), Settings.DNSRecord, healthy)
+			if dnsErr != nil {
+				dnsErr = fmt.Errorf("unable to update DNS record: %v", dnsErr)
+			} else {
+				log.Printf("Jenkins is available at http://%s:8080\n", report.DNSRecord.Name)
+			}
+		}
+	}
+
+	if launchErr != nil || bootstrapErr != nil || dnsErr != nil {
+		fatalf("provisioning failed: %v", joinErrors(launchErr, bootstrapErr, dnsErr))
+	}
+
+	writeReport()
+}
+
+// bootstrapInstance associates an Elastic IP when requested, verifies the volumes of a launched
+// instance, installs Jenkins on it, stores its initial admin password, configures it and checks
+// the installed services.
+func bootstrapInstance(ec2Client *ec2.Client, ssmClient *ssm.Client, secretsClient *secretsmanager.Client, instance *helper.LaunchedInstance, recipe helper.Recipe, configSteps []helper.CommandStep, ssmOutput *helper.SSMOutput) error {
+	instanceID := instance.InstanceID
+	if Settings.ElasticIP {
+		network, err := helper.AssociateElasticIP(ec2Client, instanceID)
+		if network.ElasticIPAllocationID != "" {
+			instance.Network = network
+		}
+		if err != nil {
+			return fmt.Errorf("unable to associate Elastic IP: %v", err)
+		}
+		log.Printf("Instance %s is reachable at %s\n", instanceID, network.Address())
+	}
+	if Settings.BlockDevices.RequiresEncryption() {
+		if err := helper.VerifyVolumeEncryption(ec2Client, instanceID); err != nil {
+			return fmt.Errorf("volume encryption check failed: %v", err)
+		}
+	}
+	if err := helper.WaitForSSMAgent(ssmClient, ec2Client, instanceID, waitOptions()); err != nil {
+		return err
+	}
+	if err := helper.WaitForUserData(ssmClient, instanceID, waitOptions()); err != nil {
+		return err
+	}
+	var steps []helper.StepResult
+	var err error
+	if report.SSMDocument != nil {
+		steps, err = helper.RunSSMDocument(ssmClient, instanceID, report.SSMDocument, recipe, waitOptions(), ssmOutput)
+	} else {
+		steps, err = helper.ExecuteSSMSteps(ssmClient, instanceID, recipe.CommandSteps(), waitOptions(), ssmOutput)
+	}
+	instance.Steps = steps
 	if err != nil {
-		log.Fatalf("unable to create instance: %v", err)
+		return fmt.Errorf("failed to install Jenkins: %v", err)
+	}
+	if err := unlockJenkins(ssmClient, secretsClient, instance); err != nil {
+		return err
 	}
-	log.Printf("Created instance %s with public DNS %s\n", instanceID, publicDNS)
 
-	err = helper.ExecuteSSMCommands(cfg, instanceID)
+	if len(configSteps) > 0 {
+		steps, err := helper.ExecuteSSMSteps(ssmClient, instanceID, configSteps, waitOptions(), ssmOutput)
+		instance.Steps = append(instance.Steps, steps...)
+		if err != nil {
+			return fmt.Errorf("failed to configure Jenkins: %v", err)
+		}
+		if err := helper.WaitForJenkins(ssmClient, instanceID, waitOptions()); err != nil {
+			return err
+		}
+	}
+
+	instance.Health, err = helper.CheckHealth(ssmClient, instanceID, waitOptions())
 	if err != nil {
-		log.Fatalf("failed to execute SSM commands: %v", err)
+		return fmt.Errorf("unhealthy after bootstrap: %v", err)
+	}
+	log.Printf("Jenkins on %s is available at %s\n", instanceID, instance.Jenkins.URL)
+	return nil
+}
+
+// unlockJenkins waits for Jenkins to answer and stores its initial admin password in Secrets
+// Manager. With several instances, each password gets a secret named after its instance.
+func unlockJenkins(ssmClient *ssm.Client, secretsClient *secretsmanager.Client, instance *helper.LaunchedInstance) error {
+	instanceID := instance.InstanceID
+	if err := helper.WaitForJenkins(ssmClient, instanceID, waitOptions()); err != nil {
+		return err
+	}
+	instance.Jenkins = &helper.JenkinsAccess{URL: helper.JenkinsURL(instance.Network)}
+
+	password, err := helper.ReadInitialAdminPassword(ssmClient, instanceID, waitOptions())
+	if err != nil {
+		return err
+	}
+	secretName := Settings.AdminPasswordSecretName
+	if Settings.InstanceCount > 1 {
+		secretName += "/" + instanceID
+	}
+	description := fmt.Sprintf("Initial Jenkins admin password of %s", instanceID)
+	instance.Jenkins.AdminPasswordSecret, err = helper.StoreSecret(secretsClient, secretName, password, description)
+	if err != nil {
+		return fmt.Errorf("unable to store the initial admin password: %v", err)
+	}
+	log.Printf("Stored the initial admin password of Jenkins on %s in secret %s\n", instanceID, secretName)
+	return nil
+}
+
+// waitOptions returns the configured waiter timeouts, printing and recording every progress event.
+func waitOptions() helper.WaitOptions {
+	waits := Settings.Waits
+	waits.Progress = func(event helper.ProgressEvent) {
+		log.Println(event)
+		report.RecordProgress(event)
+	}
+	return waits
+}
+
+// joinErrors combines the non-nil errors into one message.
+func joinErrors(errs ...error) string {
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// fatalf records the error in the run report before exiting.
+func fatalf(format string, v ...interface{}) {
+	report.Error = fmt.Sprintf(format, v...)
+	writeReport()
+	log.Fatalf(format, v...)
+}
+
+func writeReport() {
+	if err := report.Write(Settings.RunOutputFile); err != nil {
+		log.Printf("unable to write run report: %v", err)
+		return
 	}
+	log.Printf("Run report written to %s\n", Settings.RunOutputFile)
 }